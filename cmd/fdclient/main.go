@@ -50,7 +50,7 @@ func main() {
 	runner := frp.NewRunner(logger)
 
 	// 创建客户端
-	client, err := config.NewClient(cfg, runner, frpBinDir, frpcConfigDir, logger)
+	client, err := config.NewClient(cfg, runner, frpBinDir, frpcConfigDir, baseDir, logger)
 	if err != nil {
 		logger.Fatal().Msgf("创建客户端失败，error=%v", err)
 	}
@@ -1,16 +1,26 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/shellus/frp-daemon/pkg/emqx"
 	cl "github.com/shellus/frp-daemon/pkg/fdclient"
 	"github.com/shellus/frp-daemon/pkg/fdctl"
+	"github.com/shellus/frp-daemon/pkg/frp"
+	"github.com/shellus/frp-daemon/pkg/mqtt"
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
 	"github.com/shellus/frp-daemon/pkg/types"
 	"gopkg.in/yaml.v3"
 )
@@ -20,6 +30,15 @@ var logger zerolog.Logger
 // 全局配置路径
 var configFilePath string
 
+// 任务日志路径
+var journalFilePath string
+
+// 被控端历史记录存档路径
+var historyFilePath string
+
+// 全局上下文，收到中断信号时取消，用于中止正在等待的远端调用
+var ctx context.Context
+
 func main() {
 	logger = zerolog.New(zerolog.ConsoleWriter{
 		Out:        os.Stdout,
@@ -41,6 +60,8 @@ func main() {
 	}
 
 	configFilePath = filepath.Join(baseDir, "controller.yaml")
+	journalFilePath = filepath.Join(baseDir, "tasks.jsonl")
+	historyFilePath = filepath.Join(baseDir, "history.jsonl")
 
 	// 加载控制端配置
 	cfg, err := fdctl.LoadControllerConfig(configFilePath)
@@ -48,9 +69,13 @@ func main() {
 		logger.Fatal().Msgf("加载配置失败: %v", err)
 	}
 
+	var stop context.CancelFunc
+	ctx, stop = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// 检查子命令
 	if len(os.Args) < 2 {
-		runController()
+		runController(cfg)
 		return
 	}
 
@@ -66,10 +91,26 @@ func main() {
 		handlePingCmd(cfg)
 	case "status":
 		handleStatusCmd(cfg)
+	case "logs":
+		handleLogsCmd(cfg)
+	case "cancel":
+		handleCancelCmd(cfg)
+	case "schedule":
+		handleScheduleCmd(cfg)
 	case "wol":
 		handleWOLCmd(cfg)
 	case "shutdown-windows":
 		handleShutdownWindowsCmd(cfg)
+	case "tasks":
+		handleTasksCmd(cfg)
+	case "presence":
+		handlePresenceCmd(cfg)
+	case "history":
+		handleHistoryCmd(cfg)
+	case "keygen":
+		handleKeygenCmd(cfg)
+	case "seal-key":
+		handleSealKeyCmd(cfg)
 	default:
 		logger.Fatal().Msgf("未知命令: %s", os.Args[1])
 	}
@@ -80,6 +121,7 @@ func handleNewCmd(cfg *fdctl.ControllerConfig) {
 	// 创建new子命令
 	newCmd := flag.NewFlagSet("new", flag.ExitOnError)
 	clientName := newCmd.String("name", "", "客户端名称")
+	seal := newCmd.Bool("seal", true, "生成任务负载加密密钥，MQTT代理上只能看到密文")
 
 	// 解析子命令参数
 	if err := newCmd.Parse(os.Args[2:]); err != nil {
@@ -100,17 +142,34 @@ func handleNewCmd(cfg *fdctl.ControllerConfig) {
 		ClientId: types.GenerateRandomString(16),
 		Password: types.GenerateRandomString(32),
 	}
+	if *seal {
+		sealKey, err := task.GenerateSealKey()
+		if err != nil {
+			logger.Fatal().Msgf("生成加密密钥失败: %v", err)
+		}
+		auth.SealKey = sealKey
+	}
 
 	mqttconect, err := api.CreateUser(auth)
 	if err != nil {
 		logger.Fatal().Msgf("创建MQTT用户失败: %v", err)
 	}
 
-	// 将结构体转换为YAML格式
-	yamlStr, err := yaml.Marshal(&cl.ClientConfig{
+	clientConfig := cl.ClientConfig{
 		Client: *auth,
 		Mqtt:   *mqttconect,
-	})
+	}
+	// 控制端已生成签名密钥时，被控端只接受该密钥签名的任务
+	if cfg.SigningKey != "" {
+		key, err := task.ParseSigningKey(cfg.SigningKey)
+		if err != nil {
+			logger.Fatal().Msgf("配置错误，signing_key无效: %v", err)
+		}
+		clientConfig.Security.ControllerKey = task.PublicKeyOf(key)
+	}
+
+	// 将结构体转换为YAML格式
+	yamlStr, err := yaml.Marshal(&clientConfig)
 	if err != nil {
 		logger.Fatal().Msgf("转换客户端配置到YAML失败: %v", err)
 	}
@@ -162,11 +221,11 @@ func handleDeleteCmd(cfg *fdctl.ControllerConfig) {
 	if err != nil {
 		logger.Fatal().Msgf("创建控制器失败: %v", err)
 	}
-	defer ctrl.MqttClient.Disconnect()
+	defer ctrl.Disconnect()
 
 	// 删除实例
-	if err := ctrl.DeleteInstance(clientToDelete.ClientId, *deleteInstanceName); err != nil {
-		logger.Fatal().Msgf("删除实例失败: %v", err)
+	if err := ctrl.DeleteInstance(ctx, clientToDelete.ClientId, *deleteInstanceName); err != nil {
+		fatalRemote("删除实例失败", err)
 	}
 
 	logger.Info().Msgf("成功删除实例: %s", *deleteInstanceName)
@@ -180,6 +239,28 @@ func createController(cfg *fdctl.ControllerConfig) (*fdctl.Controller, error) {
 		return nil, fmt.Errorf("创建控制器失败: %v", err)
 	}
 
+	// 所有下发的任务和收到的响应都记入任务日志
+	journal, err := fdctl.OpenJournal(journalFilePath, logger)
+	if err != nil {
+		return nil, fmt.Errorf("打开任务日志失败: %v", err)
+	}
+	ctrl.SetJournal(journal)
+	// 被控端的状态快照和实例事件记入历史记录存档
+	history, err := fdctl.OpenHistory(historyFilePath, logger)
+	if err != nil {
+		return nil, fmt.Errorf("打开历史记录存档失败: %v", err)
+	}
+	ctrl.SetHistory(history)
+	ctrl.SetClients(cfg.Clients)
+
+	if cfg.SigningKey != "" {
+		key, err := task.ParseSigningKey(cfg.SigningKey)
+		if err != nil {
+			return nil, fmt.Errorf("配置错误，signing_key无效: %v", err)
+		}
+		ctrl.SetSigningKey(key)
+	}
+
 	// 连接MQTT
 	if err := ctrl.ConnectMQTT(); err != nil {
 		return nil, fmt.Errorf("连接MQTT失败: %v", err)
@@ -192,10 +273,17 @@ func createController(cfg *fdctl.ControllerConfig) (*fdctl.Controller, error) {
 func handleUpdateCmd(cfg *fdctl.ControllerConfig) {
 	// 创建update子命令
 	updateCmd := flag.NewFlagSet("update", flag.ExitOnError)
-	updateClientName := updateCmd.String("name", "", "客户端名称")
+	updateClientName := updateCmd.String("name", "", "客户端名称，多个用逗号分隔")
+	updateGroup := updateCmd.String("group", "", "分组名称，对组内所有客户端执行")
+	updateAll := updateCmd.Bool("all", false, "对所有客户端执行")
 	instanceName := updateCmd.String("instance", "", "实例名称")
 	frpVersion := updateCmd.String("version", "", "frp版本")
 	configFile := updateCmd.String("config", "", "配置文件路径")
+	ackTimeout := updateCmd.Duration("ack-timeout", 10*time.Second, "等待被控端确认收到的时间")
+	applyTimeout := updateCmd.Duration("apply-timeout", 2*time.Minute, "等待被控端应用配置的时间")
+	restart := updateCmd.String("restart", "", "实例退出后的重启策略：always、on-failure或never，默认always")
+	maxRetries := updateCmd.Int("max-retries", 0, "连续快速退出多少次后停止重启，默认10，小于0时不限制")
+	stopTimeout := updateCmd.Int("stop-timeout", 0, "停止实例时等待frpc退出的秒数，超过后强制结束，默认10")
 
 	// 解析update子命令参数
 	if err := updateCmd.Parse(os.Args[2:]); err != nil {
@@ -203,9 +291,6 @@ func handleUpdateCmd(cfg *fdctl.ControllerConfig) {
 	}
 
 	// 检查必需参数
-	if *updateClientName == "" {
-		logger.Fatal().Msg("请使用 -name 参数指定客户端名称")
-	}
 	if *instanceName == "" {
 		logger.Fatal().Msg("请使用 -instance 参数指定实例名称")
 	}
@@ -217,16 +302,9 @@ func handleUpdateCmd(cfg *fdctl.ControllerConfig) {
 	}
 
 	// 名称转为clientId
-	var targetClient *types.ClientAuth
-	for _, client := range cfg.Clients {
-		if client.Name == *updateClientName {
-			targetClient = &client
-			break
-		}
-	}
-
-	if targetClient == nil {
-		logger.Fatal().Msgf("未找到名为 %s 的客户端", *updateClientName)
+	targets, err := resolveTargets(cfg, *updateClientName, *updateGroup, *updateAll)
+	if err != nil {
+		logger.Fatal().Msgf("%v", err)
 	}
 
 	// 创建控制器
@@ -237,47 +315,279 @@ func handleUpdateCmd(cfg *fdctl.ControllerConfig) {
 
 	// 创建配置对象
 	config := types.InstanceConfigLocal{
-		Name:       *instanceName,
-		Version:    *frpVersion,
-		ConfigPath: *configFile,
+		Name:        *instanceName,
+		Version:     *frpVersion,
+		ConfigPath:  *configFile,
+		Restart:     restartPolicy(*restart, *maxRetries),
+		StopTimeout: *stopTimeout,
+	}
+
+	defer ctrl.Disconnect()
+
+	// 多个被控端时分别下发，截止时间内没有应用完成的记为超时，上线后仍会自动应用
+	if len(targets) > 1 {
+		passwords := make(map[string]string, len(targets))
+		for _, client := range targets {
+			passwords[client.ClientId] = client.Password
+		}
+		report := ctrl.Group(ctx, clientIdsOf(targets), 0, *ackTimeout+*applyTimeout, func(ctx context.Context, clientId string) error {
+			state, err := ctrl.SendConfig(ctx, clientId, passwords[clientId], config, *ackTimeout, *applyTimeout, nil)
+			if err != nil {
+				return err
+			}
+			if state != fdctl.DeliveryApplied {
+				return fmt.Errorf("%w，%s", task.ErrTimeout, state)
+			}
+			return nil
+		})
+		printGroupReport(cfg, "update", report)
+		return
+	}
+
+	targetClient := targets[0]
+	// 发送配置，等待期间在同一行刷新被控端上报的执行进度
+	progress := &progressLine{}
+	state, err := ctrl.SendConfig(ctx, targetClient.ClientId, targetClient.Password, config, *ackTimeout, *applyTimeout, progress.update)
+	progress.finish()
+	if err != nil {
+		fatalRemote(fmt.Sprintf("发送配置失败，状态=%s", state), err)
+	}
+
+	switch state {
+	case fdctl.DeliveryQueued:
+		logger.Warn().Msgf("配置%s，被控端暂未确认收到，上线后会自动应用: %s[%s]", state, targetClient.Name, targetClient.ClientId)
+	case fdctl.DeliveryReceived:
+		logger.Warn().Msgf("配置%s，尚未返回应用结果: %s[%s]", state, targetClient.Name, targetClient.ClientId)
+	case fdctl.DeliveryApplied:
+		logger.Info().Msgf("配置%s: %s[%s]", state, targetClient.Name, targetClient.ClientId)
+	}
+}
+
+// restartPolicy 由命令行参数生成重启策略，都未指定时返回nil，被控端使用默认策略
+func restartPolicy(policy string, maxRetries int) *types.RestartPolicy {
+	if policy == "" && maxRetries == 0 {
+		return nil
+	}
+	restart := &types.RestartPolicy{Policy: policy, MaxRetries: maxRetries}
+	if err := frp.ValidateRestartPolicy(restart); err != nil {
+		logger.Fatal().Msgf("%v", err)
 	}
+	return restart
+}
 
-	// 发送配置
-	if err := ctrl.SendConfig(targetClient.ClientId, targetClient.Password, config); err != nil {
-		logger.Fatal().Msgf("发送配置失败: %v", err)
+// progressLine 在终端同一行刷新任务执行进度
+type progressLine struct {
+	mu      sync.Mutex
+	printed bool
+	done    bool
+}
+
+func (p *progressLine) update(msg task.MessageProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
 	}
+	line := fmt.Sprintf("执行中: %s", msg.Phase)
+	if msg.Percent >= 0 {
+		line = fmt.Sprintf("%s %3d%%", line, msg.Percent)
+	}
+	fmt.Printf("\r%-40s", line)
+	p.printed = true
+}
 
-	// 下发不代表客户端已经收到
-	logger.Info().Msgf("配置已成功下发: %s[%s]", *updateClientName, targetClient.ClientId)
+// finish 结束进度行，之后的日志从新的一行开始
+func (p *progressLine) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.printed {
+		fmt.Println()
+	}
+	p.done = true
+}
+
+// 处理cancel子命令，取消已下发的任务，-id可以从fdctl tasks list查到
+func handleCancelCmd(cfg *fdctl.ControllerConfig) {
+	cancelCmd := flag.NewFlagSet("cancel", flag.ExitOnError)
+	messageId := cancelCmd.String("id", "", "要取消的任务消息ID")
+	clientName := cancelCmd.String("name", "", "客户端名称，为空时从任务日志中查找接收方")
+	if err := cancelCmd.Parse(os.Args[2:]); err != nil {
+		logger.Fatal().Msgf("解析参数失败: %v", err)
+	}
+	if *messageId == "" {
+		logger.Fatal().Msg("请使用 -id 参数指定要取消的任务消息ID")
+	}
+
+	var clientId string
+	if *clientName != "" {
+		client := findClient(cfg, *clientName)
+		if client == nil {
+			logger.Fatal().Msgf("未找到名为 %s 的客户端", *clientName)
+		}
+		clientId = client.ClientId
+	} else {
+		journal, err := fdctl.OpenJournal(journalFilePath, logger)
+		if err != nil {
+			logger.Fatal().Msgf("打开任务日志失败: %v", err)
+		}
+		record, err := journal.Get(*messageId)
+		if err != nil {
+			logger.Fatal().Msgf("任务日志中没有该任务，请使用 -name 参数指定客户端: %v", err)
+		}
+		clientId = record.Receiver
+	}
+
+	ctrl, err := createController(cfg)
+	if err != nil {
+		logger.Fatal().Msgf("%v", err)
+	}
+	defer ctrl.Disconnect()
+
+	result, err := ctrl.CancelTask(ctx, clientId, *messageId)
+	if err != nil {
+		fatalRemote("取消任务失败", err)
+	}
+	switch {
+	case result.State == mqtt.CancelQueued:
+		logger.Info().Msgf("任务已在执行前取消: %s", *messageId)
+	case result.State == mqtt.CancelScheduled:
+		logger.Info().Msgf("定时任务已取消: %s", *messageId)
+	case result.State == mqtt.CancelRunning || (result.State == "" && result.Canceled):
+		// 旧版本被控端不返回State，Canceled为true时可能是排队中也可能是正在执行
+		logger.Warn().Msgf("任务正在执行，已请求被控端取消，处理器仍可能执行完成，最终结果见 fdctl tasks show -id %s", *messageId)
+	case result.State == mqtt.CancelFinished:
+		logger.Warn().Msgf("任务已执行完成，取消失败: %s", *messageId)
+		os.Exit(1)
+	default:
+		logger.Warn().Msgf("被控端没有找到该任务，可能已过期或尚未送达，状态=%s，canceled=%v", result.State, result.Canceled)
+		os.Exit(1)
+	}
+}
+
+// handleScheduleCmd 处理schedule子命令，下发定时任务和查看被控端保存的定时任务，取消使用fdctl cancel
+func handleScheduleCmd(cfg *fdctl.ControllerConfig) {
+	if len(os.Args) < 3 {
+		logger.Fatal().Msg("用法: fdctl schedule wol|update|list -name <客户端名称> [-at \"2006-01-02 15:04\"] [-cron \"0 7 * * 1-5\"]")
+	}
+
+	scheduleCmd := flag.NewFlagSet("schedule "+os.Args[2], flag.ExitOnError)
+	clientName := scheduleCmd.String("name", "", "客户端名称")
+	at := scheduleCmd.String("at", "", "执行时间，格式为2006-01-02 15:04，按本机时区解析")
+	cron := scheduleCmd.String("cron", "", "cron表达式（分 时 日 月 周），按被控端本地时区执行")
+	macAddress := scheduleCmd.String("mac", "", "wol: 目标设备的MAC地址")
+	instanceName := scheduleCmd.String("instance", "", "update: 实例名称")
+	frpVersion := scheduleCmd.String("version", "", "update: frp版本")
+	configFile := scheduleCmd.String("config", "", "update: 配置文件路径")
+	restart := scheduleCmd.String("restart", "", "update: 实例退出后的重启策略：always、on-failure或never，默认always")
+	maxRetries := scheduleCmd.Int("max-retries", 0, "update: 连续快速退出多少次后停止重启，默认10，小于0时不限制")
+	stopTimeout := scheduleCmd.Int("stop-timeout", 0, "update: 停止实例时等待frpc退出的秒数，超过后强制结束，默认10")
+	if err := scheduleCmd.Parse(os.Args[3:]); err != nil {
+		logger.Fatal().Msgf("解析参数失败: %v", err)
+	}
+
+	if *clientName == "" {
+		logger.Fatal().Msg("请使用 -name 参数指定客户端名称")
+	}
+	client := findClient(cfg, *clientName)
+	if client == nil {
+		logger.Fatal().Msgf("未找到名为 %s 的客户端", *clientName)
+	}
+
+	var schedule fdctl.Schedule
+	schedule.Cron = *cron
+	if *at != "" {
+		notBefore, err := time.ParseInLocation("2006-01-02 15:04", *at, time.Local)
+		if err != nil {
+			logger.Fatal().Msgf("解析 -at 参数失败: %v", err)
+		}
+		schedule.NotBefore = notBefore
+	}
+	if os.Args[2] != "list" && schedule.NotBefore.IsZero() && schedule.Cron == "" {
+		logger.Fatal().Msg("请使用 -at 或 -cron 参数指定执行时间")
+	}
+
+	ctrl, err := createController(cfg)
+	if err != nil {
+		logger.Fatal().Msgf("%v", err)
+	}
+	defer ctrl.Disconnect()
+
+	var scheduled *fdctl.ScheduledTask
+	switch os.Args[2] {
+	case "wol":
+		if *macAddress == "" {
+			logger.Fatal().Msg("请使用 -mac 参数指定目标设备的MAC地址")
+		}
+		scheduled, err = ctrl.ScheduleWOL(ctx, client.ClientId, *macAddress, schedule)
+	case "update":
+		if *instanceName == "" || *frpVersion == "" || *configFile == "" {
+			logger.Fatal().Msg("请使用 -instance、-version 和 -config 参数指定要下发的实例")
+		}
+		scheduled, err = ctrl.ScheduleConfig(ctx, client.ClientId, client.Password, types.InstanceConfigLocal{
+			Name:        *instanceName,
+			Version:     *frpVersion,
+			ConfigPath:  *configFile,
+			Restart:     restartPolicy(*restart, *maxRetries),
+			StopTimeout: *stopTimeout,
+		}, schedule)
+	case "list":
+		infos, err := ctrl.ListSchedules(ctx, client.ClientId)
+		if err != nil {
+			fatalRemote("列出定时任务失败", err)
+		}
+		for _, info := range infos {
+			next := "已执行"
+			if info.NextRun != 0 {
+				next = time.Unix(info.NextRun, 0).Format(time.DateTime)
+			}
+			line := fmt.Sprintf("%s action=%s next=%s runs=%d", info.MessageId, info.Action, next, info.Runs)
+			if info.Cron != "" {
+				line += fmt.Sprintf(" cron=%q", info.Cron)
+			}
+			if info.LastRun != 0 {
+				line += fmt.Sprintf(" last=%s", time.Unix(info.LastRun, 0).Format(time.DateTime))
+			}
+			if info.LastError != "" {
+				line += fmt.Sprintf(" error=[%s] %s", info.LastCode, info.LastError)
+			}
+			logger.Info().Msg(line)
+		}
+		if len(infos) == 0 {
+			logger.Info().Msg("没有定时任务")
+		}
+		return
+	default:
+		logger.Fatal().Msgf("未知命令: schedule %s", os.Args[2])
+	}
+	if err != nil {
+		fatalRemote("下发定时任务失败", err)
+	}
+	if scheduled.State != fdctl.DeliveryApplied {
+		logger.Warn().Msgf("定时任务%s，被控端上线后保存，messageId=%s", scheduled.State, scheduled.MessageId)
+		return
+	}
+	logger.Info().Msgf("被控端已保存定时任务，messageId=%s，下次执行时间: %s，取消使用 fdctl cancel -id %s",
+		scheduled.MessageId, scheduled.NextRun.Format(time.DateTime), scheduled.MessageId)
 }
 
 // 处理ping子命令
 func handlePingCmd(cfg *fdctl.ControllerConfig) {
 	// 创建ping子命令
 	pingCmd := flag.NewFlagSet("ping", flag.ExitOnError)
-	pingClientName := pingCmd.String("name", "", "客户端名称")
+	pingClientName := pingCmd.String("name", "", "客户端名称，多个用逗号分隔")
+	pingGroup := pingCmd.String("group", "", "分组名称，对组内所有客户端执行")
+	pingAll := pingCmd.Bool("all", false, "对所有客户端执行")
+	timeout := pingCmd.Duration("timeout", 15*time.Second, "对多个客户端执行时，等待整组结果的时间")
 
 	// 解析ping子命令参数
 	if err := pingCmd.Parse(os.Args[2:]); err != nil {
 		logger.Fatal().Msgf("解析参数失败: %v", err)
 	}
 
-	// 检查必需参数
-	if *pingClientName == "" {
-		logger.Fatal().Msg("请使用 -name 参数指定客户端名称")
-	}
-
 	// 名称转为clientId
-	var targetClient *types.ClientAuth
-	for _, client := range cfg.Clients {
-		if client.Name == *pingClientName {
-			targetClient = &client
-			break
-		}
-	}
-
-	if targetClient == nil {
-		logger.Fatal().Msgf("未找到名为 %s 的客户端", *pingClientName)
+	targets, err := resolveTargets(cfg, *pingClientName, *pingGroup, *pingAll)
+	if err != nil {
+		logger.Fatal().Msgf("%v", err)
 	}
 
 	// 创建控制器
@@ -285,13 +595,58 @@ func handlePingCmd(cfg *fdctl.ControllerConfig) {
 	if err != nil {
 		logger.Fatal().Msgf("%v", err)
 	}
+	defer ctrl.Disconnect()
 
+	if len(targets) > 1 {
+		report := ctrl.Group(ctx, clientIdsOf(targets), 0, *timeout, ctrl.SendPing)
+		printGroupReport(cfg, "ping", report)
+		return
+	}
+
+	targetClient := targets[0]
 	// 发送ping消息
-	if err := ctrl.SendPing(targetClient.ClientId); err != nil {
-		logger.Fatal().Msgf("发送ping消息失败: %v", err)
+	result, err := ctrl.Ping(ctx, targetClient.ClientId)
+	if err != nil {
+		fatalRemote("发送ping消息失败", err)
+	}
+
+	logger.Info().Msgf("客户端 %s[%s] 在线，往返延迟: %s，时钟偏差: %s", targetClient.Name, targetClient.ClientId, result.RTT, result.ClockOffset)
+}
+
+// 处理logs子命令
+func handleLogsCmd(cfg *fdctl.ControllerConfig) {
+	logsCmd := flag.NewFlagSet("logs", flag.ExitOnError)
+	logsClientName := logsCmd.String("name", "", "客户端名称")
+	logsInstanceName := logsCmd.String("instance", "", "实例名称")
+	tail := logsCmd.Int("tail", 100, "先显示最近的日志行数")
+	follow := logsCmd.Bool("f", false, "持续跟随新日志，按Ctrl+C停止")
+
+	if err := logsCmd.Parse(os.Args[2:]); err != nil {
+		logger.Fatal().Msgf("解析参数失败: %v", err)
+	}
+	if *logsClientName == "" {
+		logger.Fatal().Msg("请使用 -name 参数指定客户端名称")
+	}
+	if *logsInstanceName == "" {
+		logger.Fatal().Msg("请使用 -instance 参数指定实例名称")
+	}
+	client := findClient(cfg, *logsClientName)
+	if client == nil {
+		logger.Fatal().Msgf("未找到名为 %s 的客户端", *logsClientName)
+	}
+
+	ctrl, err := createController(cfg)
+	if err != nil {
+		logger.Fatal().Msgf("创建控制器失败: %v", err)
 	}
+	defer ctrl.Disconnect()
 
-	logger.Info().Msgf("已向客户端 %s[%s] 发送ping消息", *pingClientName, targetClient.ClientId)
+	err = ctrl.FollowLog(ctx, client.ClientId, *logsInstanceName, *tail, *follow, func(line string) {
+		fmt.Println(line)
+	})
+	if err != nil {
+		fatalRemote("读取日志失败", err)
+	}
 }
 
 // 处理status子命令
@@ -332,12 +687,12 @@ func handleStatusCmd(cfg *fdctl.ControllerConfig) {
 	if err != nil {
 		logger.Fatal().Msgf("创建控制器失败: %v", err)
 	}
-	defer ctrl.MqttClient.Disconnect()
+	defer ctrl.Disconnect()
 
 	// 获取状态
-	status, err := ctrl.GetStatus(clientToQuery.ClientId, *statusInstanceName)
+	status, err := ctrl.GetStatus(ctx, clientToQuery.ClientId, *statusInstanceName)
 	if err != nil {
-		logger.Fatal().Msgf("获取状态失败: %v", err)
+		fatalRemote("获取状态失败", err)
 	}
 
 	// 打印状态
@@ -382,11 +737,11 @@ func handleWOLCmd(cfg *fdctl.ControllerConfig) {
 	if err != nil {
 		logger.Fatal().Msgf("创建控制器失败: %v", err)
 	}
-	defer ctrl.MqttClient.Disconnect()
+	defer ctrl.Disconnect()
 
 	// 发送WOL命令
-	if err := ctrl.SendWOL(clientToWake.ClientId, *macAddress); err != nil {
-		logger.Fatal().Msgf("发送WOL命令失败: %v", err)
+	if err := ctrl.SendWOL(ctx, clientToWake.ClientId, *macAddress); err != nil {
+		fatalRemote("发送WOL命令失败", err)
 	}
 
 	logger.Info().Msgf("已向客户端 %s[%s] 发送WOL命令，目标MAC地址: %s", *wolClientName, clientToWake.ClientId, *macAddress)
@@ -438,16 +793,409 @@ func handleShutdownWindowsCmd(cfg *fdctl.ControllerConfig) {
 	if err != nil {
 		logger.Fatal().Msgf("创建控制器失败: %v", err)
 	}
-	defer ctrl.MqttClient.Disconnect()
+	defer ctrl.Disconnect()
 
 	// 发送Windows远程关机消息
-	if err := ctrl.SendShutdownWindows(clientToShutdown.ClientId, *ip, *username, *password); err != nil {
-		logger.Fatal().Msgf("发送Windows远程关机消息失败: %v", err)
+	if err := ctrl.SendShutdownWindows(ctx, clientToShutdown.ClientId, *ip, *username, *password); err != nil {
+		fatalRemote("发送Windows远程关机消息失败", err)
 	}
 
 	logger.Info().Msgf("Windows远程关机消息发送成功，clientName=%s, ip=%s", *clientName, *ip)
 }
 
-func runController() {
+// handleKeygenCmd 处理keygen子命令，生成任务签名密钥并写入控制端配置
+func handleKeygenCmd(cfg *fdctl.ControllerConfig) {
+	keygenCmd := flag.NewFlagSet("keygen", flag.ExitOnError)
+	force := keygenCmd.Bool("force", false, "已存在签名密钥时强制重新生成，已部署的被控端需要同步更新公钥")
+	if err := keygenCmd.Parse(os.Args[2:]); err != nil {
+		logger.Fatal().Msgf("解析参数失败: %v", err)
+	}
+
+	if cfg.SigningKey != "" && !*force {
+		key, err := task.ParseSigningKey(cfg.SigningKey)
+		if err != nil {
+			logger.Fatal().Msgf("配置错误，signing_key无效: %v", err)
+		}
+		logger.Info().Msgf("签名密钥已存在，如需重新生成请使用 -force 参数\n# 被控端client.yaml配置\nsecurity:\n    controller_key: %s", task.PublicKeyOf(key))
+		return
+	}
+
+	privateKey, publicKey, err := task.GenerateSigningKey()
+	if err != nil {
+		logger.Fatal().Msgf("生成签名密钥失败: %v", err)
+	}
+	cfg.SigningKey = privateKey
+	if err := fdctl.WriteControllerConfig(*cfg, configFilePath); err != nil {
+		logger.Fatal().Msgf("写入控制器配置失败: %v", err)
+	}
+	logger.Info().Msgf("签名密钥已写入控制端配置\n# 请将以下内容添加到每个被控端的client.yaml中\nsecurity:\n    controller_key: %s", publicKey)
+}
+
+// handleSealKeyCmd 处理seal-key子命令，为已有被控端生成任务负载加密密钥
+func handleSealKeyCmd(cfg *fdctl.ControllerConfig) {
+	sealKeyCmd := flag.NewFlagSet("seal-key", flag.ExitOnError)
+	clientName := sealKeyCmd.String("name", "", "客户端名称")
+	force := sealKeyCmd.Bool("force", false, "已存在加密密钥时强制重新生成")
+	if err := sealKeyCmd.Parse(os.Args[2:]); err != nil {
+		logger.Fatal().Msgf("解析参数失败: %v", err)
+	}
+	if *clientName == "" {
+		logger.Fatal().Msg("请使用 -name 参数指定客户端名称")
+	}
+	client := findClient(cfg, *clientName)
+	if client == nil {
+		logger.Fatal().Msgf("未找到名为 %s 的客户端", *clientName)
+	}
+
+	if client.SealKey == "" || *force {
+		sealKey, err := task.GenerateSealKey()
+		if err != nil {
+			logger.Fatal().Msgf("生成加密密钥失败: %v", err)
+		}
+		client.SealKey = sealKey
+		if err := fdctl.WriteControllerConfig(*cfg, configFilePath); err != nil {
+			logger.Fatal().Msgf("写入控制器配置失败: %v", err)
+		}
+	}
+	logger.Info().Msgf("请将以下内容添加到被控端client.yaml的client部分，并重启fdclient\n    seal_key: %s", client.SealKey)
+}
+
+// handlePresenceCmd 处理presence子命令，查看被控端在线状态
+func handlePresenceCmd(cfg *fdctl.ControllerConfig) {
+	presenceCmd := flag.NewFlagSet("presence", flag.ExitOnError)
+	clientName := presenceCmd.String("name", "", "客户端名称")
+	timeout := presenceCmd.Duration("timeout", 5*time.Second, "等待保留状态消息的时间")
+	if err := presenceCmd.Parse(os.Args[2:]); err != nil {
+		logger.Fatal().Msgf("解析参数失败: %v", err)
+	}
+	if *clientName == "" {
+		logger.Fatal().Msg("请使用 -name 参数指定客户端名称")
+	}
+	client := findClient(cfg, *clientName)
+	if client == nil {
+		logger.Fatal().Msgf("未找到名为 %s 的客户端", *clientName)
+	}
+
+	ctrl, err := createController(cfg)
+	if err != nil {
+		logger.Fatal().Msgf("创建控制器失败: %v", err)
+	}
+	defer ctrl.Disconnect()
+
+	readCtx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	status, data, err := ctrl.GetClientStatus(readCtx, client.ClientId)
+	if err != nil {
+		logger.Fatal().Msgf("获取在线状态失败，被控端可能从未上报过状态: %v", err)
+	}
+
+	online := status.Online != nil && *status.Online
+	logger.Info().Msgf("在线: %v，状态时间: %s", online, time.Unix(status.Time, 0).Format(time.DateTime))
+	if status.Ip != "" || status.Version != "" {
+		logger.Info().Msgf("IP: %s，版本: %s，运行时长: %s", status.Ip, status.Version, time.Duration(status.Uptime)*time.Second)
+	}
+	if status.ClockSkew != nil {
+		logger.Info().Msgf("被控端测得的时钟偏差: %s", time.Duration(*status.ClockSkew)*time.Second)
+	}
+	if data != nil {
+		for _, instance := range data.Instances {
+			logger.Info().Msgf("实例: %s，运行中: %v，pid: %d", instance.Name, instance.Running, instance.Pid)
+		}
+	}
+}
+
+// handleHistoryCmd 处理history子命令，查看被控端的状态快照和实例事件，包括断线期间产生、重连后补发的记录
+// 只有控制端订阅期间收到的记录才会存档，不带子命令运行fdctl可以持续接收
+func handleHistoryCmd(cfg *fdctl.ControllerConfig) {
+	historyCmd := flag.NewFlagSet("history", flag.ExitOnError)
+	clientName := historyCmd.String("name", "", "客户端名称，为空时显示所有客户端")
+	since := historyCmd.Duration("since", 24*time.Hour, "显示最近多长时间内的记录")
+	events := historyCmd.Bool("events", false, "只显示实例事件，不显示状态快照")
+	if err := historyCmd.Parse(os.Args[2:]); err != nil {
+		logger.Fatal().Msgf("解析参数失败: %v", err)
+	}
+
+	var clientId string
+	if *clientName != "" {
+		client := findClient(cfg, *clientName)
+		if client == nil {
+			logger.Fatal().Msgf("未找到名为 %s 的客户端", *clientName)
+		}
+		clientId = client.ClientId
+	}
+
+	history, err := fdctl.OpenHistory(historyFilePath, logger)
+	if err != nil {
+		logger.Fatal().Msgf("打开历史记录存档失败: %v", err)
+	}
+	records, err := history.List(clientId, time.Now().Add(-*since))
+	if err != nil {
+		logger.Fatal().Msgf("读取历史记录失败: %v", err)
+	}
+
+	shown := 0
+	for _, record := range records {
+		if *events && record.Kind != task.HistoryLifecycle {
+			continue
+		}
+		shown++
+		line := fmt.Sprintf("%s %s[%s] seq=%d", time.Unix(record.Time, 0).Format(time.DateTime),
+			clientNameOf(cfg, record.ClientId), record.ClientId, record.Seq)
+		if delay := record.Received - record.Time; delay > 60 {
+			line += fmt.Sprintf(" 补发(延迟%ds)", delay)
+		}
+		if record.Dropped > 0 {
+			line += fmt.Sprintf(" 之前丢弃%d条", record.Dropped)
+		}
+		switch record.Kind {
+		case task.HistoryLifecycle:
+			var event types.InstanceEvent
+			if err := json.Unmarshal(record.Data, &event); err != nil {
+				line += fmt.Sprintf(" 无法解析的实例事件: %v", err)
+				break
+			}
+			line += fmt.Sprintf(" 实例%s %s pid=%d", event.Name, event.Type, event.Pid)
+			if event.Type != types.InstanceEventStarted {
+				line += fmt.Sprintf(" exit_status=%d", event.ExitStatus)
+			}
+		case task.HistoryStatus:
+			var status task.MessageStatus
+			var data types.Status
+			if err := json.Unmarshal(record.Data, &status); err == nil && len(status.Data) > 0 {
+				err = json.Unmarshal(status.Data, &data)
+			}
+			running := 0
+			for _, instance := range data.Instances {
+				if instance.Running {
+					running++
+				}
+			}
+			line += fmt.Sprintf(" 状态 实例%d个，运行中%d个，uptime=%ds", len(data.Instances), running, status.Uptime)
+		default:
+			line += fmt.Sprintf(" %s", record.Kind)
+		}
+		logger.Info().Msg(line)
+	}
+	if shown == 0 {
+		logger.Info().Msg("没有历史记录")
+	}
+}
+
+// handleTasksCmd 处理tasks子命令，查看任务日志
+func handleTasksCmd(cfg *fdctl.ControllerConfig) {
+	if len(os.Args) < 3 {
+		logger.Fatal().Msg("用法: fdctl tasks list|show -id <messageId>")
+	}
+
+	journal, err := fdctl.OpenJournal(journalFilePath, logger)
+	if err != nil {
+		logger.Fatal().Msgf("打开任务日志失败: %v", err)
+	}
+
+	switch os.Args[2] {
+	case "list":
+		listCmd := flag.NewFlagSet("tasks list", flag.ExitOnError)
+		clientName := listCmd.String("name", "", "只显示发往该客户端的任务")
+		limit := listCmd.Int("limit", 20, "最多显示的任务数量，0为不限制")
+		if err := listCmd.Parse(os.Args[3:]); err != nil {
+			logger.Fatal().Msgf("解析参数失败: %v", err)
+		}
+
+		var receiver string
+		if *clientName != "" {
+			client := findClient(cfg, *clientName)
+			if client == nil {
+				logger.Fatal().Msgf("未找到名为 %s 的客户端", *clientName)
+			}
+			receiver = client.ClientId
+		}
+
+		records, err := journal.List()
+		if err != nil {
+			logger.Fatal().Msgf("读取任务日志失败: %v", err)
+		}
+		shown := 0
+		for _, record := range records {
+			if receiver != "" && record.Receiver != receiver {
+				continue
+			}
+			if *limit > 0 && shown >= *limit {
+				break
+			}
+			shown++
+			logger.Info().Msgf("%s %s %s[%s] action=%s state=%s",
+				record.MessageId, time.Unix(record.SentTime, 0).Format(time.DateTime),
+				clientNameOf(cfg, record.Receiver), record.Receiver, record.Action, record.State)
+		}
+		if shown == 0 {
+			logger.Info().Msg("任务日志为空")
+		}
+	case "show":
+		showCmd := flag.NewFlagSet("tasks show", flag.ExitOnError)
+		messageId := showCmd.String("id", "", "任务的消息ID")
+		if err := showCmd.Parse(os.Args[3:]); err != nil {
+			logger.Fatal().Msgf("解析参数失败: %v", err)
+		}
+		if *messageId == "" {
+			logger.Fatal().Msg("请使用 -id 参数指定任务的消息ID")
+		}
+
+		record, err := journal.Get(*messageId)
+		if err != nil {
+			logger.Fatal().Msgf("%v", err)
+		}
+		logger.Info().Msgf("消息ID: %s", record.MessageId)
+		logger.Info().Msgf("接收方: %s[%s]", clientNameOf(cfg, record.Receiver), record.Receiver)
+		logger.Info().Msgf("动作: %s", record.Action)
+		logger.Info().Msgf("状态: %s", record.State)
+		logger.Info().Msgf("发送时间: %s", time.Unix(record.SentTime, 0).Format(time.DateTime))
+		logger.Info().Msgf("过期时间: %s", time.Unix(record.Expiration, 0).Format(time.DateTime))
+		if record.AckTime != 0 {
+			logger.Info().Msgf("确认时间: %s", time.Unix(record.AckTime, 0).Format(time.DateTime))
+		}
+		if record.FinishTime != 0 {
+			logger.Info().Msgf("完成时间: %s", time.Unix(record.FinishTime, 0).Format(time.DateTime))
+		}
+		if record.ResultValue != "" {
+			logger.Info().Msgf("返回值: %s", record.ResultValue)
+		}
+		if record.ResultError != "" {
+			logger.Info().Msgf("错误: %s", record.ResultError)
+			if record.ResultCode != "" {
+				logger.Info().Msgf("错误码: %s", record.ResultCode)
+			}
+		}
+	default:
+		logger.Fatal().Msgf("未知tasks子命令: %s", os.Args[2])
+	}
+}
+
+// findClient 按名称查找被控端
+func findClient(cfg *fdctl.ControllerConfig, name string) *types.ClientAuth {
+	for i := range cfg.Clients {
+		if cfg.Clients[i].Name == name {
+			return &cfg.Clients[i]
+		}
+	}
+	return nil
+}
+
+// clientNameOf 按clientId查找被控端名称，找不到时返回"-"
+func clientNameOf(cfg *fdctl.ControllerConfig, clientId string) string {
+	for _, client := range cfg.Clients {
+		if client.ClientId == clientId {
+			return client.Name
+		}
+	}
+	return "-"
+}
+
+// remoteExitCodes 远端调用失败时按错误码区分的退出码，脚本可以据此判断失败原因，未列出的错误以1退出
+var remoteExitCodes = map[string]int{
+	task.CodeInternal:          10,
+	task.CodeUnsupportedAction: 11,
+	task.CodeForbidden:         12,
+	task.CodeBadSignature:      13,
+	task.CodeSealError:         14,
+	task.CodeQueueFull:         15,
+	task.CodeCanceled:          16,
+	task.CodeInvalidPayload:    17,
+	task.CodeDuplicateId:       18,
+	fdctl.CodeTimeout:          20,
+}
+
+// fatalRemote 输出远端调用的错误和错误码，并以对应的退出码退出
+func fatalRemote(msg string, err error) {
+	code := fdctl.ErrorCode(err)
+	if code == "" {
+		logger.Fatal().Msgf("%s: %v", msg, err)
+	}
+	logger.Error().Msgf("%s: %v，code=%s", msg, err, code)
+	exitCode, ok := remoteExitCodes[code]
+	if !ok {
+		exitCode = 1
+	}
+	os.Exit(exitCode)
+}
+
+// resolveTargets 解析-name、-group、-all指定的被控端，-name可以用逗号分隔多个名称，结果按名称去重
+func resolveTargets(cfg *fdctl.ControllerConfig, names, group string, all bool) ([]types.ClientAuth, error) {
+	var nameList []string
+	switch {
+	case all:
+		for _, client := range cfg.Clients {
+			nameList = append(nameList, client.Name)
+		}
+	case group != "":
+		members, ok := cfg.Groups[group]
+		if !ok {
+			return nil, fmt.Errorf("未找到名为 %s 的分组", group)
+		}
+		nameList = members
+	case names != "":
+		nameList = strings.Split(names, ",")
+	default:
+		return nil, errors.New("请使用 -name、-group 或 -all 参数指定客户端")
+	}
+
+	var targets []types.ClientAuth
+	seen := make(map[string]bool)
+	for _, name := range nameList {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		client := findClient(cfg, name)
+		if client == nil {
+			return nil, fmt.Errorf("未找到名为 %s 的客户端", name)
+		}
+		targets = append(targets, *client)
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("没有要执行的客户端")
+	}
+	return targets, nil
+}
+
+func clientIdsOf(clients []types.ClientAuth) []string {
+	ids := make([]string, len(clients))
+	for i, client := range clients {
+		ids[i] = client.ClientId
+	}
+	return ids
+}
+
+// printGroupReport 输出群发任务的汇总结果，有失败或超时的被控端时以非0状态退出
+func printGroupReport(cfg *fdctl.ControllerConfig, action string, report *fdctl.GroupReport) {
+	for _, result := range report.Results {
+		name := clientNameOf(cfg, result.ClientId)
+		switch result.State {
+		case fdctl.GroupAnswered:
+			logger.Info().Msgf("%s %s[%s] %s，耗时=%s", action, name, result.ClientId, result.State, result.Elapsed.Round(time.Millisecond))
+		default:
+			logger.Warn().Msgf("%s %s[%s] %s: %v，code=%s", action, name, result.ClientId, result.State, result.Err, fdctl.ErrorCode(result.Err))
+		}
+	}
+	logger.Info().Msgf("%s 共%d个客户端，成功%d，失败%d，超时%d", action, len(report.Results),
+		report.Count(fdctl.GroupAnswered), report.Count(fdctl.GroupFailed), report.Count(fdctl.GroupTimedOut))
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+// runController 前台运行控制端，持续订阅响应主题并记入任务日志
+// 被控端离线期间的异步任务，其ack/complete/failed响应可能在数天后才到达
+func runController(cfg *fdctl.ControllerConfig) {
 	logger.Info().Msg("FRP控制器启动...")
+
+	ctrl, err := createController(cfg)
+	if err != nil {
+		logger.Fatal().Msgf("%v", err)
+	}
+	defer ctrl.Disconnect()
+
+	logger.Info().Msgf("正在订阅任务响应，任务日志=%s，历史记录=%s", journalFilePath, historyFilePath)
+	<-ctx.Done()
+	logger.Info().Msg("FRP控制器已退出")
 }
@@ -78,6 +78,7 @@ func (a *API) CreateUser(auth *types.ClientAuth) (*types.MQTTClientOpts, error)
 	// 返回MQTT配置
 	return &types.MQTTClientOpts{
 		Broker:      a.config.MQTTBroker,
+		Brokers:     a.config.MQTTBrokers,
 		ClientID:    auth.Name,
 		Username:    mqttClientId,
 		Password:    mqttPassword,
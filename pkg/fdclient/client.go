@@ -1,37 +1,50 @@
 package fdclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/shellus/frp-daemon/pkg/frp"
 	installerC "github.com/shellus/frp-daemon/pkg/installer"
 	mqttC "github.com/shellus/frp-daemon/pkg/mqtt"
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
 	"github.com/shellus/frp-daemon/pkg/types"
 )
 
 type Client struct {
 	configFile   *ConfigFile
-	mqtt         *mqttC.MQTT
+	mqtt         mqttC.Reporter
 	runner       *frp.Runner
 	binDir       string
 	instancesDir string
+	stateDir     string
 	installer    *installerC.Installer
+	startTime    time.Time
 	logger       zerolog.Logger
 }
 
-func NewClient(configFile *ConfigFile, runner *frp.Runner, binDir, instancesDir string, logger zerolog.Logger) (*Client, error) {
+// NewClient 创建被控端，stateDir用于持久化任务去重缓存等运行状态
+func NewClient(configFile *ConfigFile, runner *frp.Runner, binDir, instancesDir, stateDir string, logger zerolog.Logger) (*Client, error) {
+	if configFile.ClientConfig.Mqtt.Broker == "" && len(configFile.ClientConfig.Mqtt.Brokers) == 0 {
+		return nil, fmt.Errorf("配置错误，mqtt.Broker is empty")
+	}
+	return NewClientWithTransport(configFile, runner, binDir, instancesDir, stateDir, nil, logger)
+}
+
+// NewClientWithTransport 创建通过指定传输层连接的被控端，transport为nil时连接配置中的MQTT代理
+// 使用mqtt.Hub可以在同一个程序中运行控制端和多个被控端
+func NewClientWithTransport(configFile *ConfigFile, runner *frp.Runner, binDir, instancesDir, stateDir string, transport mqttC.Transport, logger zerolog.Logger) (*Client, error) {
 	if configFile.ClientConfig.Client.ClientId == "" {
 		return nil, fmt.Errorf("配置错误，auth.ClientId is empty")
 	}
-	if configFile.ClientConfig.Mqtt.Broker == "" {
-		return nil, fmt.Errorf("配置错误，mqtt.Broker is empty")
-	}
 	if _, err := os.Stat(instancesDir); os.IsNotExist(err) {
 		return nil, fmt.Errorf("FRP实例目录不存在，instancesDir=%s", instancesDir)
 	}
@@ -48,27 +61,116 @@ func NewClient(configFile *ConfigFile, runner *frp.Runner, binDir, instancesDir
 		runner:       runner,
 		binDir:       binDir,
 		instancesDir: instancesDir,
+		stateDir:     stateDir,
 		installer:    installer,
+		startTime:    time.Now(),
 		logger:       logger,
 	}
 
-	mqtt, err := mqttC.NewMQTT(configFile.ClientConfig.Mqtt, logger)
+	var mqtt *mqttC.MQTT
+	if transport != nil {
+		mqtt, err = mqttC.NewMQTTWithTransport(configFile.ClientConfig.Mqtt, transport, logger)
+	} else {
+		mqtt, err = mqttC.NewMQTT(configFile.ClientConfig.Mqtt, logger)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("创建MQTT客户端失败，Error=%v", err)
 	}
 
+	// QoS 1可能重复投递，已处理过的任务直接重发结果，避免重复重启frpc或发送唤醒包
+	dedup, err := mqttC.NewDedupCache(filepath.Join(stateDir, "dedup.json"), mqttC.DefaultDedupCapacity)
+	if err != nil {
+		return nil, fmt.Errorf("加载任务去重缓存失败，Error=%v", err)
+	}
+	mqtt.SetDedupCache(dedup)
+
+	// 定时任务保存在stateDir中，重启后继续按时执行
+	scheduler, err := mqttC.NewScheduler(filepath.Join(stateDir, "schedules.json"), mqttC.DefaultScheduleCapacity)
+	if err != nil {
+		return nil, fmt.Errorf("加载定时任务失败，Error=%v", err)
+	}
+	mqtt.SetScheduler(scheduler)
+
+	// 状态快照和实例生命周期事件先写入发件箱，断线期间的记录在重连后按顺序补发
+	outbox, err := mqttC.NewOutbox(filepath.Join(stateDir, "history.json"), mqttC.DefaultOutboxCapacity)
+	if err != nil {
+		return nil, fmt.Errorf("加载历史记录发件箱失败，Error=%v", err)
+	}
+	mqtt.SetOutbox(outbox)
+
+	// 配置了加密密钥时，只接受加密的任务，响应也会加密
+	if sealKey := configFile.ClientConfig.Client.SealKey; sealKey != "" {
+		key, err := task.ParseSealKey(sealKey)
+		if err != nil {
+			return nil, fmt.Errorf("配置错误，client.seal_key无效，Error=%v", err)
+		}
+		keyring := task.NewKeyring()
+		if err := keyring.Add(configFile.ClientConfig.Client.ClientId, key); err != nil {
+			return nil, fmt.Errorf("配置错误，client.seal_key无效，Error=%v", err)
+		}
+		mqtt.SetKeyring(keyring)
+		mqtt.SetRequireSealed(true)
+	}
+
+	// 只执行受信任控制端签名的任务
+	controllerKey := configFile.ClientConfig.Security.ControllerKey
+	if controllerKey != "" {
+		key, err := task.ParseVerifyKey(controllerKey)
+		if err != nil {
+			return nil, fmt.Errorf("配置错误，security.controller_key无效，Error=%v", err)
+		}
+		mqtt.SetTrustedKeys(key)
+	} else {
+		logger.Warn().Msg("未配置security.controller_key，任何能发布到pending主题的人都可以下发任务")
+	}
+
+	// 发送方白名单和动作授权，授权依据的Sender字段是发送方自称的，必须能验证签名才有意义
+	if senders := configFile.ClientConfig.Security.Senders; len(senders) > 0 {
+		policy := mqttC.NewPolicy()
+		for _, sender := range senders {
+			if sender.ClientId == "" {
+				return nil, fmt.Errorf("配置错误，security.senders中存在空的client_id")
+			}
+			rule := mqttC.SenderPolicy{Actions: sender.Actions}
+			if sender.PublicKey != "" {
+				key, err := task.ParseVerifyKey(sender.PublicKey)
+				if err != nil {
+					return nil, fmt.Errorf("配置错误，发送方%s的public_key无效，Error=%v", sender.ClientId, err)
+				}
+				rule.PublicKey = key
+			} else if controllerKey == "" {
+				return nil, fmt.Errorf("配置错误，发送方%s没有可用的验签公钥，任何人都可以冒充它，请配置security.controller_key或该发送方的public_key", sender.ClientId)
+			}
+			policy.Allow(sender.ClientId, rule)
+		}
+		mqtt.SetPolicy(policy)
+	}
+
+	// 处理器在工作协程中执行，对同一实例的update和delete按到达顺序逐个执行
+	dispatcher := configFile.ClientConfig.Dispatcher
+	mqtt.SetDispatcher(mqttC.DispatcherOptions{
+		Workers:      dispatcher.Workers,
+		QueueSize:    dispatcher.QueueSize,
+		ActionLimits: dispatcher.ActionLimits,
+		Streams:      dispatcher.Streams,
+	})
+	mqtt.SetOrderKey(types.MessageActionUpdate, instanceOrderKey)
+	mqtt.SetOrderKey(types.MessageActionDelete, instanceOrderKey)
+
 	mqtt.SubscribeAction(types.MessageActionUpdate, c.HandleUpdate)
 	mqtt.SubscribeAction(types.MessageActionPing, c.HandlePing)
 	mqtt.SubscribeAction(types.MessageActionDelete, c.HandleDelete)
 	mqtt.SubscribeAction(types.MessageActionGetStatus, c.HandleGetStatus)
 	mqtt.SubscribeAction(types.MessageActionWOL, c.HandleWOL)
 	mqtt.SubscribeAction(types.MessageActionShutdownWindows, c.HandleShutdownWindows)
+	mqtt.SubscribeAction(types.MessageActionFollowLog, c.HandleFollowLog)
 
 	if err := mqtt.Connect(); err != nil {
 		return nil, fmt.Errorf("连接MQTT失败，Error=%v", err)
 	}
 
 	c.mqtt = mqtt
+	runner.SetEventHandler(c.onInstanceEvent)
 
 	return c, nil
 }
@@ -86,38 +188,142 @@ func (c *Client) Start() (err error) {
 // ReportStatus 上报状态，应该被每分钟调用一次
 func (c *Client) ReportStatus() (err error) {
 	instancesStatus := c.runner.GetStatus()
-	status := types.Status{
+	data, err := json.Marshal(types.Status{
 		ID:             c.configFile.ClientConfig.Client.ClientId,
 		LastOnlineTime: time.Now().Unix(),
 		Instances:      instancesStatus,
+	})
+	if err != nil {
+		return fmt.Errorf("序列化状态失败，Error=%v", err)
 	}
 
-	c.mqtt.Report(c.configFile.ClientConfig.Client.ClientId, status)
+	online := true
+	status := task.MessageStatus{
+		Time:    time.Now().Unix(),
+		Online:  &online,
+		Ip:      localIP(c.mqtt.ActiveBroker()),
+		Version: types.Version,
+		Uptime:  int64(time.Since(c.startTime).Seconds()),
+		Data:    data,
+	}
+	if skew, ok := c.mqtt.LastClockSkew(); ok {
+		seconds := int64(skew.Skew / time.Second)
+		status.ClockSkew = &seconds
+	}
 
-	return
+	// 历史记录不带日志，断线时间较长时发件箱也不会太大
+	history := status
+	history.Data, err = json.Marshal(types.Status{
+		ID:             c.configFile.ClientConfig.Client.ClientId,
+		LastOnlineTime: time.Now().Unix(),
+		Instances:      withoutLogs(instancesStatus),
+	})
+	if err != nil {
+		return fmt.Errorf("序列化状态失败，Error=%v", err)
+	}
+	if err := c.mqtt.Record(task.HistoryStatus, history); err != nil {
+		c.logger.Error().Msgf("写入历史记录失败，Error=%v", err)
+	}
+
+	// 断线时发布保留状态会一直等到重连，状态已记入历史记录，重连后补发
+	if !c.mqtt.IsConnected() {
+		return fmt.Errorf("MQTT未连接，状态已记入历史记录，重连后补发")
+	}
+	return c.mqtt.Report(c.configFile.ClientConfig.Client.ClientId, status)
 }
 
+// withoutLogs 返回去掉最近日志的实例状态
+func withoutLogs(instances []types.InstanceStatus) []types.InstanceStatus {
+	stripped := make([]types.InstanceStatus, len(instances))
+	for i, instance := range instances {
+		instance.LastLog = nil
+		stripped[i] = instance
+	}
+	return stripped
+}
+
+// onInstanceEvent 把实例生命周期事件记入历史记录
+func (c *Client) onInstanceEvent(event types.InstanceEvent) {
+	c.logger.Info().Msgf("实例生命周期事件，instanceName=%s, type=%s, pid=%d, exitStatus=%d, restartCount=%d", event.Name, event.Type, event.Pid, event.ExitStatus, event.RestartCount)
+	if err := c.mqtt.Record(task.HistoryLifecycle, event); err != nil {
+		c.logger.Error().Msgf("写入历史记录失败，Error=%v", err)
+	}
+}
+
+// Stop 停止所有实例，主动发布离线状态后断开MQTT，正常下线不会触发遗嘱消息
 func (c *Client) Stop() (err error) {
-	return c.runner.Close()
+	err = c.runner.Close()
+
+	if reportErr := c.mqtt.Report(c.configFile.ClientConfig.Client.ClientId, task.NewOfflineStatus()); reportErr != nil {
+		c.logger.Warn().Msgf("发布离线状态失败，Error=%v", reportErr)
+	}
+	c.mqtt.Disconnect()
+	return err
+}
+
+// localIP 获取连接MQTT代理所用网卡的IP，UDP的Dial不会真正发送数据，获取失败时返回空
+func localIP(broker string) string {
+	u, err := url.Parse(broker)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+	port := u.Port()
+	if port == "" {
+		port = "1883"
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
 }
 
 func (c *Client) StartFrpInstance(instance types.InstanceConfigLocal) (err error) {
-	frpPath, err := c.installer.EnsureFRPInstalled(instance.Version)
+	return c.StartFrpInstanceProgress(instance, nil)
+}
+
+// StartFrpInstanceProgress 启动实例，需要下载frpc时通过onProgress回调下载进度
+func (c *Client) StartFrpInstanceProgress(instance types.InstanceConfigLocal, onProgress func(downloaded, total int64)) (err error) {
+	frpPath, err := c.installer.EnsureFRPInstalledProgress(instance.Version, onProgress)
 	if err != nil {
 		return err
 	}
-	return c.runner.StartInstance(instance.Name, instance.Version, frpPath, instance.ConfigPath)
+	return c.runner.StartInstanceWithOptions(instance.Name, instance.Version, frpPath, instance.ConfigPath, frp.InstanceOptions{
+		Restart:     instance.Restart,
+		StopTimeout: time.Duration(instance.StopTimeout) * time.Second,
+	})
 }
 
 func (c *Client) StopFrpInstance(name string) (err error) {
 	return c.runner.StopInstance(name)
 }
 
+// instanceOrderKey 以实例名称作为update和delete的顺序键
+func instanceOrderKey(action string, payload []byte) string {
+	switch action {
+	case types.MessageActionUpdate:
+		var instance types.InstanceConfigRemote
+		if err := json.Unmarshal(payload, &instance); err == nil && instance.Name != "" {
+			return "instance/" + instance.Name
+		}
+	case types.MessageActionDelete:
+		var deleteMessage types.DeleteInstanceMessage
+		if err := json.Unmarshal(payload, &deleteMessage); err == nil && deleteMessage.InstanceName != "" {
+			return "instance/" + deleteMessage.InstanceName
+		}
+	}
+	return ""
+}
+
 // HandleDelete 处理删除实例
-func (c *Client) HandleDelete(action string, payload []byte) (value []byte, err error) {
+func (c *Client) HandleDelete(ctx context.Context, action string, payload []byte) (value []byte, err error) {
 	var deleteMessage types.DeleteInstanceMessage
 	if err = json.Unmarshal(payload, &deleteMessage); err != nil {
-		return nil, fmt.Errorf("处理delete指令解析失败，Error=%v", err)
+		return nil, task.NewRemoteError(task.CodeInvalidPayload, fmt.Sprintf("处理delete指令解析失败，Error=%v", err))
 	}
 	c.logger.Info().Msgf("处理delete指令，instanceName=%s", deleteMessage.InstanceName)
 
@@ -143,10 +349,10 @@ func (c *Client) HandleDelete(action string, payload []byte) (value []byte, err
 }
 
 // HandleGetStatus 处理获取状态
-func (c *Client) HandleGetStatus(action string, payload []byte) (value []byte, err error) {
+func (c *Client) HandleGetStatus(ctx context.Context, action string, payload []byte) (value []byte, err error) {
 	var statusMessage types.GetStatusMessage
 	if err = json.Unmarshal(payload, &statusMessage); err != nil {
-		return nil, fmt.Errorf("处理get_status指令解析失败，Error=%v", err)
+		return nil, task.NewRemoteError(task.CodeInvalidPayload, fmt.Sprintf("处理get_status指令解析失败，Error=%v", err))
 	}
 	c.logger.Info().Msgf("处理get_status指令，instanceName=%s", statusMessage.InstanceName)
 
@@ -176,10 +382,10 @@ func (c *Client) HandleGetStatus(action string, payload []byte) (value []byte, e
 }
 
 // HandleWOL 处理WOL消息
-func (c *Client) HandleWOL(action string, payload []byte) (value []byte, err error) {
+func (c *Client) HandleWOL(ctx context.Context, action string, payload []byte) (value []byte, err error) {
 	var wolMessage types.WOLMessage
 	if err = json.Unmarshal(payload, &wolMessage); err != nil {
-		return nil, fmt.Errorf("处理wol指令解析失败，Error=%v", err)
+		return nil, task.NewRemoteError(task.CodeInvalidPayload, fmt.Sprintf("处理wol指令解析失败，Error=%v", err))
 	}
 	c.logger.Info().Msgf("处理wol指令，macAddress=%s", wolMessage.MacAddress)
 
@@ -232,10 +438,10 @@ func (c *Client) sendWOLPacket(macAddress string) error {
 }
 
 // HandleShutdownWindows 处理Windows远程关机消息
-func (c *Client) HandleShutdownWindows(action string, payload []byte) (value []byte, err error) {
+func (c *Client) HandleShutdownWindows(ctx context.Context, action string, payload []byte) (value []byte, err error) {
 	var shutdownMessage types.ShutdownWindowsMessage
 	if err = json.Unmarshal(payload, &shutdownMessage); err != nil {
-		return nil, fmt.Errorf("处理shutdown_windows指令解析失败，Error=%v", err)
+		return nil, task.NewRemoteError(task.CodeInvalidPayload, fmt.Sprintf("处理shutdown_windows指令解析失败，Error=%v", err))
 	}
 	c.logger.Info().Msgf("处理shutdown_windows指令，ip=%s, username=%s", shutdownMessage.IP, shutdownMessage.Username)
 
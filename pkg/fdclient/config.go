@@ -12,9 +12,40 @@ import (
 
 // ClientConfig client.yaml配置
 type ClientConfig struct {
-	Client    types.ClientAuth            `yaml:"client"`    // 客户端认证信息
-	Mqtt      types.MQTTClientOpts        `yaml:"mqtt"`      // MQTT连接配置
-	Instances []types.InstanceConfigLocal `yaml:"instances"` // FRP实例配置
+	Client     types.ClientAuth            `yaml:"client"`     // 客户端认证信息
+	Mqtt       types.MQTTClientOpts        `yaml:"mqtt"`       // MQTT连接配置
+	Instances  []types.InstanceConfigLocal `yaml:"instances"`  // FRP实例配置
+	Security   SecurityConfig              `yaml:"security"`   // 任务安全配置
+	Dispatcher DispatcherConfig            `yaml:"dispatcher"` // 任务调度配置
+}
+
+// DispatcherConfig 任务调度配置，为空时使用默认值
+type DispatcherConfig struct {
+	Workers   int `yaml:"workers,omitempty"`    // 同时执行的任务数，默认4
+	QueueSize int `yaml:"queue_size,omitempty"` // 排队等待执行的任务数上限，默认256
+	// ActionLimits 每个动作同时执行的任务数上限，例如{update: 1}
+	ActionLimits map[string]int `yaml:"action_limits,omitempty"`
+	// Streams 同时执行的流式任务数（例如fdctl logs -f），不占用workers，默认4
+	Streams int `yaml:"streams,omitempty"`
+}
+
+// SecurityConfig 被控端的任务安全配置
+type SecurityConfig struct {
+	// ControllerKey 控制端签名公钥，base64编码，由fdctl keygen生成
+	// 配置后只执行由对应私钥签名的任务，为空时不校验签名
+	ControllerKey string `yaml:"controller_key,omitempty"`
+	// Senders 允许向本被控端下发任务的发送方及其可调用的动作，为空时不限制
+	Senders []SenderConfig `yaml:"senders,omitempty"`
+}
+
+// SenderConfig 发送方授权规则
+type SenderConfig struct {
+	ClientId string `yaml:"client_id"`      // 发送方的clientId，即MQTT username
+	Name     string `yaml:"name,omitempty"` // 发送方名称，仅用于备注
+	// PublicKey 该发送方的签名公钥，设置后该发送方的任务只接受此公钥的签名，为空时使用controller_key
+	PublicKey string `yaml:"public_key,omitempty"`
+	// Actions 允许调用的动作，例如[ping, get_status]，"*"表示全部动作
+	Actions []string `yaml:"actions"`
 }
 type ConfigFile struct {
 	path         string
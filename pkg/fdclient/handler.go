@@ -1,15 +1,33 @@
 package fdclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"time"
 
+	"github.com/shellus/frp-daemon/pkg/frp"
+	mqttC "github.com/shellus/frp-daemon/pkg/mqtt"
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
 	"github.com/shellus/frp-daemon/pkg/types"
 )
 
-func (c *Client) HandlePing(action string, payload []byte) (value []byte, err error) {
+// update指令上报进度的阶段
+const (
+	PhaseStop     = "stop"     // 停止旧实例
+	PhaseDownload = "download" // 下载frpc
+	PhaseStart    = "start"    // 启动实例
+)
+
+// reportProgress 上报任务执行进度，上报失败不影响任务执行
+func (c *Client) reportProgress(ctx context.Context, percent int, phase string) {
+	if err := mqttC.ReportProgress(ctx, percent, phase); err != nil {
+		c.logger.Debug().Msgf("上报进度失败，phase=%s, Error=%v", phase, err)
+	}
+}
+
+func (c *Client) HandlePing(ctx context.Context, action string, payload []byte) (value []byte, err error) {
 	var ping types.PingMessage
 	if err = json.Unmarshal(payload, &ping); err != nil {
 		c.logger.Error().Msgf("处理ping指令解析失败，Error=%v", err)
@@ -28,10 +46,10 @@ func (c *Client) HandlePing(action string, payload []byte) (value []byte, err er
 }
 
 // HandleUpdate 处理下发frp实例
-func (c *Client) HandleUpdate(action string, payload []byte) (value []byte, err error) {
+func (c *Client) HandleUpdate(ctx context.Context, action string, payload []byte) (value []byte, err error) {
 	var instance types.InstanceConfigRemote
 	if err = json.Unmarshal(payload, &instance); err != nil {
-		return nil, fmt.Errorf("处理update指令解析失败，Error=%v", err)
+		return nil, task.NewRemoteError(task.CodeInvalidPayload, fmt.Sprintf("处理update指令解析失败，Error=%v", err))
 	}
 	c.logger.Info().Msgf("处理update指令，instanceName=%s, version=%s", instance.Name, instance.Version)
 
@@ -40,6 +58,28 @@ func (c *Client) HandleUpdate(action string, payload []byte) (value []byte, err
 		c.logger.Info().Msgf("验证密码失败拒绝更新，instanceName=%s, version=%s", instance.Name, instance.Version)
 		return nil, fmt.Errorf("验证密码失败拒绝更新，instanceName=%s, version=%s", instance.Name, instance.Version)
 	}
+	// 重启策略无效时不停止旧实例
+	if err = frp.ValidateRestartPolicy(instance.Restart); err != nil {
+		return nil, task.NewRemoteError(task.CodeInvalidPayload, fmt.Sprintf("处理update指令重启策略无效，Error=%v", err))
+	}
+
+	// 先下载frpc，下载期间被取消时旧实例不受影响，需要下载时把下载进度上报给控制端
+	_, err = c.installer.EnsureFRPInstalledProgress(instance.Version, func(downloaded, total int64) {
+		percent := -1
+		if total > 0 {
+			percent = int(downloaded * 100 / total)
+		}
+		c.reportProgress(ctx, percent, PhaseDownload)
+	})
+	if err != nil {
+		c.logger.Error().Msgf("下载frpc失败，instanceName=%s, version=%s, Error=%v", instance.Name, instance.Version, err)
+		return nil, fmt.Errorf("下载frpc失败，instanceName=%s, version=%s, Error=%v", instance.Name, instance.Version, err)
+	}
+	// 控制端取消后不再改动实例，开始停止旧实例之后不再响应取消
+	if err = ctx.Err(); err != nil {
+		c.logger.Info().Msgf("update指令已被取消，instanceName=%s", instance.Name)
+		return nil, err
+	}
 
 	// 配置写入本地文件得到文件名
 	filePath := fmt.Sprintf("%s/%s.yaml", c.instancesDir, instance.Name)
@@ -53,21 +93,26 @@ func (c *Client) HandleUpdate(action string, payload []byte) (value []byte, err
 
 	// 生成本地实例配置
 	localInstance := types.InstanceConfigLocal{
-		Name:       instance.Name,
-		Version:    instance.Version,
-		ConfigPath: filePath,
+		Name:        instance.Name,
+		Version:     instance.Version,
+		ConfigPath:  filePath,
+		Restart:     instance.Restart,
+		StopTimeout: instance.StopTimeout,
 	}
 
 	// 如果存在先停止，那就不管错误了。
+	c.reportProgress(ctx, -1, PhaseStop)
 	c.StopFrpInstance(localInstance.Name)
 
-	// 启动实例
-	if err = c.StartFrpInstance(localInstance); err != nil {
+	// 启动实例，frpc已在前面下载
+	err = c.StartFrpInstance(localInstance)
+	if err != nil {
 		c.logger.Error().Msgf("启动实例失败，instanceName=%s, Error=%v", localInstance.Name, err)
 		return nil, fmt.Errorf("启动实例失败，instanceName=%s, Error=%v", localInstance.Name, err)
 	}
 
 	// 更新持久化实例配置
+	c.reportProgress(ctx, 100, PhaseStart)
 	err = c.configFile.UpdateInstance(localInstance)
 	if err != nil {
 		c.logger.Error().Msgf("更新实例配置失败，Error=%v", err)
@@ -82,3 +127,42 @@ func (c *Client) HandleUpdate(action string, payload []byte) (value []byte, err
 	}
 	return respByte, nil
 }
+
+// HandleFollowLog 以流式方式返回实例日志，每行日志是一段流数据
+func (c *Client) HandleFollowLog(ctx context.Context, action string, payload []byte) (value []byte, err error) {
+	var follow types.FollowLogMessage
+	if err = json.Unmarshal(payload, &follow); err != nil {
+		return nil, task.NewRemoteError(task.CodeInvalidPayload, fmt.Sprintf("处理follow_log指令解析失败，Error=%v", err))
+	}
+	c.logger.Info().Msgf("处理follow_log指令，instanceName=%s, tail=%d, follow=%v", follow.InstanceName, follow.Tail, follow.Follow)
+
+	lines, ch, cancel, err := c.runner.FollowLogs(follow.InstanceName, follow.Tail)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	for _, line := range lines {
+		if err = mqttC.Emit(ctx, []byte(line)); err != nil {
+			return nil, err
+		}
+	}
+	if !follow.Follow {
+		return nil, nil
+	}
+	for {
+		select {
+		case line, ok := <-ch:
+			if !ok {
+				c.logger.Info().Msgf("实例已退出，结束日志跟随，instanceName=%s", follow.InstanceName)
+				return nil, nil
+			}
+			if err = mqttC.Emit(ctx, []byte(line)); err != nil {
+				return nil, err
+			}
+		case <-ctx.Done():
+			c.logger.Info().Msgf("调用方取消了日志跟随，instanceName=%s", follow.InstanceName)
+			return nil, nil
+		}
+	}
+}
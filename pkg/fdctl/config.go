@@ -13,6 +13,10 @@ type ControllerConfig struct {
 	Client  types.ClientAuth     `yaml:"client"`   // 客户端认证信息，控制端也是一个客户端，所以也有自己的客户端配置
 	MQTT    types.MQTTClientOpts `yaml:"mqtt"`     // MQTT连接配置，用于发送控制指令到MQTT
 	Clients []types.ClientAuth   `yaml:"clients"`  // 被控端客户端列表
+	// Groups 被控端分组，键为组名，值为被控端名称列表，fdctl的ping、update可以用-group对整组执行
+	Groups map[string][]string `yaml:"groups,omitempty"`
+	// SigningKey 任务签名私钥，base64编码，由fdctl keygen生成，对应的公钥需要配置到被控端security.controller_key
+	SigningKey string `yaml:"signing_key,omitempty"`
 }
 
 // LoadControllerConfig 加载控制器配置
@@ -1,9 +1,12 @@
 package fdctl
 
 import (
+	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"time"
 
@@ -15,18 +18,21 @@ import (
 
 type Controller struct {
 	auth       types.ClientAuth
-	MqttClient *mqtt.MQTT
+	caller     mqtt.Caller
 	mqttOpts   types.MQTTClientOpts
-	logger     zerolog.Logger
+	journal    *Journal
+	history    *History
+	clients    []types.ClientAuth
+	signingKey ed25519.PrivateKey
+	// transport 不为nil时通过该传输层连接，不使用mqttOpts中的broker
+	transport mqtt.Transport
+	logger    zerolog.Logger
 }
 
 func NewController(auth types.ClientAuth, mqttOpts types.MQTTClientOpts, logger zerolog.Logger) (*Controller, error) {
 	if auth.ClientId == "" {
 		return nil, errors.New("auth.ClientId is empty")
 	}
-	if mqttOpts.Broker == "" {
-		return nil, errors.New("mqttOpts.Broker is empty")
-	}
 	return &Controller{
 		auth:     auth,
 		mqttOpts: mqttOpts,
@@ -34,30 +40,182 @@ func NewController(auth types.ClientAuth, mqttOpts types.MQTTClientOpts, logger
 	}, nil
 }
 
+// SetJournal 设置任务日志，需要在ConnectMQTT之前调用
+// 设置后所有发出的任务和收到的响应都会记入任务日志
+func (c *Controller) SetJournal(journal *Journal) {
+	c.journal = journal
+}
+
+// SetHistory 设置历史记录存档，需要在ConnectMQTT之前调用
+// 设置后订阅所有被控端的history主题，持久会话中积压的记录在连接后立即到达
+func (c *Controller) SetHistory(history *History) {
+	c.history = history
+}
+
+// History 返回历史记录存档，未设置时为nil
+func (c *Controller) History() *History {
+	return c.history
+}
+
+// SetClients 设置被控端列表，需要在ConnectMQTT之前调用，用于确定与各被控端通信的协议版本和加密密钥
+func (c *Controller) SetClients(clients []types.ClientAuth) {
+	c.clients = clients
+}
+
+// SetSigningKey 设置任务签名私钥，需要在ConnectMQTT之前调用
+func (c *Controller) SetSigningKey(key ed25519.PrivateKey) {
+	c.signingKey = key
+}
+
+// SetTransport 设置传输层，需要在ConnectMQTT之前调用，例如使用mqtt.Hub在进程内连接被控端
+func (c *Controller) SetTransport(transport mqtt.Transport) {
+	c.transport = transport
+}
+
+// Journal 返回任务日志，未设置时为nil
+func (c *Controller) Journal() *Journal {
+	return c.journal
+}
+
 // 连接MQTT
 func (c *Controller) ConnectMQTT() error {
-	mqttClient, err := mqtt.NewMQTT(c.mqttOpts, c.logger)
+	var mqttClient *mqtt.MQTT
+	var err error
+	if c.transport != nil {
+		mqttClient, err = mqtt.NewMQTTWithTransport(c.mqttOpts, c.transport, c.logger)
+	} else {
+		mqttClient, err = mqtt.NewMQTT(c.mqttOpts, c.logger)
+	}
 	if err != nil {
 		return fmt.Errorf("mqtt connect failed: %v", err)
 	}
+	if c.journal != nil {
+		mqttClient.SetReplyObserver(c.journal)
+	}
+	if c.signingKey != nil {
+		mqttClient.SetSigningKey(c.signingKey)
+	}
+	keyring := task.NewKeyring()
+	for _, client := range c.clients {
+		if client.ProtocolVersion != 0 {
+			mqttClient.SetPeerVersion(client.ClientId, client.ProtocolVersion)
+		}
+		if client.SealKey != "" {
+			key, err := task.ParseSealKey(client.SealKey)
+			if err != nil {
+				return fmt.Errorf("被控端%s的seal_key无效: %v", client.Name, err)
+			}
+			if err := keyring.Add(client.ClientId, key); err != nil {
+				return err
+			}
+		}
+	}
+	mqttClient.SetKeyring(keyring)
 	if err := mqttClient.Connect(); err != nil {
 		return fmt.Errorf("mqtt connect failed: %v", err)
 	}
+	if c.history != nil {
+		for _, client := range c.clients {
+			if err := mqttClient.SubscribeHistory(client.ClientId, c.history.OnHistory); err != nil {
+				c.logger.Warn().Msgf("订阅被控端历史记录失败，clientId=%s, err=%v", client.ClientId, err)
+			}
+		}
+	}
 
-	c.MqttClient = mqttClient
+	c.caller = mqttClient
 	return nil
 }
 
+// SetCaller 使用指定的行为调用接口，代替ConnectMQTT建立的MQTT连接，例如在测试中使用假实现
+// 传入的caller应已连接，SetJournal等只在ConnectMQTT中生效的设置对它不起作用
+func (c *Controller) SetCaller(caller mqtt.Caller) {
+	c.caller = caller
+}
+
+// Disconnect 断开与MQTT代理的连接
+func (c *Controller) Disconnect() error {
+	if c.caller == nil {
+		return nil
+	}
+	return c.caller.Disconnect()
+}
+
+// record 将发出的任务记入任务日志，写入失败不影响任务下发
+func (c *Controller) record(msg task.MessagePending) {
+	if c.journal == nil {
+		return
+	}
+	if err := c.journal.RecordSent(msg); err != nil {
+		c.logger.Warn().Msgf("写入任务日志失败，messageId=%s, err=%v", msg.MsgId, err)
+	}
+}
+
+// sendFailed 将发布失败记入任务日志，否则任务会一直显示为已投递，直到过期
+func (c *Controller) sendFailed(msg task.MessagePending, err error) {
+	if c.journal != nil {
+		c.journal.RecordSendError(msg.MsgId, err)
+	}
+}
+
+// call 同步行为调用并记入任务日志
+func (c *Controller) call(ctx context.Context, msg task.MessagePending) ([]byte, error) {
+	waiter, err := c.dispatch(msg)
+	if err != nil {
+		return nil, err
+	}
+	defer c.caller.Release(waiter)
+	return waiter.Wait(ctx)
+}
+
+// dispatch 异步行为调用并记入任务日志
+func (c *Controller) dispatch(msg task.MessagePending) (*task.Waiter, error) {
+	c.record(msg)
+	waiter, err := c.caller.Dispatch(msg)
+	if err != nil {
+		c.sendFailed(msg, err)
+		return nil, err
+	}
+	return waiter, nil
+}
+
+// DeliveryState 异步下发任务的投递状态
+type DeliveryState int
+
+const (
+	// DeliveryQueued 已投递到MQTT代理，被控端尚未确认收到
+	DeliveryQueued DeliveryState = iota
+	// DeliveryReceived 被控端已回复ack，尚未回复执行结果
+	DeliveryReceived
+	// DeliveryApplied 被控端已执行完成
+	DeliveryApplied
+)
+
+func (s DeliveryState) String() string {
+	switch s {
+	case DeliveryQueued:
+		return "已投递到MQTT代理"
+	case DeliveryReceived:
+		return "被控端已收到"
+	case DeliveryApplied:
+		return "被控端已应用"
+	default:
+		return fmt.Sprintf("未知状态(%d)", int(s))
+	}
+}
+
 // 实现配置下发
-func (c *Controller) SendConfig(clientId string, clientPassword string, config types.InstanceConfigLocal) error {
+// 配置以3天有效期异步下发，被控端离线时由MQTT代理暂存；
+// ackTimeout和applyTimeout分别是等待被控端收到和应用完成的时间，超时不视为错误，返回当时已到达的状态
+// onProgress不为nil时，等待期间收到的执行进度会回调给它
+func (c *Controller) SendConfig(ctx context.Context, clientId string, clientPassword string, config types.InstanceConfigLocal, ackTimeout, applyTimeout time.Duration, onProgress func(task.MessageProgress)) (DeliveryState, error) {
 	if clientId == "" {
-		return errors.New("下发配置要发送到的clientId为空")
+		return DeliveryQueued, errors.New("下发配置要发送到的clientId为空")
 	}
 
 	// 读取配置文件内容
 	configContent, err := os.ReadFile(config.ConfigPath)
 	if err != nil {
-		return fmt.Errorf("下发配置读取frpc.ini文件失败，err=%v，configPaht=%s", err, config.ConfigPath)
+		return DeliveryQueued, fmt.Errorf("下发配置读取frpc.ini文件失败，err=%v，configPaht=%s", err, config.ConfigPath)
 	}
 
 	// 创建远程配置对象
@@ -66,69 +224,115 @@ func (c *Controller) SendConfig(clientId string, clientPassword string, config t
 		Name:           config.Name,
 		Version:        config.Version,
 		ConfigContent:  string(configContent),
+		Restart:        config.Restart,
+		StopTimeout:    config.StopTimeout,
 	}
 
 	// 序列化配置
 	configJSON, err := json.Marshal(remoteConfig)
 	if err != nil {
-		return err
-	}
-	// 异步行为调用
-	err = c.MqttClient.RsyncAction(task.MessagePending{
-		MessageId:        types.GenerateRandomString(16),
-		SenderClientId:   c.auth.ClientId,
-		ReceiverClientId: clientId,
-		Action:           types.MessageActionUpdate,
-		Payload:          configJSON,
-		Expiration:       time.Now().Add(3 * 24 * time.Hour).Unix(),
+		return DeliveryQueued, err
+	}
+	// 异步行为调用，保留等待器以跟踪ack和complete
+	waiter, err := c.dispatch(task.MessagePending{
+		MsgId:    types.GenerateRandomString(16),
+		Sender:   c.auth.ClientId,
+		Receiver: clientId,
+		Action:   types.MessageActionUpdate,
+		Payload:  configJSON,
+		Exp:      time.Now().Add(3 * 24 * time.Hour).Unix(),
 	})
 	if err != nil {
-		return fmt.Errorf("下发配置发送失败，err=%v", err)
-	}
-	c.logger.Info().Msg("下发配置发送成功")
-	return nil
+		return DeliveryQueued, fmt.Errorf("下发配置发送失败，err=%v", err)
+	}
+	defer c.caller.Release(waiter)
+	c.logger.Info().Msgf("下发配置已投递到MQTT代理，messageId=%s", waiter.MessageId())
+	if onProgress != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			for {
+				select {
+				case p := <-waiter.Progress():
+					onProgress(p)
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	if err := waiter.WaitAck(ctx, ackTimeout); err != nil {
+		if errors.Is(err, task.ErrAckTimeout) {
+			return DeliveryQueued, nil
+		}
+		return DeliveryQueued, err
+	}
+	c.logger.Info().Msgf("被控端已收到配置，messageId=%s", waiter.MessageId())
+
+	if _, err := waiter.WaitComplete(ctx, applyTimeout); err != nil {
+		if errors.Is(err, task.ErrTimeout) {
+			return DeliveryReceived, nil
+		}
+		return DeliveryReceived, fmt.Errorf("下发配置远端执行失败，err=%w", err)
+	}
+	return DeliveryApplied, nil
+}
+
+// PingResult 延迟测试结果
+type PingResult struct {
+	RTT time.Duration // 往返延迟
+	// ClockOffset 被控端时钟减去控制端时钟的估计值，假设去程和回程延迟相同，正数表示被控端时钟较快
+	ClockOffset time.Duration
 }
 
 // SendPing 发送ping消息到指定客户端
-func (c *Controller) SendPing(clientId string) error {
+func (c *Controller) SendPing(ctx context.Context, clientId string) error {
+	_, err := c.Ping(ctx, clientId)
+	return err
+}
+
+// Ping 发送ping消息到指定客户端，返回往返延迟和估计的时钟偏差
+func (c *Controller) Ping(ctx context.Context, clientId string) (*PingResult, error) {
 	if clientId == "" {
-		return errors.New("clientId is empty")
+		return nil, errors.New("clientId is empty")
 	}
 	pingMessage := types.PingMessage{
 		Time: time.Now().UnixMilli(),
 	}
 	pingMessageJSON, err := json.Marshal(pingMessage)
 	if err != nil {
-		return fmt.Errorf("marshal ping message failed: %v", err)
+		return nil, fmt.Errorf("marshal ping message failed: %v", err)
 	}
 
 	// 同步行为调用
-	waiter, err := c.MqttClient.SyncAction(task.MessagePending{
-		MessageId:        types.GenerateRandomString(16),
-		SenderClientId:   c.auth.ClientId,
-		ReceiverClientId: clientId,
-		Action:           types.MessageActionPing,
-		Payload:          json.RawMessage(pingMessageJSON),
-		Expiration:       time.Now().Add(10 * time.Second).Unix(),
+	remoteResult, err := c.call(ctx, task.MessagePending{
+		MsgId:    types.GenerateRandomString(16),
+		Sender:   c.auth.ClientId,
+		Receiver: clientId,
+		Action:   types.MessageActionPing,
+		Payload:  json.RawMessage(pingMessageJSON),
+		Exp:      time.Now().Add(10 * time.Second).Unix(),
 	})
 	if err != nil {
-		return fmt.Errorf("publish failed: %v", err)
-	}
-
-	remoteResult, err := waiter.Wait()
-	if err != nil {
-		return fmt.Errorf("延迟测试远端执行失败，err=%v", err)
+		return nil, fmt.Errorf("延迟测试远端执行失败，err=%w", err)
 	}
 	if remoteResult == nil {
-		return errors.New("延迟测试远端执行失败，value为空")
+		return nil, errors.New("延迟测试远端执行失败，value为空")
 	}
 	// json反序列化
 	var pingResult types.PingMessage
 	if err := json.Unmarshal(remoteResult, &pingResult); err != nil {
-		return fmt.Errorf("延迟测试远端结果反序列化失败，err=%v", err)
+		return nil, fmt.Errorf("延迟测试远端结果反序列化失败，err=%v", err)
 	}
-	c.logger.Info().Msgf("延迟测试远端结果，单向延迟=%d，双向延迟=%d", pingResult.Time-pingMessage.Time, time.Now().UnixMilli()-pingMessage.Time)
-	return nil
+	now := time.Now().UnixMilli()
+	rtt := now - pingMessage.Time
+	result := &PingResult{
+		RTT:         time.Duration(rtt) * time.Millisecond,
+		ClockOffset: time.Duration(pingResult.Time-pingMessage.Time-rtt/2) * time.Millisecond,
+	}
+	c.logger.Info().Msgf("延迟测试远端结果，单向延迟=%d，双向延迟=%d，时钟偏差=%s", pingResult.Time-pingMessage.Time, rtt, result.ClockOffset)
+	return result, nil
 }
 
 // 列出客户端实例
@@ -137,7 +341,7 @@ func (c *Controller) ListInstances(clientId string) ([]types.InstanceConfigLocal
 }
 
 // 删除客户端实例
-func (c *Controller) DeleteInstance(clientId string, instanceName string) error {
+func (c *Controller) DeleteInstance(ctx context.Context, clientId string, instanceName string) error {
 	if clientId == "" {
 		return errors.New("clientId is empty")
 	}
@@ -155,21 +359,16 @@ func (c *Controller) DeleteInstance(clientId string, instanceName string) error
 	}
 
 	// 同步行为调用
-	waiter, err := c.MqttClient.SyncAction(task.MessagePending{
-		MessageId:        types.GenerateRandomString(16),
-		SenderClientId:   c.auth.ClientId,
-		ReceiverClientId: clientId,
-		Action:           types.MessageActionDelete,
-		Payload:          json.RawMessage(deleteMessageJSON),
-		Expiration:       time.Now().Add(10 * time.Second).Unix(),
+	remoteResult, err := c.call(ctx, task.MessagePending{
+		MsgId:    types.GenerateRandomString(16),
+		Sender:   c.auth.ClientId,
+		Receiver: clientId,
+		Action:   types.MessageActionDelete,
+		Payload:  json.RawMessage(deleteMessageJSON),
+		Exp:      time.Now().Add(10 * time.Second).Unix(),
 	})
 	if err != nil {
-		return fmt.Errorf("publish failed: %v", err)
-	}
-
-	remoteResult, err := waiter.Wait()
-	if err != nil {
-		return fmt.Errorf("删除实例远端执行失败，err=%v", err)
+		return fmt.Errorf("删除实例远端执行失败，err=%w", err)
 	}
 	if remoteResult == nil {
 		return errors.New("删除实例远端执行失败，value为空")
@@ -179,14 +378,108 @@ func (c *Controller) DeleteInstance(clientId string, instanceName string) error
 	return nil
 }
 
+// cancelWait 等待被控端回复取消结果的时间
+const cancelWait = 10 * time.Second
+
+// CancelTask 取消发往指定被控端的任务，返回任务是否已被移除、不会再执行
+// 任务正在执行时只能请求取消，结果的State为mqtt.CancelRunning，任务最终是否完成以任务的回复为准
+// 取消请求的有效期与任务日志中原任务的过期时间相同，原任务还在代理暂存时，被控端上线后会先收到原任务再收到取消请求
+// 被控端离线时在cancelWait内收不到回复，返回task.ErrTimeout，取消请求仍会在上线后送达
+func (c *Controller) CancelTask(ctx context.Context, clientId string, messageId string) (*mqtt.CancelResult, error) {
+	if clientId == "" || messageId == "" {
+		return nil, errors.New("clientId或messageId为空")
+	}
+	exp := time.Now().Add(time.Minute)
+	if c.journal != nil {
+		if record, err := c.journal.Get(messageId); err == nil && time.Unix(record.Expiration, 0).After(exp) {
+			exp = time.Unix(record.Expiration, 0)
+		}
+	}
+	msg := mqtt.NewCancelMessage(c.auth.ClientId, clientId, messageId, exp)
+	waiter, err := c.dispatch(msg)
+	if err != nil {
+		return nil, fmt.Errorf("取消任务发送失败，err=%v", err)
+	}
+	defer c.caller.Release(waiter)
+	value, err := waiter.WaitComplete(ctx, cancelWait)
+	if err != nil {
+		return nil, fmt.Errorf("取消任务远端执行失败，err=%w", err)
+	}
+	var result mqtt.CancelResult
+	if err := json.Unmarshal(value, &result); err != nil {
+		return nil, fmt.Errorf("解析取消结果失败，err=%v", err)
+	}
+	return &result, nil
+}
+
 // 查看指定实例的lastLog
-func (c *Controller) GetLastLog(clientId string, instanceName string) ([]string, error) {
+func (c *Controller) GetLastLog(ctx context.Context, clientId string, instanceName string, tail int) ([]string, error) {
+	var lines []string
+	err := c.FollowLog(ctx, clientId, instanceName, tail, false, func(line string) {
+		lines = append(lines, line)
+	})
+	return lines, err
+}
 
-	return nil, errors.New("not implemented")
+// FollowLog 以流式任务读取实例日志，每收到一行调用一次onLine
+// follow为true时持续跟随新日志，直到实例退出或ctx被取消，ctx被取消时通知被控端停止跟随并返回nil
+func (c *Controller) FollowLog(ctx context.Context, clientId string, instanceName string, tail int, follow bool, onLine func(string)) error {
+	if clientId == "" {
+		return errors.New("clientId is empty")
+	}
+	if instanceName == "" {
+		return errors.New("instanceName is empty")
+	}
+	followJSON, err := json.Marshal(types.FollowLogMessage{
+		InstanceName: instanceName,
+		Tail:         tail,
+		Follow:       follow,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal follow log message failed: %v", err)
+	}
+
+	// 任务只在10秒内有效，被控端离线时不会在上线后开始一个无人接收的跟随
+	msg := task.MessagePending{
+		MsgId:    types.GenerateRandomString(16),
+		Sender:   c.auth.ClientId,
+		Receiver: clientId,
+		Action:   types.MessageActionFollowLog,
+		Payload:  followJSON,
+		Exp:      time.Now().Add(10 * time.Second).Unix(),
+		Stream:   true,
+	}
+	c.record(msg)
+	stream, err := c.caller.OpenStream(msg)
+	if err != nil {
+		c.sendFailed(msg, err)
+		return fmt.Errorf("读取日志发送失败，err=%v", err)
+	}
+	defer stream.Close()
+
+	if err := stream.Waiter().WaitAck(ctx, 10*time.Second); err != nil {
+		return fmt.Errorf("被控端未确认收到读取日志任务，err=%w", err)
+	}
+	for {
+		data, err := stream.Recv(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				if cancelErr := stream.Cancel(); cancelErr != nil {
+					c.logger.Warn().Msgf("通知被控端停止跟随日志失败，messageId=%s, err=%v", stream.MessageId(), cancelErr)
+				}
+				return nil
+			}
+			return fmt.Errorf("读取日志远端执行失败，err=%w", err)
+		}
+		onLine(string(data))
+	}
 }
 
 // 查看指定实例的status
-func (c *Controller) GetStatus(clientId string, instanceName string) (*types.InstanceStatus, error) {
+func (c *Controller) GetStatus(ctx context.Context, clientId string, instanceName string) (*types.InstanceStatus, error) {
 	if clientId == "" {
 		return nil, errors.New("clientId is empty")
 	}
@@ -204,21 +497,16 @@ func (c *Controller) GetStatus(clientId string, instanceName string) (*types.Ins
 	}
 
 	// 同步行为调用
-	waiter, err := c.MqttClient.SyncAction(task.MessagePending{
-		MessageId:        types.GenerateRandomString(16),
-		SenderClientId:   c.auth.ClientId,
-		ReceiverClientId: clientId,
-		Action:           types.MessageActionGetStatus,
-		Payload:          json.RawMessage(statusMessageJSON),
-		Expiration:       time.Now().Add(10 * time.Second).Unix(),
+	remoteResult, err := c.call(ctx, task.MessagePending{
+		MsgId:    types.GenerateRandomString(16),
+		Sender:   c.auth.ClientId,
+		Receiver: clientId,
+		Action:   types.MessageActionGetStatus,
+		Payload:  json.RawMessage(statusMessageJSON),
+		Exp:      time.Now().Add(10 * time.Second).Unix(),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("publish failed: %v", err)
-	}
-
-	remoteResult, err := waiter.Wait()
-	if err != nil {
-		return nil, fmt.Errorf("获取状态远端执行失败，err=%v", err)
+		return nil, fmt.Errorf("获取状态远端执行失败，err=%w", err)
 	}
 	if remoteResult == nil {
 		return nil, errors.New("获取状态远端执行失败，value为空")
@@ -234,7 +522,7 @@ func (c *Controller) GetStatus(clientId string, instanceName string) (*types.Ins
 }
 
 // SendWOL 发送WOL命令到指定客户端
-func (c *Controller) SendWOL(clientId string, macAddress string) error {
+func (c *Controller) SendWOL(ctx context.Context, clientId string, macAddress string) error {
 	if clientId == "" {
 		return errors.New("clientId is empty")
 	}
@@ -252,21 +540,16 @@ func (c *Controller) SendWOL(clientId string, macAddress string) error {
 	}
 
 	// 同步行为调用
-	waiter, err := c.MqttClient.SyncAction(task.MessagePending{
-		MessageId:        types.GenerateRandomString(16),
-		SenderClientId:   c.auth.ClientId,
-		ReceiverClientId: clientId,
-		Action:           types.MessageActionWOL,
-		Payload:          json.RawMessage(wolMessageJSON),
-		Expiration:       time.Now().Add(10 * time.Second).Unix(),
+	remoteResult, err := c.call(ctx, task.MessagePending{
+		MsgId:    types.GenerateRandomString(16),
+		Sender:   c.auth.ClientId,
+		Receiver: clientId,
+		Action:   types.MessageActionWOL,
+		Payload:  json.RawMessage(wolMessageJSON),
+		Exp:      time.Now().Add(10 * time.Second).Unix(),
 	})
 	if err != nil {
-		return fmt.Errorf("publish failed: %v", err)
-	}
-
-	remoteResult, err := waiter.Wait()
-	if err != nil {
-		return fmt.Errorf("发送WOL命令远端执行失败，err=%v", err)
+		return fmt.Errorf("发送WOL命令远端执行失败，err=%w", err)
 	}
 	if remoteResult == nil {
 		return errors.New("发送WOL命令远端执行失败，value为空")
@@ -277,7 +560,7 @@ func (c *Controller) SendWOL(clientId string, macAddress string) error {
 }
 
 // SendShutdownWindows 发送Windows远程关机消息到指定客户端
-func (c *Controller) SendShutdownWindows(clientId string, ip, username, password string) error {
+func (c *Controller) SendShutdownWindows(ctx context.Context, clientId string, ip, username, password string) error {
 	if clientId == "" {
 		return errors.New("clientId is empty")
 	}
@@ -303,21 +586,16 @@ func (c *Controller) SendShutdownWindows(clientId string, ip, username, password
 	}
 
 	// 同步行为调用
-	waiter, err := c.MqttClient.SyncAction(task.MessagePending{
-		MessageId:        types.GenerateRandomString(16),
-		SenderClientId:   c.auth.ClientId,
-		ReceiverClientId: clientId,
-		Action:           types.MessageActionShutdownWindows,
-		Payload:          json.RawMessage(shutdownMessageJSON),
-		Expiration:       time.Now().Add(10 * time.Second).Unix(),
+	remoteResult, err := c.call(ctx, task.MessagePending{
+		MsgId:    types.GenerateRandomString(16),
+		Sender:   c.auth.ClientId,
+		Receiver: clientId,
+		Action:   types.MessageActionShutdownWindows,
+		Payload:  json.RawMessage(shutdownMessageJSON),
+		Exp:      time.Now().Add(10 * time.Second).Unix(),
 	})
 	if err != nil {
-		return fmt.Errorf("publish failed: %v", err)
-	}
-
-	remoteResult, err := waiter.Wait()
-	if err != nil {
-		return fmt.Errorf("Windows远程关机远端执行失败，err=%v", err)
+		return fmt.Errorf("Windows远程关机远端执行失败，err=%w", err)
 	}
 	if remoteResult == nil {
 		return errors.New("Windows远程关机远端执行失败，value为空")
@@ -327,4 +605,38 @@ func (c *Controller) SendShutdownWindows(clientId string, ip, username, password
 	return nil
 }
 
-//
+// GetClientStatus 读取被控端保留在status主题上的最新状态，被控端异常断线时由遗嘱消息更新为离线
+// 返回的types.Status来自状态消息的Data字段，旧版被控端或离线状态下可能为nil
+func (c *Controller) GetClientStatus(ctx context.Context, clientId string) (*task.MessageStatus, *types.Status, error) {
+	if clientId == "" {
+		return nil, nil, errors.New("clientId is empty")
+	}
+	status, err := c.caller.ReadStatus(ctx, clientId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取被控端状态失败，err=%w", err)
+	}
+	if len(status.Data) == 0 {
+		return status, nil, nil
+	}
+	var data types.Status
+	if err := json.Unmarshal(status.Data, &data); err != nil {
+		return status, nil, fmt.Errorf("解析被控端状态数据失败，err=%v", err)
+	}
+	return status, &data, nil
+}
+
+// versionWait 读取被控端状态以得知其协议版本的等待时间
+const versionWait = 3 * time.Second
+
+// negotiateVersion 被控端协议版本未知时读取其保留状态，新版被控端在状态中上报支持的版本
+// 读取失败时按v1编码，不影响任务下发
+func (c *Controller) negotiateVersion(ctx context.Context, clientId string) {
+	if c.caller.KnowsPeerVersion(clientId) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, versionWait)
+	defer cancel()
+	if _, err := c.caller.ReadStatus(ctx, clientId); err != nil {
+		c.logger.Debug().Msgf("读取被控端状态失败，按v1协议编码，clientId=%s, err=%v", clientId, err)
+	}
+}
@@ -0,0 +1,152 @@
+package fdctl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/shellus/frp-daemon/pkg/mqtt"
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+	"github.com/shellus/frp-daemon/pkg/types"
+)
+
+// fakeCaller 不连接MQTT代理的行为调用接口，记录发出的任务并立即返回预设结果
+type fakeCaller struct {
+	sent    []task.MessagePending
+	result  []byte
+	err     error // 被控端回复的错误
+	sendErr error // 发布到代理失败
+	status  *task.MessageStatus
+}
+
+func (f *fakeCaller) Dispatch(action task.MessagePending) (*task.Waiter, error) {
+	if f.sendErr != nil {
+		return nil, f.sendErr
+	}
+	f.sent = append(f.sent, action)
+	registry := task.NewRegistry()
+	waiter := task.NewWaiter(action.MsgId, time.Unix(action.Exp, 0))
+	if err := registry.Add(waiter); err != nil {
+		return nil, err
+	}
+	var result interface{} = f.result
+	if f.err != nil {
+		result = f.err
+	}
+	registry.Resolve(action.MsgId, result)
+	return waiter, nil
+}
+
+func (f *fakeCaller) Release(waiter *task.Waiter) {}
+
+func (f *fakeCaller) OpenStream(action task.MessagePending) (*mqtt.Stream, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeCaller) ReadStatus(ctx context.Context, clientId string) (*task.MessageStatus, error) {
+	if f.status == nil {
+		return nil, errors.New("no status")
+	}
+	return f.status, nil
+}
+
+func (f *fakeCaller) KnowsPeerVersion(peer string) bool {
+	return true
+}
+
+func (f *fakeCaller) Disconnect() error {
+	return nil
+}
+
+func newTestController(t *testing.T, caller mqtt.Caller) *Controller {
+	t.Helper()
+	c, err := NewController(types.ClientAuth{ClientId: "ctl"}, types.MQTTClientOpts{}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetCaller(caller)
+	return c
+}
+
+func TestControllerPing(t *testing.T) {
+	pong, _ := json.Marshal(types.PingMessage{Time: 1})
+	tests := []struct {
+		name   string
+		result []byte
+		err    error
+		ok     bool
+	}{
+		{"成功", pong, nil, true},
+		{"远端失败", nil, errors.New("boom"), false},
+		{"结果为空", nil, nil, false},
+		{"结果无法解析", []byte("x"), nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caller := &fakeCaller{result: tt.result, err: tt.err}
+			c := newTestController(t, caller)
+			_, err := c.Ping(context.Background(), "client")
+			if (err == nil) != tt.ok {
+				t.Fatalf("ok=%v, err=%v", tt.ok, err)
+			}
+			if len(caller.sent) != 1 {
+				t.Fatalf("应发出一个任务，sent=%d", len(caller.sent))
+			}
+			msg := caller.sent[0]
+			if msg.Action != types.MessageActionPing || msg.Sender != "ctl" || msg.Receiver != "client" || msg.MsgId == "" || msg.Exp == 0 {
+				t.Fatalf("任务内容错误，msg=%+v", msg)
+			}
+		})
+	}
+}
+
+func TestControllerGetClientStatus(t *testing.T) {
+	data, _ := json.Marshal(types.Status{ID: "client"})
+	offline := task.NewOfflineStatus()
+	tests := []struct {
+		name     string
+		status   *task.MessageStatus
+		ok       bool
+		withData bool
+	}{
+		{"带状态数据", &task.MessageStatus{Data: data}, true, true},
+		{"离线状态没有数据", &offline, true, false},
+		{"读取失败", nil, false, false},
+		{"状态数据无法解析", &task.MessageStatus{Data: []byte("x")}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t, &fakeCaller{status: tt.status})
+			_, got, err := c.GetClientStatus(context.Background(), "client")
+			if (err == nil) != tt.ok {
+				t.Fatalf("ok=%v, err=%v", tt.ok, err)
+			}
+			if (got != nil) != tt.withData {
+				t.Fatalf("withData=%v, got=%+v", tt.withData, got)
+			}
+		})
+	}
+}
+
+func TestControllerJournalSendError(t *testing.T) {
+	journal, err := OpenJournal(filepath.Join(t.TempDir(), "journal.jsonl"), zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestController(t, &fakeCaller{sendErr: errors.New("not connected")})
+	c.SetJournal(journal)
+	if _, err := c.Ping(context.Background(), "client"); err == nil {
+		t.Fatal("发布失败时应返回错误")
+	}
+	records, err := journal.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].State != TaskFailed || records[0].ResultError == "" {
+		t.Fatalf("发布失败的任务应记为failed，records=%+v", records)
+	}
+}
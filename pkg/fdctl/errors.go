@@ -0,0 +1,26 @@
+package fdctl
+
+import (
+	"errors"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+// CodeTimeout 等待被控端响应超时，不是被控端回复的错误码，由ErrorCode在超时时返回
+const CodeTimeout = "timeout"
+
+// ErrorCode 返回远端调用错误的错误码
+// 被控端回复failed时为错误信封中的错误码（见task.Code*），等待响应超时为CodeTimeout，其他错误返回空
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	var remote *task.RemoteError
+	if errors.As(err, &remote) {
+		return remote.Code
+	}
+	if isTimeout(err) {
+		return CodeTimeout
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package fdctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+// DefaultGroupConcurrency 群发任务默认同时等待的被控端数量
+const DefaultGroupConcurrency = 16
+
+// GroupState 群发任务中单个被控端的结果
+type GroupState int
+
+const (
+	// GroupAnswered 被控端已回复complete
+	GroupAnswered GroupState = iota
+	// GroupFailed 被控端回复了failed，或任务下发失败
+	GroupFailed
+	// GroupTimedOut 截止时间内没有收到结果
+	GroupTimedOut
+)
+
+func (s GroupState) String() string {
+	switch s {
+	case GroupAnswered:
+		return "成功"
+	case GroupFailed:
+		return "失败"
+	case GroupTimedOut:
+		return "超时"
+	default:
+		return fmt.Sprintf("未知状态(%d)", int(s))
+	}
+}
+
+// GroupResult 群发任务中单个被控端的结果
+type GroupResult struct {
+	ClientId string
+	State    GroupState
+	Err      error
+	Elapsed  time.Duration
+}
+
+// GroupReport 群发任务的汇总结果，Results与传入的clientIds顺序一致
+type GroupReport struct {
+	Results []GroupResult
+}
+
+// Count 返回处于指定状态的被控端数量
+func (r *GroupReport) Count(state GroupState) int {
+	n := 0
+	for _, result := range r.Results {
+		if result.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// OK 是否所有被控端都已成功
+func (r *GroupReport) OK() bool {
+	return r.Count(GroupAnswered) == len(r.Results)
+}
+
+// Group 对一组被控端执行同一个操作，每个被控端单独下发任务，分别签名和加密
+// 只支持显式的被控端列表（controller.yaml的groups在调用前展开），不支持发布一次、组内成员共同订阅的分组主题：
+// 签名覆盖receiver、负载用各被控端自己的密钥加密，而且complete/failed响应不带回复方，无法按成员汇总
+// 最多同时等待concurrency个被控端，为0时使用DefaultGroupConcurrency
+// timeout是整组的截止时间，超过后仍未返回的被控端记为超时，fn应当使用传入的ctx
+func (c *Controller) Group(ctx context.Context, clientIds []string, concurrency int, timeout time.Duration, fn func(ctx context.Context, clientId string) error) *GroupReport {
+	if concurrency <= 0 {
+		concurrency = DefaultGroupConcurrency
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	report := &GroupReport{Results: make([]GroupResult, len(clientIds))}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, clientId := range clientIds {
+		wg.Add(1)
+		go func(i int, clientId string) {
+			defer wg.Done()
+			result := GroupResult{ClientId: clientId}
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				result.State, result.Err = GroupTimedOut, ctx.Err()
+				report.Results[i] = result
+				return
+			}
+
+			start := time.Now()
+			err := fn(ctx, clientId)
+			result.Elapsed = time.Since(start)
+			result.Err = err
+			switch {
+			case err == nil:
+				result.State = GroupAnswered
+			case isTimeout(err) || ctx.Err() != nil:
+				result.State = GroupTimedOut
+			default:
+				result.State = GroupFailed
+			}
+			report.Results[i] = result
+		}(i, clientId)
+	}
+	wg.Wait()
+	return report
+}
+
+// isTimeout 是否为等待响应超时
+func isTimeout(err error) bool {
+	return errors.Is(err, task.ErrTimeout) || errors.Is(err, task.ErrAckTimeout) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,82 @@
+package fdctl
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+func TestGroup(t *testing.T) {
+	// 每个被控端的假操作，slow的在截止时间之前不会返回
+	behaviors := map[string]func(ctx context.Context) error{
+		"ok":       func(ctx context.Context) error { return nil },
+		"failed":   func(ctx context.Context) error { return task.NewRemoteError(task.CodeInternal, "boom") },
+		"timeout":  func(ctx context.Context) error { return task.ErrTimeout },
+		"no_ack":   func(ctx context.Context) error { return task.ErrAckTimeout },
+		"send_err": func(ctx context.Context) error { return errors.New("发布失败") },
+		"slow": func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	fn := func(ctx context.Context, clientId string) error {
+		return behaviors[clientId](ctx)
+	}
+	tests := []struct {
+		name        string
+		clientIds   []string
+		concurrency int
+		want        []GroupState
+	}{
+		{"全部成功", []string{"ok", "ok"}, 0, []GroupState{GroupAnswered, GroupAnswered}},
+		{"成功失败和超时", []string{"ok", "failed", "timeout", "no_ack", "send_err", "slow"}, 0,
+			[]GroupState{GroupAnswered, GroupFailed, GroupTimedOut, GroupTimedOut, GroupFailed, GroupTimedOut}},
+		// 并发为1时，排在后面的被控端等到截止时间也没有开始，记为超时
+		{"排队到截止时间", []string{"slow", "slow"}, 1, []GroupState{GroupTimedOut, GroupTimedOut}},
+		{"空列表", nil, 0, []GroupState{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t, &fakeCaller{})
+			start := time.Now()
+			report := c.Group(context.Background(), tt.clientIds, tt.concurrency, 100*time.Millisecond, fn)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("截止时间之后没有返回，elapsed=%v", elapsed)
+			}
+			if len(report.Results) != len(tt.want) {
+				t.Fatalf("results=%+v", report.Results)
+			}
+			started := 0
+			counts := make(map[GroupState]int)
+			for i, result := range report.Results {
+				if result.ClientId != tt.clientIds[i] {
+					t.Fatalf("结果顺序与clientIds不一致，results=%+v", report.Results)
+				}
+				if result.State != tt.want[i] {
+					t.Fatalf("clientId=%s, state=%s, want=%s, err=%v", result.ClientId, result.State, tt.want[i], result.Err)
+				}
+				if (result.Err == nil) != (result.State == GroupAnswered) {
+					t.Fatalf("clientId=%s, state=%s, err=%v", result.ClientId, result.State, result.Err)
+				}
+				if result.Elapsed > 0 {
+					started++
+				}
+				counts[tt.want[i]]++
+			}
+			if limit := tt.concurrency; limit > 0 && started > limit {
+				t.Fatalf("同时执行了%d个，concurrency=%d", started, limit)
+			}
+			for _, state := range []GroupState{GroupAnswered, GroupFailed, GroupTimedOut} {
+				if report.Count(state) != counts[state] {
+					t.Fatalf("Count(%s)=%d, want=%d", state, report.Count(state), counts[state])
+				}
+			}
+			if report.OK() != (counts[GroupAnswered] == len(tt.want)) {
+				t.Fatalf("OK=%v", report.OK())
+			}
+		})
+	}
+}
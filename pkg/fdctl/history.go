@@ -0,0 +1,123 @@
+package fdctl
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+// HistoryRecord 被控端的一条历史记录
+type HistoryRecord struct {
+	ClientId string `json:"client_id"`
+	// Received 控制端收到的时间，与Time相差较大的记录是被控端断线期间产生、重连后补发的
+	Received int64 `json:"received"`
+	task.MessageHistory
+}
+
+// History 被控端历史记录的本地存档，只追加写入，文件中每行一条记录
+// 被控端崩溃重启后可能重发已发布过的记录，读取时按被控端、Seq和Time去重
+type History struct {
+	path   string
+	mu     sync.Mutex
+	logger zerolog.Logger
+}
+
+// OpenHistory 打开历史记录存档，文件不存在时会在首次写入时创建
+func OpenHistory(path string, logger zerolog.Logger) (*History, error) {
+	if path == "" {
+		return nil, errors.New("history path is empty")
+	}
+	return &History{
+		path:   path,
+		logger: logger,
+	}, nil
+}
+
+// OnHistory 追加一条收到的历史记录，用作mqtt.SubscribeHistory的回调
+func (h *History) OnHistory(clientId string, msg task.MessageHistory) {
+	record := HistoryRecord{
+		ClientId:       clientId,
+		Received:       time.Now().Unix(),
+		MessageHistory: msg,
+	}
+	if msg.Dropped > 0 {
+		h.logger.Warn().Msgf("被控端断线期间丢弃了部分历史记录，clientId=%s, seq=%d, dropped=%d", clientId, msg.Seq, msg.Dropped)
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		h.logger.Warn().Msgf("序列化历史记录失败，err=%v", err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		h.logger.Warn().Msgf("写入历史记录失败，err=%v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		h.logger.Warn().Msgf("写入历史记录失败，err=%v", err)
+	}
+}
+
+// List 返回指定被控端在since之后产生的历史记录，按产生时间和Seq排序，clientId为空时返回所有被控端的记录
+func (h *History) List(clientId string, since time.Time) ([]HistoryRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	type key struct {
+		clientId string
+		seq      int64
+		time     int64
+	}
+	seen := make(map[key]bool)
+	var records []HistoryRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var record HistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			h.logger.Warn().Msgf("历史记录存在无法解析的行，已跳过，err=%v", err)
+			continue
+		}
+		if clientId != "" && record.ClientId != clientId {
+			continue
+		}
+		if record.Time < since.Unix() {
+			continue
+		}
+		k := key{record.ClientId, record.Seq, record.Time}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(a, b int) bool {
+		if records[a].Time != records[b].Time {
+			return records[a].Time < records[b].Time
+		}
+		return records[a].Seq < records[b].Seq
+	})
+	return records, nil
+}
@@ -0,0 +1,133 @@
+//go:build !windows
+
+package fdctl
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/shellus/frp-daemon/pkg/fdclient"
+	"github.com/shellus/frp-daemon/pkg/frp"
+	"github.com/shellus/frp-daemon/pkg/mqtt"
+	"github.com/shellus/frp-daemon/pkg/types"
+	"gopkg.in/yaml.v3"
+)
+
+const hubFrpVersion = "0.61.0"
+
+// newHubClient 创建通过Hub连接的被控端，frpc是一个只打印日志然后等待的脚本，不需要下载
+func newHubClient(t *testing.T, hub *mqtt.Hub, clientId, password string) (*fdclient.Client, *fdclient.ConfigFile, string) {
+	t.Helper()
+	dir := t.TempDir()
+	binDir := filepath.Join(dir, "bin")
+	instancesDir := filepath.Join(dir, "instances")
+	stateDir := filepath.Join(dir, "state")
+	for _, d := range []string{binDir, instancesDir, stateDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	frpc := "#!/bin/sh\necho \"frpc started $2\"\nexec sleep 60\n"
+	if err := os.WriteFile(filepath.Join(binDir, "frpc-"+hubFrpVersion), []byte(frpc), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, err := yaml.Marshal(fdclient.ClientConfig{
+		Client: types.ClientAuth{ClientId: clientId, Password: password},
+		Mqtt:   types.MQTTClientOpts{ClientID: clientId, Username: clientId, TopicPrefix: "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "client.yaml")
+	if err := os.WriteFile(configPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	configFile, err := fdclient.LoadClientConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := fdclient.NewClientWithTransport(configFile, frp.NewRunner(zerolog.Nop()), binDir, instancesDir, stateDir, hub.Transport(), zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Stop() })
+	return client, configFile, instancesDir
+}
+
+func newHubController(t *testing.T, hub *mqtt.Hub) *Controller {
+	t.Helper()
+	c, err := NewController(types.ClientAuth{ClientId: "ctl"}, types.MQTTClientOpts{ClientID: "ctl", Username: "ctl", TopicPrefix: "test"}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetTransport(hub.Transport())
+	if err := c.ConnectMQTT(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Disconnect() })
+	return c
+}
+
+// 控制端下发配置、读取状态和删除实例，被控端通过Hub收到任务并启动、停止frpc
+func TestHubEndToEnd(t *testing.T) {
+	hub := mqtt.NewHub()
+	client, configFile, instancesDir := newHubClient(t, hub, "client", "secret")
+	c := newHubController(t, hub)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	frpcConfig := filepath.Join(t.TempDir(), "web.yaml")
+	if err := os.WriteFile(frpcConfig, []byte("serverAddr: 127.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	instance := types.InstanceConfigLocal{Name: "web", Version: hubFrpVersion, ConfigPath: frpcConfig}
+
+	// 密码错误时被控端拒绝更新
+	state, err := c.SendConfig(ctx, "client", "wrong", instance, time.Second, 5*time.Second, nil)
+	if err == nil || state != DeliveryReceived {
+		t.Fatalf("state=%s, err=%v", state, err)
+	}
+
+	state, err = c.SendConfig(ctx, "client", "secret", instance, time.Second, 5*time.Second, nil)
+	if err != nil || state != DeliveryApplied {
+		t.Fatalf("state=%s, err=%v", state, err)
+	}
+	if got, err := configFile.GetInstance("web"); err != nil || got.Version != hubFrpVersion {
+		t.Fatalf("被控端没有保存实例配置，instance=%+v, err=%v", got, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(instancesDir, "web.yaml")); err != nil || string(data) != "serverAddr: 127.0.0.1\n" {
+		t.Fatalf("被控端写入的frpc配置错误，data=%s, err=%v", data, err)
+	}
+
+	// 被控端上报的保留状态在控制端订阅时立即送达
+	if err := client.ReportStatus(); err != nil {
+		t.Fatal(err)
+	}
+	status, data, err := c.GetClientStatus(ctx, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Online == nil || !*status.Online || data == nil || data.ID != "client" {
+		t.Fatalf("status=%+v, data=%+v", status, data)
+	}
+	if len(data.Instances) != 1 || data.Instances[0].Name != "web" || data.Instances[0].Pid == 0 {
+		t.Fatalf("instances=%+v", data.Instances)
+	}
+
+	if err := c.DeleteInstance(ctx, "client", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := configFile.GetInstance("web"); err == nil {
+		t.Fatal("删除后被控端仍保存着实例配置")
+	}
+	if err := client.ReportStatus(); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := c.GetClientStatus(ctx, "client"); err != nil || len(data.Instances) != 0 {
+		t.Fatalf("删除后仍有实例，data=%+v, err=%v", data, err)
+	}
+}
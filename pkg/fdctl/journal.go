@@ -0,0 +1,257 @@
+package fdctl
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+// TaskState 任务在任务日志中的状态
+type TaskState string
+
+const (
+	TaskQueued    TaskState = "queued"    // 已投递到MQTT代理
+	TaskReceived  TaskState = "received"  // 被控端已回复ack
+	TaskCompleted TaskState = "completed" // 被控端已回复complete
+	TaskFailed    TaskState = "failed"    // 被控端已回复failed
+	TaskExpired   TaskState = "expired"   // 超过过期时间仍未收到执行结果
+)
+
+// 任务日志事件类型
+const (
+	journalEventSent     = "sent"
+	journalEventAck      = "ack"
+	journalEventComplete = "complete"
+	journalEventFailed   = "failed"
+)
+
+// journalEntry 任务日志中的一行，发送任务和收到响应各追加一行
+type journalEntry struct {
+	Event      string `json:"event"`
+	Time       int64  `json:"time"`
+	MessageId  string `json:"message_id"`
+	Receiver   string `json:"receiver,omitempty"`
+	Action     string `json:"action,omitempty"`
+	Expiration int64  `json:"expiration,omitempty"`
+	Value      string `json:"value,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Code       string `json:"code,omitempty"`
+}
+
+// TaskRecord 由任务日志汇总得到的单个任务记录
+type TaskRecord struct {
+	MessageId   string    `json:"message_id"`
+	Receiver    string    `json:"receiver"`
+	Action      string    `json:"action"`
+	SentTime    int64     `json:"sent_time"`
+	Expiration  int64     `json:"expiration"`
+	State       TaskState `json:"state"`
+	AckTime     int64     `json:"ack_time,omitempty"`
+	FinishTime  int64     `json:"finish_time,omitempty"`
+	ResultValue string    `json:"result_value,omitempty"`
+	ResultError string    `json:"result_error,omitempty"`
+	// ResultCode failed响应的错误码，见task.Code*
+	ResultCode string `json:"result_code,omitempty"`
+}
+
+// Journal 控制端发出任务的本地日志，只追加写入，文件中每行一个JSON事件
+// 发送任务的fdctl进程和后台订阅响应的fdctl进程可能同时写入，追加写入可以避免互相覆盖
+type Journal struct {
+	path   string
+	mu     sync.Mutex
+	logger zerolog.Logger
+}
+
+// OpenJournal 打开任务日志，文件不存在时会在首次写入时创建
+func OpenJournal(path string, logger zerolog.Logger) (*Journal, error) {
+	if path == "" {
+		return nil, errors.New("journal path is empty")
+	}
+	return &Journal{
+		path:   path,
+		logger: logger,
+	}, nil
+}
+
+// RecordSent 记录一个已发出的任务，不记录Payload，避免配置中的密钥落盘
+func (j *Journal) RecordSent(msg task.MessagePending) error {
+	return j.append(journalEntry{
+		Event:      journalEventSent,
+		Time:       time.Now().Unix(),
+		MessageId:  msg.MsgId,
+		Receiver:   msg.Receiver,
+		Action:     msg.Action,
+		Expiration: msg.Exp,
+	})
+}
+
+// RecordSendError 记录任务发布到MQTT代理失败
+func (j *Journal) RecordSendError(messageId string, sendErr error) {
+	j.appendLogged(journalEntry{
+		Event:     journalEventFailed,
+		Time:      time.Now().Unix(),
+		MessageId: messageId,
+		Error:     fmt.Sprintf("发布失败: %v", sendErr),
+	})
+}
+
+// OnAck 实现mqtt.ReplyObserver
+func (j *Journal) OnAck(msg task.MessageAck) {
+	j.appendLogged(journalEntry{
+		Event:     journalEventAck,
+		Time:      time.Now().Unix(),
+		MessageId: msg.MsgId,
+	})
+}
+
+// OnComplete 实现mqtt.ReplyObserver
+func (j *Journal) OnComplete(msg task.MessageComplete) {
+	j.appendLogged(journalEntry{
+		Event:     journalEventComplete,
+		Time:      time.Now().Unix(),
+		MessageId: msg.MsgId,
+		Value:     string(msg.Value),
+	})
+}
+
+// OnFailed 实现mqtt.ReplyObserver
+func (j *Journal) OnFailed(msg task.MessageFailed) {
+	remote := task.ParseRemoteError(msg.Error)
+	j.appendLogged(journalEntry{
+		Event:     journalEventFailed,
+		Time:      time.Now().Unix(),
+		MessageId: msg.MsgId,
+		Error:     remote.Message,
+		Code:      remote.Code,
+	})
+}
+
+// List 汇总任务日志，按发送时间倒序返回所有任务
+func (j *Journal) List() ([]TaskRecord, error) {
+	records, err := j.load()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]TaskRecord, 0, len(records))
+	for _, record := range records {
+		list = append(list, *record)
+	}
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].SentTime > list[b].SentTime
+	})
+	return list, nil
+}
+
+// Get 查找指定消息ID的任务
+func (j *Journal) Get(messageId string) (*TaskRecord, error) {
+	records, err := j.load()
+	if err != nil {
+		return nil, err
+	}
+	record, ok := records[messageId]
+	if !ok {
+		return nil, fmt.Errorf("任务日志中不存在该任务，messageId=%s", messageId)
+	}
+	return record, nil
+}
+
+// load 读取任务日志并按消息ID汇总，没有对应sent事件的响应会被忽略
+func (j *Journal) load() (map[string]*TaskRecord, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	records := make(map[string]*TaskRecord)
+	f, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return records, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			j.logger.Warn().Msgf("任务日志存在无法解析的行，已跳过，err=%v", err)
+			continue
+		}
+		if entry.Event == journalEventSent {
+			records[entry.MessageId] = &TaskRecord{
+				MessageId:  entry.MessageId,
+				Receiver:   entry.Receiver,
+				Action:     entry.Action,
+				SentTime:   entry.Time,
+				Expiration: entry.Expiration,
+				State:      TaskQueued,
+			}
+			continue
+		}
+		record, ok := records[entry.MessageId]
+		if !ok {
+			continue
+		}
+		switch entry.Event {
+		case journalEventAck:
+			record.AckTime = entry.Time
+			if record.State == TaskQueued {
+				record.State = TaskReceived
+			}
+		case journalEventComplete:
+			record.State = TaskCompleted
+			record.FinishTime = entry.Time
+			record.ResultValue = entry.Value
+		case journalEventFailed:
+			record.State = TaskFailed
+			record.FinishTime = entry.Time
+			record.ResultError = entry.Error
+			record.ResultCode = entry.Code
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	for _, record := range records {
+		if (record.State == TaskQueued || record.State == TaskReceived) && record.Expiration < now {
+			record.State = TaskExpired
+		}
+	}
+	return records, nil
+}
+
+func (j *Journal) append(entry journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+// appendLogged 用于mqtt回调中，写入失败只记录日志
+func (j *Journal) appendLogged(entry journalEntry) {
+	if err := j.append(entry); err != nil {
+		j.logger.Error().Msgf("写入任务日志失败，messageId=%s, event=%s, err=%v", entry.MessageId, entry.Event, err)
+	}
+}
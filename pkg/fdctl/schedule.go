@@ -0,0 +1,141 @@
+package fdctl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt"
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+	"github.com/shellus/frp-daemon/pkg/types"
+)
+
+// scheduleWait 等待被控端回复定时任务保存结果的时间
+const scheduleWait = 10 * time.Second
+
+// scheduleExpiration 定时任务的投递有效期，被控端离线时由MQTT代理暂存，与执行时间无关
+const scheduleExpiration = 3 * 24 * time.Hour
+
+// Schedule 任务的执行时间，NotBefore和Cron至少设置一个
+type Schedule struct {
+	NotBefore time.Time // 最早执行时间，只设置它时执行一次
+	Cron      string    // 周期执行的cron表达式，按被控端本地时区计算
+}
+
+// ScheduledTask 下发定时任务的结果
+type ScheduledTask struct {
+	MessageId string
+	// State 为DeliveryApplied时被控端已保存任务，NextRun有效；被控端离线时为DeliveryQueued，上线后才会保存
+	State   DeliveryState
+	NextRun time.Time
+}
+
+// ScheduleTask 下发定时任务，被控端保存后按时执行，执行结果通过ListSchedules查看，取消使用CancelTask
+func (c *Controller) ScheduleTask(ctx context.Context, clientId string, action string, payload []byte, schedule Schedule) (*ScheduledTask, error) {
+	if clientId == "" {
+		return nil, errors.New("clientId is empty")
+	}
+	if schedule.NotBefore.IsZero() && schedule.Cron == "" {
+		return nil, errors.New("定时任务需要设置执行时间或cron表达式")
+	}
+	// v1被控端不认识定时字段，需要先确认被控端支持v2
+	c.negotiateVersion(ctx, clientId)
+	msg := task.MessagePending{
+		MsgId:    types.GenerateRandomString(16),
+		Sender:   c.auth.ClientId,
+		Receiver: clientId,
+		Action:   action,
+		Payload:  payload,
+		Exp:      time.Now().Add(scheduleExpiration).Unix(),
+		Cron:     schedule.Cron,
+	}
+	if !schedule.NotBefore.IsZero() {
+		msg.NotBefore = schedule.NotBefore.Unix()
+	}
+	waiter, err := c.dispatch(msg)
+	if err != nil {
+		return nil, fmt.Errorf("下发定时任务发送失败，err=%v", err)
+	}
+	defer c.caller.Release(waiter)
+
+	result := &ScheduledTask{MessageId: msg.MsgId, State: DeliveryQueued}
+	if err := waiter.WaitAck(ctx, scheduleWait); err != nil {
+		if errors.Is(err, task.ErrAckTimeout) {
+			return result, nil
+		}
+		return result, err
+	}
+	result.State = DeliveryReceived
+	value, err := waiter.WaitComplete(ctx, scheduleWait)
+	if err != nil {
+		if errors.Is(err, task.ErrTimeout) {
+			return result, nil
+		}
+		return result, fmt.Errorf("下发定时任务远端执行失败，err=%w", err)
+	}
+	var scheduled mqtt.ScheduleResult
+	if err := json.Unmarshal(value, &scheduled); err != nil {
+		return result, fmt.Errorf("解析定时任务保存结果失败，err=%v", err)
+	}
+	result.State = DeliveryApplied
+	result.NextRun = time.Unix(scheduled.NextRun, 0)
+	c.logger.Info().Msgf("被控端已保存定时任务，clientId=%s, messageId=%s, nextRun=%s", clientId, msg.MsgId, result.NextRun.Format(time.DateTime))
+	return result, nil
+}
+
+// ScheduleWOL 定时发送WOL命令
+func (c *Controller) ScheduleWOL(ctx context.Context, clientId string, macAddress string, schedule Schedule) (*ScheduledTask, error) {
+	if macAddress == "" {
+		return nil, errors.New("macAddress is empty")
+	}
+	payload, err := json.Marshal(types.WOLMessage{MacAddress: macAddress})
+	if err != nil {
+		return nil, fmt.Errorf("marshal wol message failed: %v", err)
+	}
+	return c.ScheduleTask(ctx, clientId, types.MessageActionWOL, payload, schedule)
+}
+
+// ScheduleConfig 定时下发配置，配置内容在下发时读取，到执行时间后被控端才更新实例
+func (c *Controller) ScheduleConfig(ctx context.Context, clientId string, clientPassword string, config types.InstanceConfigLocal, schedule Schedule) (*ScheduledTask, error) {
+	configContent, err := os.ReadFile(config.ConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("下发配置读取frpc.ini文件失败，err=%v，configPaht=%s", err, config.ConfigPath)
+	}
+	payload, err := json.Marshal(types.InstanceConfigRemote{
+		ClientPassword: clientPassword,
+		Name:           config.Name,
+		Version:        config.Version,
+		ConfigContent:  string(configContent),
+		Restart:        config.Restart,
+		StopTimeout:    config.StopTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.ScheduleTask(ctx, clientId, types.MessageActionUpdate, payload, schedule)
+}
+
+// ListSchedules 列出被控端保存的本控制端下发的定时任务
+func (c *Controller) ListSchedules(ctx context.Context, clientId string) ([]mqtt.ScheduleInfo, error) {
+	if clientId == "" {
+		return nil, errors.New("clientId is empty")
+	}
+	value, err := c.call(ctx, task.MessagePending{
+		MsgId:    types.GenerateRandomString(16),
+		Sender:   c.auth.ClientId,
+		Receiver: clientId,
+		Action:   task.ActionSchedules,
+		Exp:      time.Now().Add(10 * time.Second).Unix(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("列出定时任务远端执行失败，err=%w", err)
+	}
+	var infos []mqtt.ScheduleInfo
+	if err := json.Unmarshal(value, &infos); err != nil {
+		return nil, fmt.Errorf("解析定时任务列表失败，err=%v", err)
+	}
+	return infos, nil
+}
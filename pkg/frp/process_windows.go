@@ -0,0 +1,34 @@
+//go:build windows
+
+package frp
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+var procGenerateConsoleCtrlEvent = syscall.NewLazyDLL("kernel32.dll").NewProc("GenerateConsoleCtrlEvent")
+
+// setProcessGroup 让进程在新的进程组中运行，只有这样才能单独向它发送CTRL_BREAK_EVENT
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// terminateProcess 向进程组发送CTRL_BREAK_EVENT，frpc收到后优雅退出
+// 被控端作为服务运行、没有控制台时发送会失败，返回错误后StopInstance不再等待宽限期，直接强制结束进程树
+func terminateProcess(cmd *exec.Cmd) error {
+	r, _, err := procGenerateConsoleCtrlEvent.Call(syscall.CTRL_BREAK_EVENT, uintptr(cmd.Process.Pid))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// killProcess 使用taskkill结束进程树，失败时只结束frpc本身
+func killProcess(cmd *exec.Cmd) error {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run(); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package frp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shellus/frp-daemon/pkg/types"
+)
+
+const (
+	// DefaultRestartMaxRetries 默认连续快速退出多少次后判定为崩溃循环
+	DefaultRestartMaxRetries = 10
+	// DefaultRestartInitialBackoff 默认首次重启前等待的时间
+	DefaultRestartInitialBackoff = time.Second
+	// DefaultRestartMaxBackoff 默认重启前等待的最长时间
+	DefaultRestartMaxBackoff = 5 * time.Minute
+	// DefaultRestartMinUptime 默认运行不足多久就退出算作快速退出
+	DefaultRestartMinUptime = 10 * time.Second
+)
+
+// ValidateRestartPolicy 检查重启策略是否有效，为空时有效
+func ValidateRestartPolicy(policy *types.RestartPolicy) error {
+	_, err := newRestartPolicy(policy)
+	return err
+}
+
+// restartPolicy 填充默认值后的重启策略
+type restartPolicy struct {
+	policy         string
+	maxRetries     int // 小于0时不限制
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	minUptime      time.Duration
+}
+
+// newRestartPolicy 校验重启策略并填充默认值，policy为空时使用默认策略
+func newRestartPolicy(policy *types.RestartPolicy) (restartPolicy, error) {
+	p := restartPolicy{
+		policy:         types.RestartAlways,
+		maxRetries:     DefaultRestartMaxRetries,
+		initialBackoff: DefaultRestartInitialBackoff,
+		maxBackoff:     DefaultRestartMaxBackoff,
+		minUptime:      DefaultRestartMinUptime,
+	}
+	if policy == nil {
+		return p, nil
+	}
+	switch policy.Policy {
+	case "":
+	case types.RestartAlways, types.RestartOnFailure, types.RestartNever:
+		p.policy = policy.Policy
+	default:
+		return p, fmt.Errorf("不支持的重启策略，policy=%s", policy.Policy)
+	}
+	if policy.MaxRetries != 0 {
+		p.maxRetries = policy.MaxRetries
+	}
+	if policy.InitialBackoff > 0 {
+		p.initialBackoff = time.Duration(policy.InitialBackoff) * time.Second
+	}
+	if policy.MaxBackoff > 0 {
+		p.maxBackoff = time.Duration(policy.MaxBackoff) * time.Second
+	}
+	if p.maxBackoff < p.initialBackoff {
+		p.maxBackoff = p.initialBackoff
+	}
+	if policy.MinUptime > 0 {
+		p.minUptime = time.Duration(policy.MinUptime) * time.Second
+	}
+	return p, nil
+}
+
+// shouldRestart 按退出状态判断是否需要重启
+func (p restartPolicy) shouldRestart(exitStatus int) bool {
+	switch p.policy {
+	case types.RestartAlways:
+		return true
+	case types.RestartOnFailure:
+		return exitStatus != 0
+	}
+	return false
+}
+
+// backoff 第failures次连续快速退出后重启前等待的时间，从initialBackoff开始按2倍增长，最长maxBackoff
+func (p restartPolicy) backoff(failures int) time.Duration {
+	d := p.initialBackoff
+	for i := 1; i < failures && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	return d
+}
+
+// scheduleRestart 实例意外退出后按重启策略安排重启，返回值表示实例是否需要保留在列表中，调用方需持有锁
+// 运行超过minUptime后退出时连续快速退出次数清零，超过maxRetries时判定为崩溃循环，不再重启
+func (r *Runner) scheduleRestart(instance *Instance, event *types.InstanceEvent, now time.Time) (keep bool, crashLoop bool) {
+	if !instance.policy.shouldRestart(instance.status.ExitStatus) {
+		return false, false
+	}
+	if now.Sub(time.Unix(instance.status.StartTime, 0)) >= instance.policy.minUptime {
+		instance.failures = 0
+	}
+	instance.failures++
+	if instance.policy.maxRetries >= 0 && instance.failures > instance.policy.maxRetries {
+		instance.status.CrashLoop = true
+		r.logger.Error().Msgf("实例连续快速退出%d次，判定为崩溃循环，停止自动重启，instanceName=%s, exitStatus=%d", instance.failures, instance.Name, instance.status.ExitStatus)
+		return true, true
+	}
+
+	delay := instance.policy.backoff(instance.failures)
+	next := now.Add(delay)
+	instance.status.NextRestartTime = next.Unix()
+	event.NextRestartTime = next.Unix()
+	instance.restartSeq++
+	seq := instance.restartSeq
+	instance.restartTimer = time.AfterFunc(delay, func() {
+		r.restart(instance, seq)
+	})
+	r.logger.Warn().Msgf("实例意外退出，将在%s后重启，instanceName=%s, exitStatus=%d, failures=%d", delay, instance.Name, instance.status.ExitStatus, instance.failures)
+	return true, false
+}
+
+// restart 重启等待中的实例，启动失败时按一次快速退出处理
+func (r *Runner) restart(instance *Instance, seq int) {
+	r.mu.Lock()
+	// 等待期间实例被停止或被替换
+	if r.instances[instance.Name] != instance || instance.restartTimer == nil || instance.restartSeq != seq {
+		r.mu.Unlock()
+		return
+	}
+	instance.restartTimer = nil
+	instance.status.NextRestartTime = 0
+	instance.status.RestartCount++
+	now := time.Now()
+	event := types.InstanceEvent{
+		Name:         instance.Name,
+		Type:         types.InstanceEventRestarted,
+		Time:         now.Unix(),
+		RestartCount: instance.status.RestartCount,
+	}
+	err := r.spawn(instance)
+	if err != nil {
+		r.logger.Error().Msgf("重启实例失败，instanceName=%s, Error=%v", instance.Name, err)
+		instance.status.StartTime = now.Unix()
+		instance.status.ExitTime = now.Unix()
+		instance.status.ExitStatus = -1
+		event.Type = types.InstanceEventExited
+		event.ExitStatus = -1
+		keep, crashLoop := r.scheduleRestart(instance, &event, now)
+		if !keep {
+			delete(r.instances, instance.Name)
+		}
+		r.mu.Unlock()
+		r.emit(event)
+		if crashLoop {
+			r.emit(crashLoopEvent(event))
+		}
+		return
+	}
+	event.Pid = instance.status.Pid
+	cmd, exit := instance.cmd, instance.exit
+	r.mu.Unlock()
+	r.logger.Info().Msgf("已自动重启实例，instanceName=%s, pid=%d, restartCount=%d", instance.Name, event.Pid, event.RestartCount)
+	r.emit(event)
+	go r.monitorInstance(instance, cmd, exit)
+}
+
+// crashLoopEvent 由退出事件生成崩溃循环事件
+func crashLoopEvent(exited types.InstanceEvent) types.InstanceEvent {
+	return types.InstanceEvent{
+		Name:         exited.Name,
+		Type:         types.InstanceEventCrashLoop,
+		Time:         exited.Time,
+		Pid:          exited.Pid,
+		ExitStatus:   exited.ExitStatus,
+		RestartCount: exited.RestartCount,
+	}
+}
@@ -0,0 +1,193 @@
+package frp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/shellus/frp-daemon/pkg/types"
+)
+
+func TestNewRestartPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *types.RestartPolicy
+		want   restartPolicy
+		valid  bool
+	}{
+		{
+			name:  "默认策略",
+			want:  restartPolicy{types.RestartAlways, DefaultRestartMaxRetries, DefaultRestartInitialBackoff, DefaultRestartMaxBackoff, DefaultRestartMinUptime},
+			valid: true,
+		},
+		{
+			name:   "空策略名使用默认",
+			policy: &types.RestartPolicy{MaxRetries: 3},
+			want:   restartPolicy{types.RestartAlways, 3, DefaultRestartInitialBackoff, DefaultRestartMaxBackoff, DefaultRestartMinUptime},
+			valid:  true,
+		},
+		{
+			name:   "自定义",
+			policy: &types.RestartPolicy{Policy: types.RestartOnFailure, MaxRetries: -1, InitialBackoff: 2, MaxBackoff: 60, MinUptime: 30},
+			want:   restartPolicy{types.RestartOnFailure, -1, 2 * time.Second, time.Minute, 30 * time.Second},
+			valid:  true,
+		},
+		{
+			name:   "最长等待小于首次等待",
+			policy: &types.RestartPolicy{Policy: types.RestartNever, InitialBackoff: 10, MaxBackoff: 5},
+			want:   restartPolicy{types.RestartNever, DefaultRestartMaxRetries, 10 * time.Second, 10 * time.Second, DefaultRestartMinUptime},
+			valid:  true,
+		},
+		{
+			name:   "不支持的策略",
+			policy: &types.RestartPolicy{Policy: "sometimes"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newRestartPolicy(tt.policy)
+			if (err == nil) != tt.valid {
+				t.Fatalf("valid=%v, err=%v", tt.valid, err)
+			}
+			if tt.valid && got != tt.want {
+				t.Fatalf("got=%+v, want=%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestartPolicyShouldRestart(t *testing.T) {
+	tests := []struct {
+		policy     string
+		exitStatus int
+		want       bool
+	}{
+		{types.RestartAlways, 0, true},
+		{types.RestartAlways, 1, true},
+		{types.RestartOnFailure, 0, false},
+		{types.RestartOnFailure, 1, true},
+		{types.RestartOnFailure, -1, true},
+		{types.RestartNever, 1, false},
+	}
+	for _, tt := range tests {
+		p := restartPolicy{policy: tt.policy}
+		if got := p.shouldRestart(tt.exitStatus); got != tt.want {
+			t.Errorf("policy=%s, exitStatus=%d, got=%v, want=%v", tt.policy, tt.exitStatus, got, tt.want)
+		}
+	}
+}
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	p := restartPolicy{initialBackoff: time.Second, maxBackoff: 10 * time.Second}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := p.backoff(tt.failures); got != tt.want {
+			t.Errorf("failures=%d, got=%s, want=%s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleRestart(t *testing.T) {
+	type exit struct {
+		uptime     time.Duration
+		exitStatus int
+		keep       bool
+		crashLoop  bool
+		failures   int
+		delay      time.Duration
+	}
+	tests := []struct {
+		name   string
+		policy restartPolicy
+		exits  []exit
+	}{
+		{
+			name:   "快速退出按退避等待直到崩溃循环",
+			policy: restartPolicy{types.RestartAlways, 3, time.Minute, 3 * time.Minute, 10 * time.Second},
+			exits: []exit{
+				{time.Second, 1, true, false, 1, time.Minute},
+				{time.Second, 1, true, false, 2, 2 * time.Minute},
+				{time.Second, 1, true, false, 3, 3 * time.Minute},
+				{time.Second, 1, true, true, 4, 0},
+			},
+		},
+		{
+			name:   "运行超过最短时间后清零",
+			policy: restartPolicy{types.RestartAlways, 2, time.Minute, time.Hour, 10 * time.Second},
+			exits: []exit{
+				{time.Second, 1, true, false, 1, time.Minute},
+				{time.Second, 1, true, false, 2, 2 * time.Minute},
+				{time.Minute, 1, true, false, 1, time.Minute},
+				{time.Second, 1, true, false, 2, 2 * time.Minute},
+			},
+		},
+		{
+			name:   "不限制重试次数",
+			policy: restartPolicy{types.RestartAlways, -1, time.Minute, time.Minute, 10 * time.Second},
+			exits: []exit{
+				{time.Second, 1, true, false, 1, time.Minute},
+				{time.Second, 1, true, false, 2, time.Minute},
+				{time.Second, 1, true, false, 3, time.Minute},
+			},
+		},
+		{
+			name:   "正常退出不重启",
+			policy: restartPolicy{types.RestartOnFailure, 3, time.Minute, time.Minute, 10 * time.Second},
+			exits: []exit{
+				{time.Second, 1, true, false, 1, time.Minute},
+				{time.Second, 0, false, false, 1, 0},
+			},
+		},
+		{
+			name:   "从不重启",
+			policy: restartPolicy{types.RestartNever, 3, time.Minute, time.Minute, 10 * time.Second},
+			exits: []exit{
+				{time.Second, 1, false, false, 0, 0},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRunner(zerolog.Nop())
+			// 实例不在列表中，即使等待的重启到期也不会启动进程
+			instance := &Instance{Name: "test", policy: tt.policy}
+			now := time.Now()
+			for i, e := range tt.exits {
+				instance.status.StartTime = now.Add(-e.uptime).Unix()
+				instance.status.ExitStatus = e.exitStatus
+				instance.status.NextRestartTime = 0
+				event := types.InstanceEvent{Name: instance.Name}
+				keep, crashLoop := r.scheduleRestart(instance, &event, now)
+				if instance.restartTimer != nil {
+					instance.restartTimer.Stop()
+					instance.restartTimer = nil
+				}
+				if keep != e.keep || crashLoop != e.crashLoop || instance.failures != e.failures {
+					t.Fatalf("第%d次退出，keep=%v, crashLoop=%v, failures=%d, want keep=%v, crashLoop=%v, failures=%d",
+						i+1, keep, crashLoop, instance.failures, e.keep, e.crashLoop, e.failures)
+				}
+				if instance.status.CrashLoop != e.crashLoop {
+					t.Fatalf("第%d次退出，status.CrashLoop=%v", i+1, instance.status.CrashLoop)
+				}
+				var wantNext int64
+				if e.delay > 0 {
+					wantNext = now.Add(e.delay).Unix()
+				}
+				if instance.status.NextRestartTime != wantNext || event.NextRestartTime != wantNext {
+					t.Fatalf("第%d次退出，nextRestartTime=%d, event=%d, want=%d", i+1, instance.status.NextRestartTime, event.NextRestartTime, wantNext)
+				}
+			}
+		})
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"os"
 	"os/exec"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -18,16 +17,49 @@ import (
 type Runner struct {
 	instances map[string]*Instance
 	mu        sync.RWMutex
-	logger    zerolog.Logger
+	// onEvent 实例生命周期事件回调，在不持有锁时按发生顺序调用
+	onEvent func(types.InstanceEvent)
+	logger  zerolog.Logger
 }
 
 // Instance FRP实例本地配置
 type Instance struct {
 	Name       string
+	Version    string
 	ConfigPath string
-	cmd        *exec.Cmd
-	status     types.InstanceStatus
-	logs       []string
+	frpPath    string
+	policy     restartPolicy
+	// stopTimeout 停止实例时等待进程退出的宽限期，超过后强制结束整个进程组
+	stopTimeout time.Duration
+	cmd         *exec.Cmd
+	// exit 当前进程退出后由monitorInstance关闭，每次启动进程时重新创建
+	exit   chan struct{}
+	status types.InstanceStatus
+	logs   []string
+	// followers 正在跟随日志的订阅者，实例退出时关闭
+	followers map[chan string]struct{}
+	// exited 当前进程已退出，等待重启或已判定为崩溃循环的实例仍保留在列表中
+	exited bool
+	// failures 连续快速退出的次数，restartTimer 等待中的重启，restartSeq 区分已取消的重启
+	failures     int
+	restartTimer *time.Timer
+	restartSeq   int
+}
+
+// followBuffer 日志订阅通道的缓冲行数，订阅者读取不及时时丢弃新日志
+const followBuffer = 256
+
+const (
+	// DefaultStopTimeout 默认停止实例时等待进程退出的宽限期
+	DefaultStopTimeout = 10 * time.Second
+	// stopKillWait 强制结束进程组后等待进程退出的时间
+	stopKillWait = 5 * time.Second
+)
+
+// InstanceOptions 实例的运行选项
+type InstanceOptions struct {
+	Restart     *types.RestartPolicy // 重启策略，为空时使用默认策略
+	StopTimeout time.Duration        // 停止实例时等待进程退出的宽限期，为0时使用DefaultStopTimeout
 }
 
 // NewRunner 创建FRP运行器
@@ -38,27 +70,94 @@ func NewRunner(logger zerolog.Logger) *Runner {
 	}
 }
 
-// StartInstance 启动FRP实例
+// SetEventHandler 设置实例生命周期事件回调，需要在启动实例之前调用
+func (r *Runner) SetEventHandler(handler func(types.InstanceEvent)) {
+	r.onEvent = handler
+}
+
+// emit 调用事件回调，调用方不能持有锁
+func (r *Runner) emit(event types.InstanceEvent) {
+	if r.onEvent != nil {
+		r.onEvent(event)
+	}
+}
+
+// StartInstance 使用默认重启策略启动FRP实例
 func (r *Runner) StartInstance(name, version, frpPath, configPath string) error {
+	return r.StartInstanceWithOptions(name, version, frpPath, configPath, InstanceOptions{})
+}
+
+// StartInstanceWithOptions 启动FRP实例，实例意外退出后按opts.Restart自动重启
+func (r *Runner) StartInstanceWithOptions(name, version, frpPath, configPath string, opts InstanceOptions) error {
+	restart, err := newRestartPolicy(opts.Restart)
+	if err != nil {
+		return err
+	}
+	stopTimeout := opts.StopTimeout
+	if stopTimeout <= 0 {
+		stopTimeout = DefaultStopTimeout
+	}
+	instance, err := r.startInstance(name, version, frpPath, configPath, restart, stopTimeout)
+	if err != nil {
+		return err
+	}
+	r.emit(types.InstanceEvent{
+		Name: name,
+		Type: types.InstanceEventStarted,
+		Time: time.Now().Unix(),
+		Pid:  instance.status.Pid,
+	})
+
+	// 监控实例状态，在启动事件之后开始，退出事件不会先于启动事件
+	go r.monitorInstance(instance, instance.cmd, instance.exit)
+	return nil
+}
+
+func (r *Runner) startInstance(name, version, frpPath, configPath string, policy restartPolicy, stopTimeout time.Duration) (*Instance, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	r.logger.Info().Msgf("正在启动实例，instanceName=%s, version=%s, frpPath=%s, configPath=%s", name, version, frpPath, configPath)
+	r.logger.Info().Msgf("正在启动实例，instanceName=%s, version=%s, frpPath=%s, configPath=%s, restart=%s", name, version, frpPath, configPath, policy.policy)
 
-	// 检查实例是否已存在
+	// 检查实例是否已存在，已判定为崩溃循环的实例直接替换
 	if instance, exists := r.instances[name]; exists {
-		if instance.cmd != nil && instance.cmd.Process != nil {
-			return fmt.Errorf("实例已在运行，instanceName=%s", name)
+		if !instance.exited || instance.restartTimer != nil {
+			return nil, fmt.Errorf("实例已在运行，instanceName=%s", name)
 		}
 	}
 
+	// 保存实例信息
+	instance := &Instance{
+		Name:        name,
+		Version:     version,
+		ConfigPath:  configPath,
+		frpPath:     frpPath,
+		policy:      policy,
+		stopTimeout: stopTimeout,
+		status: types.InstanceStatus{
+			LastLog: make([]string, 0, 100),
+		},
+		logs:      make([]string, 0, 100),
+		followers: make(map[chan string]struct{}),
+	}
+	if err := r.spawn(instance); err != nil {
+		return nil, err
+	}
+	r.instances[name] = instance
+	return instance, nil
+}
+
+// spawn 启动实例的进程，首次启动和自动重启共用，调用方需持有锁
+func (r *Runner) spawn(instance *Instance) error {
 	// 检查配置文件是否存在
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		return fmt.Errorf("配置文件不存在，configPath=%s", configPath)
+	if _, err := os.Stat(instance.ConfigPath); os.IsNotExist(err) {
+		return fmt.Errorf("配置文件不存在，configPath=%s", instance.ConfigPath)
 	}
 
 	// 启动FRP实例
-	cmd := exec.Command(frpPath, "-c", configPath)
+	cmd := exec.Command(instance.frpPath, "-c", instance.ConfigPath)
+	// 在独立的进程组中运行，停止时向整个进程组发送信号，frpc的子进程也会被结束
+	setProcessGroup(cmd)
 
 	// 创建管道用于捕获输出
 	stdout, err := cmd.StdoutPipe()
@@ -75,27 +174,16 @@ func (r *Runner) StartInstance(name, version, frpPath, configPath string) error
 		return fmt.Errorf("启动FRP实例失败，Error=%v", err)
 	}
 
-	// 保存实例信息
-	instance := &Instance{
-		Name:       name,
-		ConfigPath: configPath,
-		cmd:        cmd,
-		status: types.InstanceStatus{
-			Running:   true,
-			StartTime: time.Now().Unix(),
-			Pid:       cmd.Process.Pid,
-			LastLog:   make([]string, 0, 100),
-		},
-		logs: make([]string, 0, 100),
-	}
-	r.instances[name] = instance
+	instance.cmd = cmd
+	instance.exit = make(chan struct{})
+	instance.exited = false
+	instance.status.Running = true
+	instance.status.StartTime = time.Now().Unix()
+	instance.status.Pid = cmd.Process.Pid
 
 	// 启动日志收集
 	go r.collectLogs(instance, stdout, stderr)
 
-	// 监控实例状态
-	go r.monitorInstance(name)
-
 	return nil
 }
 
@@ -138,6 +226,44 @@ func (r *Runner) appendLog(instance *Instance, line string) {
 		instance.logs = instance.logs[len(instance.logs)-100:]
 		instance.status.LastLog = instance.status.LastLog[len(instance.status.LastLog)-100:]
 	}
+
+	for ch := range instance.followers {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// FollowLogs 订阅实例日志，返回最近tail行日志和新日志通道，实例退出时通道被关闭
+// 调用方不再需要时必须调用返回的cancel
+func (r *Runner) FollowLogs(name string, tail int) ([]string, <-chan string, func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	instance, exists := r.instances[name]
+	if !exists {
+		return nil, nil, nil, fmt.Errorf("实例不存在，instanceName=%s", name)
+	}
+	if tail < 0 || tail > len(instance.logs) {
+		tail = len(instance.logs)
+	}
+	lines := append([]string{}, instance.logs[len(instance.logs)-tail:]...)
+
+	ch := make(chan string, followBuffer)
+	instance.followers[ch] = struct{}{}
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if _, ok := instance.followers[ch]; ok {
+				delete(instance.followers, ch)
+				close(ch)
+			}
+		})
+	}
+	return lines, ch, cancel, nil
 }
 
 // ExistsInstance 检查实例是否存在
@@ -148,7 +274,7 @@ func (r *Runner) ExistsInstance(name string) bool {
 	return exists
 }
 
-// StopInstance 停止FRP实例
+// StopInstance 停止FRP实例，先向进程组发送终止信号，进程退出后立即返回，超过宽限期仍未退出时强制结束整个进程组
 func (r *Runner) StopInstance(name string) error {
 	r.mu.Lock()
 	instance, exists := r.instances[name]
@@ -158,36 +284,67 @@ func (r *Runner) StopInstance(name string) error {
 		return nil
 	}
 
-	// 标记实例为已停止
+	// 取消等待中的重启
+	pending := instance.restartTimer != nil
+	if pending {
+		instance.restartTimer.Stop()
+		instance.restartTimer = nil
+		instance.status.NextRestartTime = 0
+	}
+	// 进程已退出（等待重启或已判定为崩溃循环），直接移除
+	if instance.exited {
+		delete(r.instances, name)
+		pid := instance.status.Pid
+		r.mu.Unlock()
+		r.logger.Info().Msgf("实例已退出，移除实例，instanceName=%s, pendingRestart=%v", name, pending)
+		if pending {
+			r.emit(types.InstanceEvent{
+				Name:         name,
+				Type:         types.InstanceEventStopped,
+				Time:         time.Now().Unix(),
+				Pid:          pid,
+				RestartCount: instance.status.RestartCount,
+			})
+		}
+		return nil
+	}
+
+	// 标记实例为已停止，monitorInstance据此记录为主动停止并且不再重启
 	instance.status.Running = false
 	instance.status.ExitTime = time.Now().Unix()
+	cmd, exit, timeout := instance.cmd, instance.exit, instance.stopTimeout
 	r.mu.Unlock()
 
-	// 停止进程
-	if instance.cmd != nil && instance.cmd.Process != nil {
-		// 首先尝试发送SIGTERM信号，让进程优雅退出
-		if err := instance.cmd.Process.Signal(syscall.SIGTERM); err != nil {
-			// 如果进程已经退出，忽略错误
-			if err.Error() != "os: process already finished" {
-				r.logger.Warn().Msgf("发送SIGTERM信号失败: %v", err)
-			}
-		}
-
-		// 等待进程退出，带超时
-		time.Sleep(time.Second)               // 等待1秒
-		if instance.cmd.ProcessState == nil { // 检查进程是否已退出
-			r.logger.Warn().Msgf("进程 %d 未在1秒内退出，将在30秒后强制终止", instance.cmd.Process.Pid)
-			time.Sleep(30 * time.Second)          // 等待30秒
-			if instance.cmd.ProcessState == nil { // 再次检查进程是否已退出
-				r.logger.Error().Msgf("进程 %d 未在30秒内退出，发送SIGKILL信号强制终止", instance.cmd.Process.Pid)
-				if err := instance.cmd.Process.Kill(); err != nil {
-					r.logger.Warn().Msgf("发送SIGKILL信号失败: %v", err)
-				}
-			}
+	pid := cmd.Process.Pid
+	// 进程已退出时不再发送信号，避免信号发给复用了该进程ID的其他进程
+	select {
+	case <-exit:
+		return nil
+	default:
+	}
+	if err := terminateProcess(cmd); err != nil {
+		// 无法通知进程优雅退出，等待宽限期没有意义
+		r.logger.Warn().Msgf("发送终止信号失败，强制结束进程组，instanceName=%s, pid=%d, Error=%v", name, pid, err)
+	} else {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-exit:
+			return nil
+		case <-timer.C:
 		}
+		r.logger.Error().Msgf("进程 %d 未在%s内退出，强制结束进程组，instanceName=%s", pid, timeout, name)
 	}
 
-	return nil
+	if err := killProcess(cmd); err != nil {
+		r.logger.Warn().Msgf("强制结束进程组失败，instanceName=%s, pid=%d, Error=%v", name, pid, err)
+	}
+	select {
+	case <-exit:
+		return nil
+	case <-time.After(stopKillWait):
+		return fmt.Errorf("强制结束后进程仍未退出，instanceName=%s, pid=%d", name, pid)
+	}
 }
 
 // GetStatus 获取实例状态
@@ -204,37 +361,57 @@ func (r *Runner) GetStatus() []types.InstanceStatus {
 	return status
 }
 
-// monitorInstance 监控实例状态
-func (r *Runner) monitorInstance(name string) {
-	r.mu.RLock()
-	instance := r.instances[name]
-	r.mu.RUnlock()
-
-	if instance == nil {
-		return
-	}
+// monitorInstance 监控实例进程，进程退出后按重启策略安排重启
+// exit在记录退出状态和发出事件之后关闭，StopInstance返回时退出事件已经发出
+func (r *Runner) monitorInstance(instance *Instance, cmd *exec.Cmd, exit chan struct{}) {
+	defer close(exit)
 
 	// 等待进程退出
-	err := instance.cmd.Wait()
+	err := cmd.Wait()
+
+	now := time.Now()
+	event := types.InstanceEvent{
+		Name: instance.Name,
+		Type: types.InstanceEventExited,
+		Time: now.Unix(),
+		Pid:  cmd.Process.Pid,
+	}
+	if err != nil {
+		event.ExitStatus = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			event.ExitStatus = exitErr.ExitCode()
+		}
+	}
 
 	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	// 再次检查实例是否存在，因为可能在等待过程中被删除
-	if instance, exists := r.instances[name]; exists {
-		instance.status.Running = false
-		instance.status.ExitTime = time.Now().Unix()
-		if err != nil {
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				instance.status.ExitStatus = exitErr.ExitCode()
-			} else {
-				instance.status.ExitStatus = -1
-			}
-		} else {
-			instance.status.ExitStatus = 0
+	// StopInstance在发送信号前已将Running置为false
+	if !instance.status.Running {
+		event.Type = types.InstanceEventStopped
+	}
+	instance.status.Running = false
+	instance.status.ExitTime = now.Unix()
+	instance.status.ExitStatus = event.ExitStatus
+	instance.exited = true
+	event.RestartCount = instance.status.RestartCount
+	// 结束所有日志订阅
+	for ch := range instance.followers {
+		delete(instance.followers, ch)
+		close(ch)
+	}
+	// 再次检查实例是否存在，因为可能在等待过程中被删除或替换
+	keep, crashLoop := false, false
+	if r.instances[instance.Name] == instance {
+		if event.Type == types.InstanceEventExited {
+			keep, crashLoop = r.scheduleRestart(instance, &event, now)
 		}
-		// 删除实例
-		delete(r.instances, name)
+		if !keep {
+			delete(r.instances, instance.Name)
+		}
+	}
+	r.mu.Unlock()
+	r.emit(event)
+	if crashLoop {
+		r.emit(crashLoopEvent(event))
 	}
 }
 
@@ -87,6 +87,11 @@ func (i *Installer) GetFRPBinaryPath(version string) string {
 
 // EnsureFRPInstalled 确保指定版本的FRP已安装
 func (i *Installer) EnsureFRPInstalled(version string) (string, error) {
+	return i.EnsureFRPInstalledProgress(version, nil)
+}
+
+// EnsureFRPInstalledProgress 确保指定版本的FRP已安装，需要下载时通过onProgress回调下载进度，onProgress可以为nil
+func (i *Installer) EnsureFRPInstalledProgress(version string, onProgress func(downloaded, total int64)) (string, error) {
 	// 已安装
 	frpPath, exists, err := i.IsFRPInstalled(version)
 	if err != nil {
@@ -110,7 +115,7 @@ func (i *Installer) EnsureFRPInstalled(version string) (string, error) {
 		url = strings.Join([]string{i.Proxy, url}, "/")
 	}
 
-	if err := i.downloadAndExtract(url, version); err != nil {
+	if err := i.downloadAndExtract(url, version, onProgress); err != nil {
 		return "", fmt.Errorf("下载并解压FRP失败: %v", err)
 	}
 
@@ -166,7 +171,7 @@ func (i *Installer) getSystemInfo() (osType, arch, ext string) {
 }
 
 // downloadAndExtract 下载并解压FRP
-func (i *Installer) downloadAndExtract(url, version string) error {
+func (i *Installer) downloadAndExtract(url, version string, onProgress func(downloaded, total int64)) error {
 	// 创建临时文件
 	tmpFile, err := os.CreateTemp("", "frp-*.tmp")
 	if err != nil {
@@ -213,6 +218,9 @@ func (i *Installer) downloadAndExtract(url, version string) error {
 			if downloaded >= total {
 				i.logger.Info().Msg("下载完成！")
 			}
+			if onProgress != nil {
+				onProgress(downloaded, total)
+			}
 		},
 	}
 
@@ -0,0 +1,46 @@
+package mqtt
+
+import (
+	"context"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+// Caller 控制端使用的行为调用接口，由*MQTT实现
+// 控制端只依赖该接口，可以替换为其他实现，测试中也可以使用假实现
+type Caller interface {
+	// Dispatch 发布任务并返回等待器，用完后应调用Release
+	Dispatch(action task.MessagePending) (*task.Waiter, error)
+	// Release 移除等待器
+	Release(waiter *task.Waiter)
+	// OpenStream 发布流式任务并返回数据流
+	OpenStream(action task.MessagePending) (*Stream, error)
+	// ReadStatus 读取被控端的保留状态
+	ReadStatus(ctx context.Context, clientId string) (*task.MessageStatus, error)
+	// KnowsPeerVersion 是否已知对端的协议版本
+	KnowsPeerVersion(peer string) bool
+	// Disconnect 断开连接
+	Disconnect() error
+}
+
+// Reporter 被控端使用的上报接口，由*MQTT实现
+// 行为的执行通过SubscribeAction注册，被控端运行期间只需要上报状态和历史记录
+type Reporter interface {
+	// Report 发布保留状态
+	Report(selfClientId string, status task.MessageStatus) error
+	// Record 写入历史记录，断线时暂存在发件箱中
+	Record(kind string, v interface{}) error
+	// IsConnected 是否已连接
+	IsConnected() bool
+	// ActiveBroker 当前连接的MQTT代理地址
+	ActiveBroker() string
+	// LastClockSkew 最近测得的时钟偏差
+	LastClockSkew() (ClockSkew, bool)
+	// Disconnect 断开连接
+	Disconnect() error
+}
+
+var (
+	_ Caller   = (*MQTT)(nil)
+	_ Reporter = (*MQTT)(nil)
+)
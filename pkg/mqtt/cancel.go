@@ -0,0 +1,94 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+	"github.com/shellus/frp-daemon/pkg/types"
+)
+
+// cancelExpiration 取消请求的有效期，接收方离线太久时取消已无意义
+const cancelExpiration = time.Minute
+
+// 取消请求到达时任务所处的状态
+const (
+	// CancelQueued 任务还在排队，已从队列中移除，处理器不会执行
+	CancelQueued = "queued"
+	// CancelRunning 处理器正在执行，已通过ctx请求取消，处理器可能不响应取消并正常完成，最终结果以任务的回复为准
+	CancelRunning = "running"
+	// CancelScheduled 定时任务尚未执行或cron任务等待下一次执行，已从定时任务中移除
+	CancelScheduled = "scheduled"
+	// CancelFinished 任务已执行完成，取消来得太晚
+	CancelFinished = "finished"
+	// CancelNotFound 没有找到该发送方的这个任务，可能尚未送达或已过期
+	CancelNotFound = "not_found"
+)
+
+// CancelResult 取消请求的处理结果
+type CancelResult struct {
+	// Canceled 任务是否确定不会执行，只有State为CancelQueued或CancelScheduled（任务已被移除）时为true
+	// 正在执行的任务只是收到了取消请求，Canceled为false
+	Canceled bool `json:"canceled"`
+	// State 取消请求到达时任务所处的状态，旧版本接收方不返回该字段
+	State string `json:"state,omitempty"`
+}
+
+// Cancel 请求接收方取消指定任务，只发布取消请求，不等待结果
+func (m *MQTT) Cancel(receiver, msgId string) error {
+	return m.action(NewCancelMessage(m.config.Username, receiver, msgId, time.Now().Add(cancelExpiration)))
+}
+
+// NewCancelMessage 创建取消任务的请求，exp一般与原任务的过期时间相同，原任务还在代理暂存时取消请求也不会先过期
+func NewCancelMessage(sender, receiver, msgId string, exp time.Time) task.MessagePending {
+	payload, _ := json.Marshal(task.MessageCancel{MsgId: msgId})
+	return task.MessagePending{
+		MsgId:    types.GenerateRandomString(16),
+		Sender:   sender,
+		Receiver: receiver,
+		Action:   task.ActionCancel,
+		Exp:      exp.Unix(),
+		Payload:  payload,
+	}
+}
+
+// handleCancel 处理内置的取消动作，取消请求的发送方必须是原任务的发送方
+// 排队中的任务直接移除，并以CodeCanceled回复原任务；正在执行的任务通过ctx通知处理器；定时任务从定时任务存储中移除
+func (m *MQTT) handleCancel(msg task.MessagePending) {
+	m.ack(msg)
+	var cancelMsg task.MessageCancel
+	if err := json.Unmarshal(msg.Payload, &cancelMsg); err != nil {
+		m.replyFailed(msg, task.NewRemoteError(task.CodeInvalidPayload, err.Error()))
+		return
+	}
+
+	var result CancelResult
+	// 定时任务的去重缓存记录的是保存结果，要先于去重缓存检查
+	removed, err := m.scheduler.remove(cancelMsg.MsgId, msg.Sender)
+	if err != nil {
+		m.logger.Error().Msgf("保存定时任务失败，messageId=%s, Err=%v", cancelMsg.MsgId, err)
+	}
+	j, state := m.dispatcher.cancel(cancelMsg.MsgId, msg.Sender)
+	switch state {
+	case CancelQueued:
+		m.finishJob(j, nil, task.NewRemoteError(task.CodeCanceled, "任务在执行前被取消"))
+	case CancelNotFound:
+		if removed {
+			state = CancelScheduled
+		} else if m.dedup != nil {
+			if _, ok := m.dedup.get(msg.Sender, cancelMsg.MsgId); ok {
+				state = CancelFinished
+			}
+		}
+	}
+	result.State = state
+	result.Canceled = state == CancelQueued || state == CancelScheduled
+	m.logger.Info().Msgf("处理取消请求，messageId=%s, sender=%s, state=%s", cancelMsg.MsgId, msg.Sender, state)
+
+	value, err := json.Marshal(result)
+	if err != nil {
+		m.replyFailed(msg, err)
+		return
+	}
+	m.reply(msg, value, nil)
+}
@@ -0,0 +1,262 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxPacketSize 单个MQTT消息的默认最大长度，超过后分片发送
+	DefaultMaxPacketSize = 128 * 1024
+	// minMaxPacketSize 允许配置的最小分片长度
+	minMaxPacketSize = 4 * 1024
+	// chunkReserved 为分片头部和MQTT报文头预留的长度
+	chunkReserved = 1024
+	// maxAssembledSize 重组后消息的最大长度，声明超过该长度的分片帧直接丢弃
+	maxAssembledSize = 64 * 1024 * 1024
+	// minChunkSize 发送端最小的分片数据长度，据此校验声明的分片总数
+	minChunkSize = minMaxPacketSize - chunkReserved
+	// maxChunks 一个分片组最多的分片数
+	maxChunks = maxAssembledSize/minChunkSize + 1
+	// maxChunkGroupsPerTopic 同一主题同时重组的分片组上限，超过时丢弃最早的分片组
+	maxChunkGroupsPerTopic = 8
+	// maxBufferedSize 所有正在重组的分片组缓存的数据总长度上限
+	// 分片帧在验签之前解析，这些上限保证伪造的分片不会耗尽内存
+	maxBufferedSize = 2 * maxAssembledSize
+	// chunkAssembleTimeout 分片重组超时时间，超过后丢弃已收到的分片
+	chunkAssembleTimeout = 2 * time.Minute
+)
+
+// chunkMagic 分片帧的前缀，JSON消息不会以0字节开头，收到的消息据此区分是否为分片
+var chunkMagic = []byte("\x00FDCHUNK1")
+
+// chunkHeader 分片帧头部
+type chunkHeader struct {
+	Id    string `json:"id"`    // 分片组ID，同一消息的所有分片相同
+	Seq   int    `json:"seq"`   // 分片序号，从0开始
+	Total int    `json:"total"` // 分片总数
+	Size  int    `json:"size"`  // 完整消息长度
+	Sum   string `json:"sum"`   // 完整消息的sha256，十六进制
+	Crc   uint32 `json:"crc"`   // 本分片数据的crc32
+}
+
+// splitChunks 将消息切分为分片帧，每帧长度不超过maxPacketSize
+func splitChunks(payload []byte, maxPacketSize int) ([][]byte, error) {
+	chunkSize := maxPacketSize - chunkReserved
+	total := (len(payload) + chunkSize - 1) / chunkSize
+	var idBytes [8]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(payload)
+	header := chunkHeader{
+		Id:    hex.EncodeToString(idBytes[:]),
+		Total: total,
+		Size:  len(payload),
+		Sum:   hex.EncodeToString(sum[:]),
+	}
+	frames := make([][]byte, 0, total)
+	for seq := 0; seq < total; seq++ {
+		end := (seq + 1) * chunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		data := payload[seq*chunkSize : end]
+		header.Seq = seq
+		header.Crc = crc32.ChecksumIEEE(data)
+		headerJSON, err := json.Marshal(header)
+		if err != nil {
+			return nil, err
+		}
+		// 帧格式：magic + 4字节头部长度 + 头部JSON + 分片数据
+		frame := make([]byte, 0, len(chunkMagic)+4+len(headerJSON)+len(data))
+		frame = append(frame, chunkMagic...)
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(headerJSON)))
+		frame = append(frame, headerJSON...)
+		frame = append(frame, data...)
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// parseChunk 解析分片帧，不是分片帧时ok为false
+func parseChunk(frame []byte) (header chunkHeader, data []byte, ok bool, err error) {
+	if !bytes.HasPrefix(frame, chunkMagic) {
+		return header, nil, false, nil
+	}
+	rest := frame[len(chunkMagic):]
+	if len(rest) < 4 {
+		return header, nil, true, errors.New("分片帧长度不足")
+	}
+	n := int(binary.BigEndian.Uint32(rest))
+	rest = rest[4:]
+	if n > len(rest) {
+		return header, nil, true, errors.New("分片帧头部长度错误")
+	}
+	if err := json.Unmarshal(rest[:n], &header); err != nil {
+		return header, nil, true, fmt.Errorf("解析分片帧头部失败: %v", err)
+	}
+	data = rest[n:]
+	if crc32.ChecksumIEEE(data) != header.Crc {
+		return header, nil, true, fmt.Errorf("分片校验失败，id=%s, seq=%d", header.Id, header.Seq)
+	}
+	if header.Size < 0 || header.Size > maxAssembledSize ||
+		header.Total <= 0 || header.Total > maxChunks || header.Total > header.Size/minChunkSize+1 ||
+		header.Seq < 0 || header.Seq >= header.Total {
+		return header, nil, true, fmt.Errorf("分片帧头部无效，id=%s, seq=%d, total=%d, size=%d", header.Id, header.Seq, header.Total, header.Size)
+	}
+	return header, data, true, nil
+}
+
+// chunkBuffer 正在重组的消息
+type chunkBuffer struct {
+	topic    string
+	header   chunkHeader
+	parts    [][]byte
+	received int
+	length   int
+	deadline time.Time
+}
+
+// chunkAssembler 分片重组器，按主题和分片组ID缓存已收到的分片
+type chunkAssembler struct {
+	mu      sync.Mutex
+	buffers map[string]*chunkBuffer
+	// buffered 所有分片组已缓存的数据长度
+	buffered int
+}
+
+func newChunkAssembler() *chunkAssembler {
+	return &chunkAssembler{
+		buffers: make(map[string]*chunkBuffer),
+	}
+}
+
+// add 加入一个分片，所有分片到齐并校验通过后返回完整消息
+// QoS 1可能重复投递同一分片，重复的分片会被忽略
+func (a *chunkAssembler) add(topic string, header chunkHeader, data []byte) ([]byte, error) {
+	key := topic + "\x00" + header.Id
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	buf, ok := a.buffers[key]
+	if !ok {
+		a.evictOldest(topic)
+		buf = &chunkBuffer{
+			topic:    topic,
+			header:   header,
+			parts:    make([][]byte, header.Total),
+			deadline: time.Now().Add(chunkAssembleTimeout),
+		}
+		a.buffers[key] = buf
+	}
+	if header.Total != buf.header.Total || header.Size != buf.header.Size || header.Sum != buf.header.Sum {
+		a.drop(key)
+		return nil, fmt.Errorf("同一分片组的头部不一致，id=%s", header.Id)
+	}
+	if buf.parts[header.Seq] != nil {
+		return nil, nil
+	}
+	if buf.length+len(data) > header.Size {
+		a.drop(key)
+		return nil, fmt.Errorf("分片数据超过声明的长度，id=%s", header.Id)
+	}
+	if a.buffered+len(data) > maxBufferedSize {
+		a.drop(key)
+		return nil, fmt.Errorf("正在重组的分片总长度超过上限，丢弃分片组，id=%s", header.Id)
+	}
+	// paho会复用消息缓冲区，这里必须拷贝
+	buf.parts[header.Seq] = append([]byte{}, data...)
+	buf.received++
+	buf.length += len(data)
+	a.buffered += len(data)
+	if buf.received < header.Total {
+		return nil, nil
+	}
+	a.drop(key)
+
+	payload := make([]byte, 0, header.Size)
+	for _, part := range buf.parts {
+		payload = append(payload, part...)
+	}
+	sum := sha256.Sum256(payload)
+	if len(payload) != header.Size || hex.EncodeToString(sum[:]) != header.Sum {
+		return nil, fmt.Errorf("重组后的消息校验失败，id=%s", header.Id)
+	}
+	return payload, nil
+}
+
+// sweep 丢弃超时未到齐的分片组，返回丢弃的数量
+func (a *chunkAssembler) sweep(now time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := 0
+	for key, buf := range a.buffers {
+		if now.After(buf.deadline) {
+			a.drop(key)
+			n++
+		}
+	}
+	return n
+}
+
+// evictOldest 同一主题正在重组的分片组达到上限时丢弃最早的一个，调用方需持有锁
+func (a *chunkAssembler) evictOldest(topic string) {
+	count := 0
+	var oldestKey string
+	var oldest *chunkBuffer
+	for key, buf := range a.buffers {
+		if buf.topic != topic {
+			continue
+		}
+		count++
+		if oldest == nil || buf.deadline.Before(oldest.deadline) {
+			oldestKey, oldest = key, buf
+		}
+	}
+	if count >= maxChunkGroupsPerTopic {
+		a.drop(oldestKey)
+	}
+}
+
+// drop 移除分片组并扣减缓存长度，调用方需持有锁
+func (a *chunkAssembler) drop(key string) {
+	if buf, ok := a.buffers[key]; ok {
+		a.buffered -= buf.length
+		delete(a.buffers, key)
+	}
+}
+
+// reassemble 包装订阅回调，分片帧先交给重组器，完整消息到齐后再调用原回调，非分片消息直接透传
+func (m *MQTT) reassemble(callback TransportHandler) TransportHandler {
+	return func(msg Message) {
+		header, data, ok, err := parseChunk(msg.Payload)
+		if !ok {
+			callback(msg)
+			return
+		}
+		if err != nil {
+			m.logger.Error().Msgf("丢弃分片: topic=%s, err=%v", msg.Topic, err)
+			return
+		}
+		payload, err := m.chunks.add(msg.Topic, header, data)
+		if err != nil {
+			m.logger.Error().Msgf("分片重组失败: topic=%s, err=%v", msg.Topic, err)
+			return
+		}
+		if payload == nil {
+			return
+		}
+		m.logger.Debug().Msgf("分片重组完成，topic=%s, id=%s, total=%d, size=%d", msg.Topic, header.Id, header.Total, header.Size)
+		msg.Payload = payload
+		callback(msg)
+	}
+}
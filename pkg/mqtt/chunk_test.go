@@ -0,0 +1,164 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"testing"
+	"time"
+)
+
+// buildFrame 按指定头部构造分片帧，用于构造恶意或异常的帧
+func buildFrame(t *testing.T, header chunkHeader, data []byte) []byte {
+	t.Helper()
+	header.Crc = crc32.ChecksumIEEE(data)
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := append([]byte{}, chunkMagic...)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(headerJSON)))
+	frame = append(frame, headerJSON...)
+	return append(frame, data...)
+}
+
+func TestSplitAndReassemble(t *testing.T) {
+	tests := []struct {
+		name          string
+		size          int
+		maxPacketSize int
+	}{
+		{"单个分片", 100, minMaxPacketSize},
+		{"刚好整除", 3 * (minMaxPacketSize - chunkReserved), minMaxPacketSize},
+		{"多个分片", 1 << 20, minMaxPacketSize},
+		{"默认长度", 1 << 20, DefaultMaxPacketSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := make([]byte, tt.size)
+			if _, err := rand.Read(payload); err != nil {
+				t.Fatal(err)
+			}
+			frames, err := splitChunks(payload, tt.maxPacketSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := newChunkAssembler()
+			var got []byte
+			// 倒序投递并重复投递第一帧，重组不依赖顺序，重复分片被忽略
+			for i := len(frames) - 1; i >= 0; i-- {
+				if len(frames[i]) > tt.maxPacketSize {
+					t.Fatalf("分片帧长度超过限制，len=%d", len(frames[i]))
+				}
+				header, data, ok, err := parseChunk(frames[i])
+				if !ok || err != nil {
+					t.Fatalf("解析分片帧失败，ok=%v, err=%v", ok, err)
+				}
+				if i == len(frames)-1 && len(frames) > 1 {
+					if out, err := a.add("t", header, data); out != nil || err != nil {
+						t.Fatalf("重复分片不应完成重组，err=%v", err)
+					}
+				}
+				out, err := a.add("t", header, data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if out != nil {
+					got = out
+				}
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("重组结果不一致，len=%d, want=%d", len(got), len(payload))
+			}
+			if a.buffered != 0 || len(a.buffers) != 0 {
+				t.Fatalf("重组完成后仍有缓存，buffered=%d, groups=%d", a.buffered, len(a.buffers))
+			}
+		})
+	}
+}
+
+func TestParseChunkBounds(t *testing.T) {
+	tests := []struct {
+		name   string
+		header chunkHeader
+		valid  bool
+	}{
+		{"正常", chunkHeader{Id: "a", Seq: 0, Total: 2, Size: minChunkSize + 1}, true},
+		{"最大分片数", chunkHeader{Id: "a", Seq: 0, Total: maxAssembledSize/minChunkSize + 1, Size: maxAssembledSize}, true},
+		{"分片总数过大", chunkHeader{Id: "a", Seq: 0, Total: 1 << 40, Size: maxAssembledSize}, false},
+		{"分片总数与长度不符", chunkHeader{Id: "a", Seq: 0, Total: 3, Size: minChunkSize}, false},
+		{"分片总数为0", chunkHeader{Id: "a", Seq: 0, Total: 0, Size: 10}, false},
+		{"序号越界", chunkHeader{Id: "a", Seq: 2, Total: 2, Size: minChunkSize + 1}, false},
+		{"序号为负", chunkHeader{Id: "a", Seq: -1, Total: 2, Size: minChunkSize + 1}, false},
+		{"长度过大", chunkHeader{Id: "a", Seq: 0, Total: 1, Size: maxAssembledSize + 1}, false},
+		{"长度为负", chunkHeader{Id: "a", Seq: 0, Total: 1, Size: -1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, ok, err := parseChunk(buildFrame(t, tt.header, []byte("x")))
+			if !ok {
+				t.Fatal("分片帧未被识别")
+			}
+			if (err == nil) != tt.valid {
+				t.Fatalf("valid=%v, err=%v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestParseChunkNotChunk(t *testing.T) {
+	if _, _, ok, _ := parseChunk([]byte(`{"msg_id":"a"}`)); ok {
+		t.Fatal("JSON消息被识别为分片帧")
+	}
+	frame := buildFrame(t, chunkHeader{Id: "a", Total: 1, Size: 1}, []byte("x"))
+	frame[len(frame)-1] = 'y'
+	if _, _, ok, err := parseChunk(frame); !ok || err == nil {
+		t.Fatalf("crc错误的分片帧应被拒绝，ok=%v, err=%v", ok, err)
+	}
+}
+
+func TestChunkAssemblerGroupLimit(t *testing.T) {
+	a := newChunkAssembler()
+	header := func(id string) chunkHeader {
+		return chunkHeader{Id: id, Seq: 0, Total: 2, Size: 2, Sum: "x"}
+	}
+	for i := 0; i < maxChunkGroupsPerTopic+5; i++ {
+		if _, err := a.add("t1", header(fmt.Sprint(i)), []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.add("t2", header("other"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	count := map[string]int{}
+	for _, buf := range a.buffers {
+		count[buf.topic]++
+	}
+	if count["t1"] != maxChunkGroupsPerTopic || count["t2"] != 1 {
+		t.Fatalf("同一主题的分片组数量没有受限，count=%v", count)
+	}
+	if a.buffered != maxChunkGroupsPerTopic+1 {
+		t.Fatalf("缓存长度统计错误，buffered=%d", a.buffered)
+	}
+	if n := a.sweep(time.Now().Add(chunkAssembleTimeout + time.Second)); n != maxChunkGroupsPerTopic+1 {
+		t.Fatalf("超时清理数量错误，n=%d", n)
+	}
+	if a.buffered != 0 {
+		t.Fatalf("清理后缓存长度应为0，buffered=%d", a.buffered)
+	}
+}
+
+func TestChunkAssemblerBufferedLimit(t *testing.T) {
+	a := newChunkAssembler()
+	a.buffered = maxBufferedSize
+	_, err := a.add("t", chunkHeader{Id: "a", Seq: 0, Total: 2, Size: 2, Sum: "x"}, []byte("a"))
+	if err == nil {
+		t.Fatal("超过缓存上限时应拒绝分片")
+	}
+	if len(a.buffers) != 0 {
+		t.Fatal("被拒绝的分片组应被丢弃")
+	}
+}
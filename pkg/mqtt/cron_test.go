@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	tests := []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/a * * * *",
+		"5-1 * * * *",
+		"1-a * * * *",
+		"a * * * *",
+		"1,,2 * * * *",
+	}
+	for _, expr := range tests {
+		t.Run(expr, func(t *testing.T) {
+			if _, err := parseCron(expr); err == nil {
+				t.Fatalf("无效的cron表达式没有被拒绝，cron=%s", expr)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2024-01-01是周一
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2024, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"每分钟", "* * * * *", at(1, 1, 0, 0), at(1, 1, 0, 1)},
+		{"不含当前分钟", "0 12 * * *", at(1, 1, 12, 0).Add(30 * time.Second), at(1, 2, 12, 0)},
+		{"步长", "*/15 * * * *", at(1, 1, 0, 0), at(1, 1, 0, 15)},
+		{"起点加步长", "5/20 * * * *", at(1, 1, 0, 5), at(1, 1, 0, 25)},
+		{"列表", "10,40 * * * *", at(1, 1, 0, 10), at(1, 1, 0, 40)},
+		{"每天", "30 2 * * *", at(1, 1, 3, 0), at(1, 2, 2, 30)},
+		{"每月1日", "0 0 1 * *", at(1, 1, 0, 0), at(2, 1, 0, 0)},
+		{"跨年", "0 0 1 1 *", at(6, 1, 0, 0), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"工作日", "0 9 * * 1-5", at(1, 5, 10, 0), at(1, 8, 9, 0)},
+		{"周日为0", "0 0 * * 0", at(1, 1, 0, 0), at(1, 7, 0, 0)},
+		{"周日为7", "0 0 * * 7", at(1, 1, 0, 0), at(1, 7, 0, 0)},
+		{"日和周满足其一", "0 0 13 * 5", at(1, 1, 0, 0), at(1, 5, 0, 0)},
+		{"闰日", "0 0 29 2 *", at(3, 1, 0, 0), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"不会触发", "0 0 30 2 *", at(1, 1, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.next(tt.from); !got.Equal(tt.want) {
+				t.Fatalf("cron=%s, from=%s, got=%s, want=%s", tt.expr, tt.from, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+// DefaultDedupCapacity 去重缓存默认保留的任务数量
+const DefaultDedupCapacity = 256
+
+// messageKey 按发送方区分的任务键，不同发送方可能使用相同的消息ID
+// 发送方ID是主题中的一段，不会包含"/"
+func messageKey(sender, messageId string) string {
+	return sender + "/" + messageId
+}
+
+// dedupEntry 已处理任务的结果
+// 旧版本缓存中的记录没有Sender和Action，不会再被命中，按过期时间自然淘汰
+type dedupEntry struct {
+	MessageId  string `json:"message_id"`
+	Sender     string `json:"sender,omitempty"`
+	Action     string `json:"action,omitempty"`
+	Expiration int64  `json:"expiration"`  // 任务过期时间，超过过期时间和时钟偏差容忍之后的重复投递会被直接丢弃，无需再缓存
+	Value      []byte `json:"value"`       // 处理器返回值
+	Error      string `json:"error"`       // 处理器返回的错误，为空表示成功
+	HandleTime int64  `json:"handle_time"` // 处理时间
+	// Code和Details是错误信封的其余字段，旧版本缓存中没有，按task.CodeInternal处理
+	Code    string          `json:"code,omitempty"`
+	Details json.RawMessage `json:"details,omitempty"`
+}
+
+func (e dedupEntry) key() string {
+	return messageKey(e.Sender, e.MessageId)
+}
+
+// remoteError 还原处理器返回的错误信封
+func (e dedupEntry) remoteError() *task.RemoteError {
+	code := e.Code
+	if code == "" {
+		code = task.CodeInternal
+	}
+	return &task.RemoteError{Code: code, Message: e.Error, Details: e.Details}
+}
+
+// DedupCache 接收方已处理任务的结果缓存，按处理顺序淘汰并持久化到磁盘
+// QoS 1是至少一次投递，重复投递的任务不再执行处理器，而是重发缓存的结果
+type DedupCache struct {
+	path     string
+	capacity int
+	mu       sync.Mutex
+	entries  []dedupEntry   // 按处理时间先后排列
+	index    map[string]int // 键为messageKey
+	// pending 已收到、尚未记录结果的任务，键为messageKey，值为动作，只保存在内存中
+	pending map[string]string
+	// tolerance 时钟偏差容忍，接收方在过期时间之后的tolerance内仍会执行任务，记录需要保留到那时
+	tolerance time.Duration
+}
+
+// NewDedupCache 创建去重缓存并从path加载已有记录，path为空时只缓存在内存中
+func NewDedupCache(path string, capacity int) (*DedupCache, error) {
+	if capacity <= 0 {
+		return nil, errors.New("dedup capacity must be positive")
+	}
+	d := &DedupCache{
+		path:     path,
+		capacity: capacity,
+		index:    make(map[string]int),
+		pending:  make(map[string]string),
+	}
+	if path == "" {
+		return d, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return d, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &d.entries); err != nil {
+		return nil, err
+	}
+	// 此时还不知道时钟偏差容忍，过期记录在设置容忍或写入新记录时移除
+	d.limit()
+	return d, nil
+}
+
+// setTolerance 设置时钟偏差容忍并移除超过容忍的过期记录
+func (d *DedupCache) setTolerance(tolerance time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tolerance = tolerance
+	d.prune(time.Now())
+}
+
+// begin 的查找结果
+const (
+	dedupNew      = iota // 首次收到，已记录处理中标记
+	dedupPending         // 同一任务已在处理中
+	dedupDone            // 已处理过，返回缓存的结果
+	dedupConflict        // 同一发送方的消息ID已被其他动作使用
+)
+
+// begin 查找任务的处理记录，首次收到时记录处理中标记，之后由put或abort移除
+// 查找和标记在同一把锁内完成，任务排队或执行期间到达的重复投递不会再次执行
+func (d *DedupCache) begin(msg task.MessagePending) (dedupEntry, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := messageKey(msg.Sender, msg.MsgId)
+	if i, ok := d.index[key]; ok {
+		entry := d.entries[i]
+		if entry.Action != msg.Action {
+			return entry, dedupConflict
+		}
+		return entry, dedupDone
+	}
+	if action, ok := d.pending[key]; ok {
+		if action != msg.Action {
+			return dedupEntry{}, dedupConflict
+		}
+		return dedupEntry{}, dedupPending
+	}
+	d.pending[key] = msg.Action
+	return dedupEntry{}, dedupNew
+}
+
+// abort 移除处理中标记，任务没有被执行也没有记录结果，之后的重复投递可以重新执行
+func (d *DedupCache) abort(msg task.MessagePending) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.pending, messageKey(msg.Sender, msg.MsgId))
+}
+
+// get 查找已处理任务的结果
+func (d *DedupCache) get(sender, messageId string) (dedupEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i, ok := d.index[messageKey(sender, messageId)]
+	if !ok {
+		return dedupEntry{}, false
+	}
+	return d.entries[i], true
+}
+
+// put 记录任务结果并持久化，同时移除处理中标记
+func (d *DedupCache) put(entry dedupEntry) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.pending, entry.key())
+	if i, ok := d.index[entry.key()]; ok {
+		d.entries[i] = entry
+	} else {
+		d.entries = append(d.entries, entry)
+	}
+	d.prune(time.Now())
+	return d.save()
+}
+
+// prune 移除过期时间加上时钟偏差容忍之后仍已过期的记录，这些任务的重复投递会被当作过期丢弃，调用方需持有锁
+func (d *DedupCache) prune(now time.Time) {
+	kept := d.entries[:0]
+	for _, e := range d.entries {
+		if !now.After(time.Unix(e.Expiration, 0).Add(d.tolerance)) {
+			kept = append(kept, e)
+		}
+	}
+	d.entries = kept
+	d.limit()
+}
+
+// limit 将数量限制在容量以内，然后重建索引，调用方需持有锁
+func (d *DedupCache) limit() {
+	if len(d.entries) > d.capacity {
+		d.entries = d.entries[len(d.entries)-d.capacity:]
+	}
+	d.index = make(map[string]int, len(d.entries))
+	for i, e := range d.entries {
+		d.index[e.key()] = i
+	}
+}
+
+// save 先写临时文件再重命名，避免写入中途退出损坏缓存文件，调用方需持有锁
+func (d *DedupCache) save() error {
+	if d.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(d.entries)
+	if err != nil {
+		return err
+	}
+	tmp := d.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
+}
@@ -0,0 +1,160 @@
+package mqtt
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+func TestDedupCacheRetention(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		exp       time.Time
+		tolerance time.Duration
+		kept      bool
+	}{
+		{"未过期", now.Add(time.Minute), 0, true},
+		{"已过期且不容忍偏差", now.Add(-time.Second), 0, false},
+		{"过期但在容忍范围内", now.Add(-10 * time.Second), 30 * time.Second, true},
+		{"超过容忍范围", now.Add(-time.Minute), 30 * time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDedupCache("", DefaultDedupCapacity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.setTolerance(tt.tolerance)
+			if err := d.put(dedupEntry{MessageId: "a", Sender: "ctl", Expiration: tt.exp.Unix()}); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := d.get("ctl", "a"); ok != tt.kept {
+				t.Fatalf("kept=%v, want=%v", ok, tt.kept)
+			}
+		})
+	}
+}
+
+func TestDedupCacheExpiredMatchesRetention(t *testing.T) {
+	// 接收方仍会执行的任务，去重缓存必须还保留着它的结果
+	m := &MQTT{skewTolerance: 30 * time.Second}
+	d, err := NewDedupCache("", DefaultDedupCapacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetDedupCache(d)
+	now := time.Now()
+	for _, offset := range []time.Duration{-29 * time.Second, -10 * time.Second, 0, time.Minute} {
+		exp := now.Add(offset).Unix()
+		msg := task.MessagePending{MsgId: offset.String(), Exp: exp}
+		if m.expired(msg, now) {
+			continue
+		}
+		if err := d.put(dedupEntry{MessageId: msg.MsgId, Sender: "ctl", Expiration: exp}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := d.get("ctl", msg.MsgId); !ok {
+			t.Fatalf("未过期的任务没有保留去重记录，offset=%s", offset)
+		}
+	}
+}
+
+func TestDedupCacheCapacityAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.json")
+	d, err := NewDedupCache(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	for _, id := range []string{"a", "b", "c"} {
+		if err := d.put(dedupEntry{MessageId: id, Sender: "ctl", Expiration: exp, Value: []byte(id)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reloaded, err := NewDedupCache(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]bool{"a": false, "b": true, "c": true} {
+		if _, ok := reloaded.get("ctl", id); ok != want {
+			t.Fatalf("id=%s, kept=%v, want=%v", id, ok, want)
+		}
+	}
+}
+
+func TestDedupCacheBegin(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	pending := func(sender, id, action string) task.MessagePending {
+		return task.MessagePending{MsgId: id, Sender: sender, Action: action, Exp: exp}
+	}
+	tests := []struct {
+		name  string
+		setup func(d *DedupCache)
+		msg   task.MessagePending
+		state int
+	}{
+		{"首次收到", func(d *DedupCache) {}, pending("ctl", "a", "update"), dedupNew},
+		{"正在处理", func(d *DedupCache) { d.begin(pending("ctl", "a", "update")) }, pending("ctl", "a", "update"), dedupPending},
+		{"处理中被其他动作使用", func(d *DedupCache) { d.begin(pending("ctl", "a", "update")) }, pending("ctl", "a", "wol"), dedupConflict},
+		{"放弃后重新执行", func(d *DedupCache) {
+			d.begin(pending("ctl", "a", "update"))
+			d.abort(pending("ctl", "a", "update"))
+		}, pending("ctl", "a", "update"), dedupNew},
+		{"已处理", func(d *DedupCache) {
+			d.begin(pending("ctl", "a", "update"))
+			d.put(dedupEntry{MessageId: "a", Sender: "ctl", Action: "update", Expiration: exp})
+		}, pending("ctl", "a", "update"), dedupDone},
+		{"已处理的ID被其他动作使用", func(d *DedupCache) {
+			d.put(dedupEntry{MessageId: "a", Sender: "ctl", Action: "update", Expiration: exp})
+		}, pending("ctl", "a", "wol"), dedupConflict},
+		{"其他发送方的相同ID", func(d *DedupCache) {
+			d.begin(pending("ctl", "a", "update"))
+			d.put(dedupEntry{MessageId: "b", Sender: "ctl", Action: "update", Expiration: exp})
+		}, pending("other", "a", "update"), dedupNew},
+		{"旧版本缓存记录不再命中", func(d *DedupCache) {
+			d.put(dedupEntry{MessageId: "a", Expiration: exp})
+		}, pending("ctl", "a", "update"), dedupNew},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDedupCache("", DefaultDedupCapacity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.setup(d)
+			if _, state := d.begin(tt.msg); state != tt.state {
+				t.Fatalf("state=%d, want=%d", state, tt.state)
+			}
+		})
+	}
+}
+
+func TestDedupCacheBeginConcurrent(t *testing.T) {
+	d, err := NewDedupCache("", DefaultDedupCapacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := task.MessagePending{MsgId: "a", Sender: "ctl", Action: "wol"}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	started := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, state := d.begin(msg); state == dedupNew {
+				mu.Lock()
+				started++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if started != 1 {
+		t.Fatalf("并发到达的重复投递只应执行一次，started=%d", started)
+	}
+}
@@ -0,0 +1,222 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+const (
+	// DefaultWorkers 默认同时执行的任务数
+	DefaultWorkers = 4
+	// DefaultQueueSize 默认排队等待执行的任务数上限
+	DefaultQueueSize = 256
+	// DefaultStreams 默认同时执行的流式任务数
+	DefaultStreams = 4
+)
+
+// ErrQueueFull 排队的任务数已达上限
+var ErrQueueFull = errors.New("任务队列已满")
+
+// OrderKeyFunc 从任务负载中提取顺序键，顺序键相同的任务按到达顺序逐个执行，返回空字符串表示不限制顺序
+// 例如update和delete都返回实例名称，对同一实例的两次更新不会交错执行
+type OrderKeyFunc func(action string, payload []byte) string
+
+// DispatcherOptions 任务调度配置
+type DispatcherOptions struct {
+	// Workers 同时执行的任务数，为0时使用DefaultWorkers
+	Workers int
+	// QueueSize 排队等待执行的任务数上限，为0时使用DefaultQueueSize
+	QueueSize int
+	// ActionLimits 每个动作同时执行的任务数上限，未配置的动作只受Workers或Streams限制
+	ActionLimits map[string]int
+	// Streams 同时执行的流式任务数，为0时使用DefaultStreams
+	// 流式任务（例如跟随日志）可能持续很久，不占用Workers，避免几个长时间的流把普通任务挡在队列里
+	Streams int
+}
+
+// job 等待执行的任务，ctx在提交时创建，取消请求通过它通知处理器
+type job struct {
+	msg      task.MessagePending
+	callback MessageHandler
+	key      string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	// done 不为nil时代替回复发送方接收执行结果，用于定时任务
+	done func(value []byte, err error)
+}
+
+// dispatcher 任务调度器，处理器不在paho的消息回调中执行，慢任务不会阻塞其他消息的接收
+// 调度时按到达顺序选出第一个可执行的任务：总并发未满、该动作并发未满、同顺序键没有正在执行或排在前面的任务
+type dispatcher struct {
+	mu      sync.Mutex
+	opts    DispatcherOptions
+	run     func(job)
+	queue   []job
+	running int
+	// streams 正在执行的流式任务数，不计入running
+	streams       int
+	actionRunning map[string]int
+	keyBusy       map[string]bool
+	// inflight 已排队或正在执行的任务，键为messageKey，重复投递的任务在执行完成前直接忽略
+	inflight map[string]job
+	closed   bool
+}
+
+func newDispatcher(opts DispatcherOptions, run func(job)) *dispatcher {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.Streams <= 0 {
+		opts.Streams = DefaultStreams
+	}
+	return &dispatcher{
+		opts:          opts,
+		run:           run,
+		actionRunning: make(map[string]int),
+		keyBusy:       make(map[string]bool),
+		inflight:      make(map[string]job),
+	}
+}
+
+// submit 提交任务，任务已在队列中或正在执行时返回false
+func (d *dispatcher) submit(j job) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return false, errors.New("任务调度器已关闭")
+	}
+	key := messageKey(j.msg.Sender, j.msg.MsgId)
+	if _, ok := d.inflight[key]; ok {
+		return false, nil
+	}
+	if len(d.queue) >= d.opts.QueueSize {
+		return false, fmt.Errorf("%w，queueSize=%d", ErrQueueFull, d.opts.QueueSize)
+	}
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	d.inflight[key] = j
+	d.queue = append(d.queue, j)
+	d.schedule()
+	return true, nil
+}
+
+// schedule 启动所有可执行的任务，调用方需持有锁
+func (d *dispatcher) schedule() {
+	// blocked 本轮被跳过的任务的顺序键，排在它们后面的同键任务也不能执行
+	blocked := make(map[string]bool)
+	kept := d.queue[:0]
+	for _, j := range d.queue {
+		if !d.hasSlot(j) || !d.runnable(j, blocked) {
+			if j.key != "" {
+				blocked[j.key] = true
+			}
+			kept = append(kept, j)
+			continue
+		}
+		if j.msg.Stream {
+			d.streams++
+		} else {
+			d.running++
+		}
+		d.actionRunning[j.msg.Action]++
+		if j.key != "" {
+			d.keyBusy[j.key] = true
+		}
+		go d.execute(j)
+	}
+	// 清空尾部引用，避免已出队的任务负载无法回收
+	for i := len(kept); i < len(d.queue); i++ {
+		d.queue[i] = job{}
+	}
+	d.queue = kept
+}
+
+// hasSlot 流式任务受Streams限制，其他任务受Workers限制，调用方需持有锁
+func (d *dispatcher) hasSlot(j job) bool {
+	if j.msg.Stream {
+		return d.streams < d.opts.Streams
+	}
+	return d.running < d.opts.Workers
+}
+
+func (d *dispatcher) runnable(j job, blocked map[string]bool) bool {
+	if limit, ok := d.opts.ActionLimits[j.msg.Action]; ok && limit > 0 && d.actionRunning[j.msg.Action] >= limit {
+		return false
+	}
+	if j.key != "" && (d.keyBusy[j.key] || blocked[j.key]) {
+		return false
+	}
+	return true
+}
+
+func (d *dispatcher) execute(j job) {
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if j.msg.Stream {
+			d.streams--
+		} else {
+			d.running--
+		}
+		d.actionRunning[j.msg.Action]--
+		if d.actionRunning[j.msg.Action] == 0 {
+			delete(d.actionRunning, j.msg.Action)
+		}
+		if j.key != "" {
+			delete(d.keyBusy, j.key)
+		}
+		delete(d.inflight, messageKey(j.msg.Sender, j.msg.MsgId))
+		if !d.closed {
+			d.schedule()
+		}
+	}()
+	defer j.cancel()
+	d.run(j)
+}
+
+// cancel 取消发送方为sender的任务，排队中的任务从队列移除并返回，正在执行的任务取消其ctx
+// 出队到处理器开始执行之间被取消的任务，由执行方检查ctx后不再调用处理器
+func (d *dispatcher) cancel(msgId, sender string) (job, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	j, ok := d.inflight[messageKey(sender, msgId)]
+	if !ok {
+		return job{}, CancelNotFound
+	}
+	j.cancel()
+	for i, queued := range d.queue {
+		if queued.msg.MsgId != msgId || queued.msg.Sender != sender {
+			continue
+		}
+		copy(d.queue[i:], d.queue[i+1:])
+		d.queue[len(d.queue)-1] = job{}
+		d.queue = d.queue[:len(d.queue)-1]
+		delete(d.inflight, messageKey(sender, msgId))
+		// 被移除的任务可能挡住了同顺序键的后续任务
+		if !d.closed {
+			d.schedule()
+		}
+		return j, CancelQueued
+	}
+	return j, CancelRunning
+}
+
+// close 停止调度，丢弃排队中的任务并返回丢弃的数量，正在执行的任务不受影响
+func (d *dispatcher) close() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	n := len(d.queue)
+	for _, j := range d.queue {
+		j.cancel()
+		delete(d.inflight, messageKey(j.msg.Sender, j.msg.MsgId))
+	}
+	d.queue = nil
+	return n
+}
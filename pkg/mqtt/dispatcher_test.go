@@ -0,0 +1,174 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+// testRunner 通知开始执行的任务，任务一直执行到对应的release通道被关闭
+type testRunner struct {
+	mu      sync.Mutex
+	release map[string]chan struct{}
+	notify  chan string
+}
+
+func newTestRunner() *testRunner {
+	return &testRunner{
+		release: make(map[string]chan struct{}),
+		notify:  make(chan string, 100),
+	}
+}
+
+func (r *testRunner) gate(id string) chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ch, ok := r.release[id]
+	if !ok {
+		ch = make(chan struct{})
+		r.release[id] = ch
+	}
+	return ch
+}
+
+func (r *testRunner) run(j job) {
+	r.notify <- j.msg.MsgId
+	<-r.gate(j.msg.MsgId)
+}
+
+// waitStarted 等待n个任务开始执行，返回它们的ID
+func (r *testRunner) waitStarted(t *testing.T, n int) []string {
+	t.Helper()
+	var ids []string
+	for len(ids) < n {
+		select {
+		case id := <-r.notify:
+			ids = append(ids, id)
+		case <-time.After(time.Second):
+			t.Fatalf("等待任务开始执行超时，已开始=%v", ids)
+		}
+	}
+	return ids
+}
+
+// assertIdle 确认没有其他任务开始执行
+func (r *testRunner) assertIdle(t *testing.T) {
+	t.Helper()
+	select {
+	case id := <-r.notify:
+		t.Fatalf("任务%s不应开始执行", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func testJob(id, action, key string, stream bool) job {
+	return job{
+		msg: task.MessagePending{MsgId: id, Action: action, Sender: "ctl", Stream: stream},
+		key: key,
+	}
+}
+
+func TestDispatcherLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    DispatcherOptions
+		jobs    []job
+		started int // 立即开始执行的任务数
+	}{
+		{
+			name:    "总并发",
+			opts:    DispatcherOptions{Workers: 2},
+			jobs:    []job{testJob("1", "a", "", false), testJob("2", "a", "", false), testJob("3", "a", "", false)},
+			started: 2,
+		},
+		{
+			name:    "动作并发",
+			opts:    DispatcherOptions{Workers: 4, ActionLimits: map[string]int{"update": 1}},
+			jobs:    []job{testJob("1", "update", "", false), testJob("2", "update", "", false), testJob("3", "ping", "", false)},
+			started: 2,
+		},
+		{
+			name:    "顺序键",
+			opts:    DispatcherOptions{Workers: 4},
+			jobs:    []job{testJob("1", "update", "frp", false), testJob("2", "delete", "frp", false), testJob("3", "update", "other", false)},
+			started: 2,
+		},
+		{
+			name:    "流式任务不占用工作池",
+			opts:    DispatcherOptions{Workers: 1, Streams: 2},
+			jobs:    []job{testJob("1", "follow_log", "", true), testJob("2", "follow_log", "", true), testJob("3", "follow_log", "", true), testJob("4", "ping", "", false)},
+			started: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRunner()
+			d := newDispatcher(tt.opts, r.run)
+			for _, j := range tt.jobs {
+				if ok, err := d.submit(j); !ok || err != nil {
+					t.Fatalf("提交任务失败，ok=%v, err=%v", ok, err)
+				}
+			}
+			started := r.waitStarted(t, tt.started)
+			r.assertIdle(t)
+			// 逐个放行，剩余任务最终都会执行
+			remaining := len(tt.jobs) - tt.started
+			for _, id := range started {
+				close(r.gate(id))
+			}
+			for remaining > 0 {
+				ids := r.waitStarted(t, 1)
+				close(r.gate(ids[0]))
+				remaining--
+			}
+		})
+	}
+}
+
+func TestDispatcherOrderKey(t *testing.T) {
+	r := newTestRunner()
+	d := newDispatcher(DispatcherOptions{Workers: 4}, r.run)
+	for i := 0; i < 5; i++ {
+		d.submit(testJob(fmt.Sprint(i), "update", "frp", false))
+	}
+	for i := 0; i < 5; i++ {
+		ids := r.waitStarted(t, 1)
+		if ids[0] != fmt.Sprint(i) {
+			t.Fatalf("同顺序键的任务没有按到达顺序执行，got=%s, want=%d", ids[0], i)
+		}
+		r.assertIdle(t)
+		close(r.gate(ids[0]))
+	}
+}
+
+func TestDispatcherQueueAndCancel(t *testing.T) {
+	r := newTestRunner()
+	d := newDispatcher(DispatcherOptions{Workers: 1, QueueSize: 1}, r.run)
+	d.submit(testJob("1", "a", "", false))
+	r.waitStarted(t, 1)
+	if ok, err := d.submit(testJob("2", "a", "", false)); !ok || err != nil {
+		t.Fatalf("排队失败，ok=%v, err=%v", ok, err)
+	}
+	if ok, _ := d.submit(testJob("2", "a", "", false)); ok {
+		t.Fatal("重复投递的任务不应再次排队")
+	}
+	if _, err := d.submit(testJob("3", "a", "", false)); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("队列已满时应返回ErrQueueFull，err=%v", err)
+	}
+	if _, state := d.cancel("2", "other"); state != CancelNotFound {
+		t.Fatalf("其他发送方不能取消任务，state=%s", state)
+	}
+	if _, state := d.cancel("2", "ctl"); state != CancelQueued {
+		t.Fatalf("state=%s, want=%s", state, CancelQueued)
+	}
+	j, state := d.cancel("1", "ctl")
+	if state != CancelRunning || j.ctx.Err() == nil {
+		t.Fatalf("正在执行的任务应通过ctx取消，state=%s", state)
+	}
+	close(r.gate("1"))
+	r.assertIdle(t)
+}
@@ -0,0 +1,328 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+	"github.com/shellus/frp-daemon/pkg/types"
+)
+
+const (
+	// DefaultFailoverTimeout 当前代理断开多久后切换到下一个代理
+	DefaultFailoverTimeout = 30 * time.Second
+	// DefaultFailbackInterval 使用备用代理时尝试切回优先级更高的代理的间隔
+	DefaultFailbackInterval = 5 * time.Minute
+	// failoverCheckInterval 检查连接状态的间隔
+	failoverCheckInterval = 5 * time.Second
+)
+
+// connectionState 传输层报告当前是否已连接，paho会在后台自动重连，故障切换据此判断代理是否可用
+// 没有实现该接口的传输层视为一直连接
+type connectionState interface {
+	IsConnected() bool
+}
+
+// brokerList 返回配置的代理地址，配置了Brokers时忽略Broker
+func brokerList(config types.MQTTClientOpts) []string {
+	if len(config.Brokers) > 0 {
+		return config.Brokers
+	}
+	if config.Broker == "" {
+		return nil
+	}
+	return []string{config.Broker}
+}
+
+// failoverSubscription 已订阅的主题，切换代理后在新代理上重新订阅
+type failoverSubscription struct {
+	qos     byte
+	handler TransportHandler
+}
+
+// failoverTransport 按优先级连接多个代理中的一个，同一时间只连接一个代理
+// 当前代理断开超过failoverTimeout时依次尝试其他代理，使用备用代理时定期尝试切回优先级更高的代理
+// 每次连接都通过dial创建新的传输层，遗嘱消息随连接注册在当前代理上
+type failoverTransport struct {
+	brokers          []string
+	dial             func(broker string) (Transport, error)
+	failoverTimeout  time.Duration
+	failbackInterval time.Duration
+	// onSwitch 切换到新代理并重新订阅之后、断开旧代理之前调用，用于把保留状态转移到新代理
+	onSwitch func(old Transport, broker string)
+
+	mu     sync.RWMutex
+	active Transport
+	index  int
+	subs   map[string]failoverSubscription
+
+	// downSince 当前代理断开的时间，lastProbe 上次尝试切回的时间，只在监控协程中访问
+	downSince time.Time
+	lastProbe time.Time
+	done      chan struct{}
+	logger    zerolog.Logger
+}
+
+func newFailoverTransport(config types.MQTTClientOpts, dial func(broker string) (Transport, error), logger zerolog.Logger) *failoverTransport {
+	failoverTimeout := DefaultFailoverTimeout
+	if config.FailoverTimeout > 0 {
+		failoverTimeout = time.Duration(config.FailoverTimeout) * time.Second
+	}
+	failbackInterval := DefaultFailbackInterval
+	switch {
+	case config.FailbackInterval > 0:
+		failbackInterval = time.Duration(config.FailbackInterval) * time.Second
+	case config.FailbackInterval < 0:
+		failbackInterval = 0
+	}
+	return &failoverTransport{
+		brokers:          brokerList(config),
+		dial:             dial,
+		failoverTimeout:  failoverTimeout,
+		failbackInterval: failbackInterval,
+		subs:             make(map[string]failoverSubscription),
+		logger:           logger,
+	}
+}
+
+// Connect 按优先级依次尝试连接，连接成功后开始监控
+func (t *failoverTransport) Connect() error {
+	index, transport, err := t.connectFirst(0, len(t.brokers), -1)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.active, t.index = transport, index
+	t.mu.Unlock()
+	t.done = make(chan struct{})
+	t.downSince, t.lastProbe = time.Time{}, time.Now()
+	go t.monitor(t.done)
+	return nil
+}
+
+func (t *failoverTransport) Disconnect() {
+	t.mu.Lock()
+	active := t.active
+	t.active = nil
+	t.mu.Unlock()
+	if t.done != nil {
+		close(t.done)
+		t.done = nil
+	}
+	if active != nil {
+		active.Disconnect()
+	}
+}
+
+func (t *failoverTransport) Publish(topic string, payload []byte, qos byte, retain bool, opts *PublishOptions) error {
+	active := t.current()
+	if active == nil {
+		return ErrNotConnected
+	}
+	return active.Publish(topic, payload, qos, retain, opts)
+}
+
+func (t *failoverTransport) Subscribe(topic string, qos byte, handler TransportHandler) error {
+	t.mu.Lock()
+	t.subs[topic] = failoverSubscription{qos: qos, handler: handler}
+	active := t.active
+	t.mu.Unlock()
+	if active == nil {
+		return ErrNotConnected
+	}
+	return active.Subscribe(topic, qos, handler)
+}
+
+func (t *failoverTransport) Unsubscribe(topic string) error {
+	t.mu.Lock()
+	delete(t.subs, topic)
+	active := t.active
+	t.mu.Unlock()
+	if active == nil {
+		return ErrNotConnected
+	}
+	return active.Unsubscribe(topic)
+}
+
+// activeBroker 返回当前连接的代理地址
+func (t *failoverTransport) activeBroker() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.brokers[t.index]
+}
+
+// IsConnected 当前代理是否已连接，切换过程中仍报告旧代理的状态
+func (t *failoverTransport) IsConnected() bool {
+	active := t.current()
+	if active == nil {
+		return false
+	}
+	if state, ok := active.(connectionState); ok {
+		return state.IsConnected()
+	}
+	return true
+}
+
+func (t *failoverTransport) current() Transport {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.active
+}
+
+// connectFirst 按顺序尝试连接[from, to)中除skip以外的代理，返回第一个连接成功的
+func (t *failoverTransport) connectFirst(from, to, skip int) (int, Transport, error) {
+	var errs []string
+	for i := from; i < to; i++ {
+		if i == skip {
+			continue
+		}
+		transport, err := t.dial(t.brokers[i])
+		if err == nil {
+			err = transport.Connect()
+			if err != nil {
+				// paho在Connect超时后仍会在后台重试，需要停止
+				transport.Disconnect()
+			}
+		}
+		if err != nil {
+			t.logger.Warn().Msgf("连接MQTT代理失败，broker=%s, Error=%v", t.brokers[i], err)
+			errs = append(errs, fmt.Sprintf("%s: %v", t.brokers[i], err))
+			continue
+		}
+		return i, transport, nil
+	}
+	if len(errs) == 0 {
+		return 0, nil, errors.New("没有可用的MQTT代理")
+	}
+	return 0, nil, fmt.Errorf("所有MQTT代理都连接失败，%s", strings.Join(errs, "; "))
+}
+
+// monitor 定期检查当前代理，断开超过failoverTimeout时切换，使用备用代理时定期尝试切回
+func (t *failoverTransport) monitor(done <-chan struct{}) {
+	ticker := time.NewTicker(failoverCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			t.check(now)
+		}
+	}
+}
+
+func (t *failoverTransport) check(now time.Time) {
+	t.mu.RLock()
+	active, index := t.active, t.index
+	t.mu.RUnlock()
+	if active == nil {
+		return
+	}
+
+	if state, ok := active.(connectionState); ok && !state.IsConnected() {
+		if t.downSince.IsZero() {
+			t.downSince = now
+		}
+		if now.Sub(t.downSince) < t.failoverTimeout {
+			return
+		}
+		t.logger.Warn().Msgf("MQTT代理断开超过%s，尝试切换，broker=%s", t.failoverTimeout, t.brokers[index])
+		next, transport, err := t.connectFirst(0, len(t.brokers), index)
+		if err != nil {
+			// 当前代理仍在后台重连，下一个周期再尝试切换
+			t.logger.Error().Msgf("切换MQTT代理失败，Error=%v", err)
+			t.downSince = now
+			return
+		}
+		t.switchTo(next, transport)
+		return
+	}
+	t.downSince = time.Time{}
+
+	// 优先级最高的代理或未启用切回时不探测
+	if index == 0 || t.failbackInterval == 0 || now.Sub(t.lastProbe) < t.failbackInterval {
+		return
+	}
+	t.lastProbe = now
+	next, transport, err := t.connectFirst(0, index, -1)
+	if err != nil {
+		t.logger.Debug().Msgf("优先级更高的MQTT代理仍不可用，Error=%v", err)
+		return
+	}
+	t.switchTo(next, transport)
+}
+
+// switchTo 切换到新连接，先在新代理上重新订阅，再断开旧代理
+// 切换期间两个代理可能投递同一个任务，由去重缓存处理
+func (t *failoverTransport) switchTo(index int, transport Transport) {
+	t.mu.Lock()
+	old, oldIndex := t.active, t.index
+	if old == nil {
+		// 切换期间已调用Disconnect
+		t.mu.Unlock()
+		transport.Disconnect()
+		return
+	}
+	t.active, t.index = transport, index
+	subs := make(map[string]failoverSubscription, len(t.subs))
+	for topic, sub := range t.subs {
+		subs[topic] = sub
+	}
+	t.mu.Unlock()
+
+	for topic, sub := range subs {
+		if err := transport.Subscribe(topic, sub.qos, sub.handler); err != nil {
+			t.logger.Error().Msgf("在新MQTT代理上订阅失败，broker=%s, topic=%s, Error=%v", t.brokers[index], topic, err)
+		}
+	}
+	t.logger.Warn().Msgf("已切换MQTT代理，from=%s, to=%s", t.brokers[oldIndex], t.brokers[index])
+	if t.onSwitch != nil {
+		t.onSwitch(old, t.brokers[index])
+	}
+	old.Disconnect()
+	t.downSince, t.lastProbe = time.Time{}, time.Now()
+}
+
+// reportedStatus 最近一次上报的状态
+type reportedStatus struct {
+	clientId string
+	payload  []byte
+}
+
+// ActiveBroker 返回当前连接的代理地址，使用NewMQTTWithTransport创建时返回配置中的broker
+func (m *MQTT) ActiveBroker() string {
+	if failover, ok := m.transport.(*failoverTransport); ok {
+		return failover.activeBroker()
+	}
+	return m.config.Broker
+}
+
+// onBrokerSwitch 把保留状态转移到新代理，旧代理仍可连接时（切回优先级更高的代理）在旧代理上发布离线状态，
+// 否则旧代理上保留的在线状态会一直留着，仍连接旧代理的控制端会误以为本节点在线
+func (m *MQTT) onBrokerSwitch(old Transport, broker string) {
+	m.lastStatusMu.Lock()
+	status := m.lastStatus
+	m.lastStatusMu.Unlock()
+	if status == nil {
+		return
+	}
+	topic := task.TopicStatus(m.topicPrefix, status.clientId)
+	// 断开的旧代理上发布会一直等到重连，所以只在旧代理已连接时发布
+	if state, ok := old.(connectionState); ok && state.IsConnected() {
+		offline, err := json.Marshal(task.NewOfflineStatus())
+		if err == nil {
+			err = old.Publish(topic, offline, m.qos, true, nil)
+		}
+		if err != nil {
+			m.logger.Warn().Msgf("在旧MQTT代理上发布离线状态失败，Error=%v", err)
+		}
+	}
+	if err := m.transport.Publish(topic, status.payload, m.qos, true, nil); err != nil {
+		m.logger.Error().Msgf("在新MQTT代理上发布状态失败，broker=%s, Error=%v", broker, err)
+	}
+}
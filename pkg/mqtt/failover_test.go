@@ -0,0 +1,187 @@
+package mqtt
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+	"github.com/shellus/frp-daemon/pkg/types"
+)
+
+// testBroker 用Hub模拟的代理，down为true时新连接失败，已有连接报告断开且无法发布
+type testBroker struct {
+	hub  *Hub
+	down atomic.Bool
+}
+
+type testBrokerConn struct {
+	Transport
+	broker *testBroker
+}
+
+func (c *testBrokerConn) Connect() error {
+	if c.broker.down.Load() {
+		return ErrNotConnected
+	}
+	return c.Transport.Connect()
+}
+
+func (c *testBrokerConn) IsConnected() bool {
+	return !c.broker.down.Load() && c.Transport.(connectionState).IsConnected()
+}
+
+func (c *testBrokerConn) Publish(topic string, payload []byte, qos byte, retain bool, opts *PublishOptions) error {
+	if c.broker.down.Load() {
+		return ErrNotConnected
+	}
+	return c.Transport.Publish(topic, payload, qos, retain, opts)
+}
+
+// newFailoverMQTT 创建按优先级连接primary和backup的被控端，注册ping动作
+func newFailoverMQTT(t *testing.T, primary, backup *testBroker) (*MQTT, *failoverTransport) {
+	t.Helper()
+	brokers := map[string]*testBroker{"primary": primary, "backup": backup}
+	config := types.MQTTClientOpts{ClientID: "client", Username: "client", TopicPrefix: "test", Brokers: []string{"primary", "backup"}}
+	failover := newFailoverTransport(config, func(broker string) (Transport, error) {
+		b := brokers[broker]
+		return &testBrokerConn{Transport: b.hub.Transport(), broker: b}, nil
+	}, zerolog.Nop())
+	m, err := NewMQTTWithTransport(config, failover, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	failover.onSwitch = m.onBrokerSwitch
+	h := newCountingHandler()
+	close(h.release)
+	m.SubscribeAction("ping", h.handle)
+	return m, failover
+}
+
+func pingClient(t *testing.T, ctl *MQTT, id string) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err := ctl.Call(ctx, newPending("ctl", "client", id, "ping"))
+	return err
+}
+
+func readOnline(t *testing.T, ctl *MQTT) bool {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	status, err := ctl.ReadStatus(ctx, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status.Online != nil && *status.Online
+}
+
+// 主代理断开超过failoverTimeout后切换到备用代理并重新订阅、转移保留状态，主代理恢复后切回
+func TestFailoverSwitch(t *testing.T) {
+	primary, backup := &testBroker{hub: NewHub()}, &testBroker{hub: NewHub()}
+	m, failover := newFailoverMQTT(t, primary, backup)
+	if err := m.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Disconnect()
+	ctlPrimary := newHubMQTT(t, primary.hub, "ctl", nil)
+	ctlBackup := newHubMQTT(t, backup.hub, "ctl", nil)
+
+	online := true
+	if err := m.Report("client", task.MessageStatus{Time: time.Now().Unix(), Online: &online}); err != nil {
+		t.Fatal(err)
+	}
+	if m.ActiveBroker() != "primary" {
+		t.Fatalf("broker=%s", m.ActiveBroker())
+	}
+	if err := pingClient(t, ctlPrimary, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	primary.down.Store(true)
+	now := time.Now()
+	failover.check(now)
+	failover.check(now.Add(failover.failoverTimeout / 2))
+	if m.ActiveBroker() != "primary" {
+		t.Fatal("断开未超过failoverTimeout就切换了代理")
+	}
+	failover.check(now.Add(failover.failoverTimeout))
+	if m.ActiveBroker() != "backup" {
+		t.Fatalf("没有切换到备用代理，broker=%s", m.ActiveBroker())
+	}
+	if !readOnline(t, ctlBackup) {
+		t.Fatal("备用代理上没有保留的在线状态")
+	}
+	if err := pingClient(t, ctlBackup, "b"); err != nil {
+		t.Fatalf("切换后没有在备用代理上重新订阅，err=%v", err)
+	}
+
+	// 使用备用代理期间主代理仍不可用时不切回
+	now = time.Now()
+	failover.check(now.Add(failover.failbackInterval))
+	if m.ActiveBroker() != "backup" {
+		t.Fatal("主代理不可用时切回了主代理")
+	}
+	primary.down.Store(false)
+	failover.check(now.Add(2 * failover.failbackInterval))
+	if m.ActiveBroker() != "primary" {
+		t.Fatalf("主代理恢复后没有切回，broker=%s", m.ActiveBroker())
+	}
+	if readOnline(t, ctlBackup) {
+		t.Fatal("切回后备用代理上仍保留着在线状态")
+	}
+	if !readOnline(t, ctlPrimary) {
+		t.Fatal("切回后主代理上没有在线状态")
+	}
+	if err := pingClient(t, ctlPrimary, "c"); err != nil {
+		t.Fatalf("切回后没有在主代理上重新订阅，err=%v", err)
+	}
+}
+
+// 两个代理都不可用时保持当前代理，发布返回错误，恢复后继续使用
+func TestFailoverBothDown(t *testing.T) {
+	primary, backup := &testBroker{hub: NewHub()}, &testBroker{hub: NewHub()}
+	primary.down.Store(true)
+	backup.down.Store(true)
+	m, failover := newFailoverMQTT(t, primary, backup)
+	if err := m.Connect(); err == nil {
+		t.Fatal("所有代理都不可用时Connect应返回错误")
+	}
+
+	// 启动时主代理不可用，连接备用代理
+	backup.down.Store(false)
+	if err := m.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Disconnect()
+	if m.ActiveBroker() != "backup" {
+		t.Fatalf("broker=%s", m.ActiveBroker())
+	}
+
+	backup.down.Store(true)
+	now := time.Now()
+	failover.check(now)
+	failover.check(now.Add(failover.failoverTimeout))
+	if m.ActiveBroker() != "backup" {
+		t.Fatalf("没有可切换的代理时不应切换，broker=%s", m.ActiveBroker())
+	}
+	if m.IsConnected() {
+		t.Fatal("两个代理都不可用时报告已连接")
+	}
+	if err := failover.Publish(task.TopicStatus("test", "client"), []byte("{}"), 1, true, nil); err == nil {
+		t.Fatal("两个代理都不可用时发布应返回错误")
+	}
+
+	backup.down.Store(false)
+	failover.check(now.Add(2 * failover.failoverTimeout))
+	if !m.IsConnected() || m.ActiveBroker() != "backup" {
+		t.Fatalf("代理恢复后没有继续使用，broker=%s", m.ActiveBroker())
+	}
+	ctl := newHubMQTT(t, backup.hub, "ctl", nil)
+	if err := pingClient(t, ctl, "a"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,228 @@
+package mqtt
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotConnected 传输层尚未连接或已断开
+var ErrNotConnected = errors.New("传输层未连接")
+
+// Hub 进程内的消息代理，用于在同一个程序中运行控制端和多个被控端，不需要MQTT代理
+// 只支持精确主题和保留消息，不模拟会话：断开期间发往该连接的消息会丢失
+// 与MQTT 5代理一样转发报文属性，并丢弃已过期的消息
+type Hub struct {
+	mu       sync.RWMutex
+	subs     map[string]map[*hubTransport]TransportHandler
+	retained map[string]hubMessage
+}
+
+// hubMessage Hub中转的消息
+type hubMessage struct {
+	topic   string
+	payload []byte
+	props   *PublishOptions
+}
+
+// NewHub 创建进程内消息代理
+func NewHub() *Hub {
+	return &Hub{
+		subs:     make(map[string]map[*hubTransport]TransportHandler),
+		retained: make(map[string]hubMessage),
+	}
+}
+
+// Transport 创建一个连接到Hub的传输层，每个MQTT客户端使用各自的传输层
+func (h *Hub) Transport() Transport {
+	return &hubTransport{hub: h}
+}
+
+// publish 把消息投递到订阅该主题的所有连接，保留消息的负载为空时清除保留
+func (h *Hub) publish(msg hubMessage, retain bool) {
+	h.mu.Lock()
+	if retain {
+		if len(msg.payload) == 0 {
+			delete(h.retained, msg.topic)
+		} else {
+			h.retained[msg.topic] = msg
+		}
+	}
+	subs := make([]*hubTransport, 0, len(h.subs[msg.topic]))
+	for t := range h.subs[msg.topic] {
+		subs = append(subs, t)
+	}
+	h.mu.Unlock()
+	for _, t := range subs {
+		t.enqueue(msg)
+	}
+}
+
+// subscribe 订阅主题，存在保留消息时立即投递给该连接
+func (h *Hub) subscribe(t *hubTransport, topic string, handler TransportHandler) {
+	h.mu.Lock()
+	if h.subs[topic] == nil {
+		h.subs[topic] = make(map[*hubTransport]TransportHandler)
+	}
+	h.subs[topic][t] = handler
+	retained, ok := h.retained[topic]
+	h.mu.Unlock()
+	if ok {
+		t.enqueue(retained)
+	}
+}
+
+func (h *Hub) unsubscribe(t *hubTransport, topic string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[topic], t)
+	if len(h.subs[topic]) == 0 {
+		delete(h.subs, topic)
+	}
+}
+
+// handler 返回连接在该主题上的订阅回调
+func (h *Hub) handler(t *hubTransport, topic string) (TransportHandler, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	handler, ok := h.subs[topic][t]
+	return handler, ok
+}
+
+// hubTransport 连接到Hub的传输层
+// 每个连接有一个接收协程，按到达顺序逐条调用订阅回调，回调中发布消息不会阻塞
+type hubTransport struct {
+	hub *Hub
+
+	mu        sync.Mutex
+	connected bool
+	topics    map[string]struct{}
+	queue     []hubMessage
+	notify    chan struct{}
+	done      chan struct{}
+}
+
+func (t *hubTransport) Connect() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.connected {
+		return nil
+	}
+	t.connected = true
+	t.topics = make(map[string]struct{})
+	t.queue = nil
+	t.notify = make(chan struct{}, 1)
+	t.done = make(chan struct{})
+	go t.receive(t.notify, t.done)
+	return nil
+}
+
+func (t *hubTransport) IsConnected() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.connected
+}
+
+func (t *hubTransport) Disconnect() {
+	t.mu.Lock()
+	if !t.connected {
+		t.mu.Unlock()
+		return
+	}
+	t.connected = false
+	topics := t.topics
+	t.topics = nil
+	t.queue = nil
+	close(t.done)
+	t.mu.Unlock()
+	for topic := range topics {
+		t.hub.unsubscribe(t, topic)
+	}
+}
+
+func (t *hubTransport) Publish(topic string, payload []byte, qos byte, retain bool, opts *PublishOptions) error {
+	t.mu.Lock()
+	connected := t.connected
+	t.mu.Unlock()
+	if !connected {
+		return ErrNotConnected
+	}
+	msg := hubMessage{topic: topic, payload: append([]byte(nil), payload...)}
+	if opts != nil {
+		props := *opts
+		msg.props = &props
+	}
+	t.hub.publish(msg, retain)
+	return nil
+}
+
+func (t *hubTransport) Subscribe(topic string, qos byte, handler TransportHandler) error {
+	t.mu.Lock()
+	if !t.connected {
+		t.mu.Unlock()
+		return ErrNotConnected
+	}
+	t.topics[topic] = struct{}{}
+	t.mu.Unlock()
+	t.hub.subscribe(t, topic, handler)
+	return nil
+}
+
+func (t *hubTransport) Unsubscribe(topic string) error {
+	t.mu.Lock()
+	if !t.connected {
+		t.mu.Unlock()
+		return ErrNotConnected
+	}
+	delete(t.topics, topic)
+	t.mu.Unlock()
+	t.hub.unsubscribe(t, topic)
+	return nil
+}
+
+// enqueue 把消息放入接收队列，队列不限长度，避免回调中发布消息时互相等待
+func (t *hubTransport) enqueue(msg hubMessage) {
+	t.mu.Lock()
+	if !t.connected {
+		t.mu.Unlock()
+		return
+	}
+	t.queue = append(t.queue, msg)
+	notify := t.notify
+	t.mu.Unlock()
+	select {
+	case notify <- struct{}{}:
+	default:
+	}
+}
+
+// receive 接收协程，断开连接后退出
+func (t *hubTransport) receive(notify <-chan struct{}, done <-chan struct{}) {
+	for {
+		select {
+		case <-notify:
+		case <-done:
+			return
+		}
+		for {
+			t.mu.Lock()
+			if len(t.queue) == 0 || t.done != done {
+				t.mu.Unlock()
+				break
+			}
+			msg := t.queue[0]
+			t.queue[0] = hubMessage{}
+			t.queue = t.queue[1:]
+			t.mu.Unlock()
+
+			// 与代理一样丢弃已过期的消息
+			if msg.props != nil && !msg.props.Expiry.IsZero() && time.Now().After(msg.props.Expiry) {
+				continue
+			}
+			// 入队后可能已取消订阅
+			if handler, ok := t.hub.handler(t, msg.topic); ok {
+				handler(Message{Topic: msg.topic, Payload: msg.payload, Properties: msg.props})
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// recv 在超时之内读取一条消息，超时返回false
+func recv(ch <-chan Message, timeout time.Duration) (Message, bool) {
+	select {
+	case msg := <-ch:
+		return msg, true
+	case <-time.After(timeout):
+		return Message{}, false
+	}
+}
+
+// 断开期间的消息丢失，重新连接后需要重新订阅，订阅时收到保留消息
+func TestHubReconnect(t *testing.T) {
+	hub := NewHub()
+	pub := hub.Transport()
+	if err := pub.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Disconnect()
+	sub := hub.Transport()
+	if err := sub.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan Message, 10)
+	handler := func(msg Message) { received <- msg }
+	if err := sub.Subscribe("a", 1, handler); err != nil {
+		t.Fatal(err)
+	}
+	pub.Publish("a", []byte("1"), 1, false, nil)
+	if msg, ok := recv(received, time.Second); !ok || string(msg.Payload) != "1" {
+		t.Fatalf("连接期间没有收到消息，msg=%+v", msg)
+	}
+
+	sub.Disconnect()
+	if err := sub.Publish("a", []byte("x"), 1, false, nil); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("断开后发布，err=%v", err)
+	}
+	if err := sub.Subscribe("a", 1, handler); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("断开后订阅，err=%v", err)
+	}
+	pub.Publish("a", []byte("2"), 1, false, nil)
+	pub.Publish("a", []byte("retained"), 1, true, nil)
+
+	if err := sub.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Disconnect()
+	pub.Publish("a", []byte("3"), 1, false, nil)
+	if msg, ok := recv(received, 50*time.Millisecond); ok {
+		t.Fatalf("重新订阅之前收到消息，msg=%s", msg.Payload)
+	}
+	if err := sub.Subscribe("a", 1, handler); err != nil {
+		t.Fatal(err)
+	}
+	if msg, ok := recv(received, time.Second); !ok || string(msg.Payload) != "retained" {
+		t.Fatalf("重新订阅后没有收到保留消息，msg=%s", msg.Payload)
+	}
+	pub.Publish("a", []byte("4"), 1, false, nil)
+	if msg, ok := recv(received, time.Second); !ok || string(msg.Payload) != "4" {
+		t.Fatalf("重新连接后没有收到消息，msg=%s", msg.Payload)
+	}
+	if msg, ok := recv(received, 50*time.Millisecond); ok {
+		t.Fatalf("收到断开期间的消息，msg=%s", msg.Payload)
+	}
+}
+
+// 发布空的保留消息清除保留，已过期的消息不会投递
+func TestHubRetainedAndExpiry(t *testing.T) {
+	hub := NewHub()
+	pub := hub.Transport()
+	pub.Connect()
+	defer pub.Disconnect()
+	pub.Publish("status", []byte("online"), 1, true, nil)
+	pub.Publish("cleared", []byte("online"), 1, true, nil)
+	pub.Publish("cleared", nil, 1, true, nil)
+	pub.Publish("expired", []byte("old"), 1, true, &PublishOptions{Expiry: time.Now().Add(-time.Second)})
+
+	sub := hub.Transport()
+	sub.Connect()
+	defer sub.Disconnect()
+	received := make(chan Message, 10)
+	for _, topic := range []string{"status", "cleared", "expired"} {
+		sub.Subscribe(topic, 1, func(msg Message) { received <- msg })
+	}
+	if msg, ok := recv(received, time.Second); !ok || msg.Topic != "status" {
+		t.Fatalf("没有收到保留消息，msg=%+v", msg)
+	}
+	if msg, ok := recv(received, 50*time.Millisecond); ok {
+		t.Fatalf("收到已清除或已过期的消息，topic=%s", msg.Topic)
+	}
+}
@@ -1,19 +1,29 @@
 package mqtt
 
 import (
+	"context"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"encoding/json"
 
-	pahomqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rs/zerolog"
 	"github.com/shellus/frp-daemon/pkg/mqtt/task"
 	"github.com/shellus/frp-daemon/pkg/types"
 )
 
-type MessageHandler func(action string, payload []byte) (value []byte, err error)
+// MessageHandler 任务处理器，ctx携带正在执行的任务，可用于ReportProgress上报执行进度
+type MessageHandler func(ctx context.Context, action string, payload []byte) (value []byte, err error)
+
+// ReplyObserver 观察收到的所有任务响应，包括没有等待器的异步任务和上次连接期间未收到的响应
+type ReplyObserver interface {
+	OnAck(msg task.MessageAck)
+	OnComplete(msg task.MessageComplete)
+	OnFailed(msg task.MessageFailed)
+}
 
 type MQTT struct {
 	config       types.MQTTClientOpts
@@ -21,18 +31,156 @@ type MQTT struct {
 	qos          byte
 	retain       bool
 	cleanSession bool
-	paho         pahomqtt.Client
+	transport    Transport
 	// subscribeActionArr订阅行为调用数组
 	subscribeActionArr map[string]MessageHandler
-	// waiters 存储等待器
-	waiters map[string]*task.Waiter
-	logger  zerolog.Logger
+	// orderKeys 动作的顺序键提取函数
+	orderKeys map[string]OrderKeyFunc
+	// dispatcher 任务调度器，处理器在调度器的工作协程中执行
+	dispatcher *dispatcher
+	// waiters 存储等待器，会被多个goroutine并发访问
+	waiters *task.Registry
+	// observer 响应观察者，为nil时不通知
+	observer ReplyObserver
+	// dedup 已处理任务的结果缓存，为nil时不去重
+	dedup *DedupCache
+	// signingKey 发出任务时使用的签名私钥，为nil时不签名
+	signingKey ed25519.PrivateKey
+	// trustedKeys 受信任的发送方公钥，不为空时拒绝未签名或签名无效的任务
+	trustedKeys []ed25519.PublicKey
+	// keyring 负载加密密钥环，发往持有密钥的接收方的任务会被加密
+	keyring *task.Keyring
+	// requireSealed 为true时拒绝未加密的任务
+	requireSealed bool
+	// policy 发送方白名单和动作授权，为nil时不限制
+	policy *Policy
+	// peerVersions 配置的对端FD协议版本，learnedVersions 从对端状态消息得知的版本，配置优先
+	peerVersions    map[string]int
+	learnedVersions map[string]int
+	peerMu          sync.RWMutex
+	defaultVersion  int
+	// maxPacketSize 单个MQTT消息的最大长度，超过后分片发送
+	maxPacketSize int
+	// chunks 分片重组器
+	chunks *chunkAssembler
+	// streams 正在接收的流，键为任务消息ID
+	streams  map[string]*Stream
+	streamMu sync.Mutex
+	// skews 各发送方的时钟偏差，skewTolerance 判断任务过期时容忍的时钟偏差
+	skews         *skewTracker
+	skewTolerance time.Duration
+	// scheduler 定时任务存储，为nil时不接受定时任务
+	scheduler *Scheduler
+	// outbox 历史记录发件箱，为nil时不记录历史
+	outbox *Outbox
+	// lastStatus 最近一次上报的状态，切换代理后在新代理上重新发布
+	lastStatus   *reportedStatus
+	lastStatusMu sync.Mutex
+	// done 关闭时停止后台清理
+	done   chan struct{}
+	logger zerolog.Logger
 }
 
+// waiterSweepInterval 过期等待器的清理间隔
+const waiterSweepInterval = 30 * time.Second
+
 func NewMQTT(config types.MQTTClientOpts, logger zerolog.Logger) (*MQTT, error) {
-	if config.Broker == "" {
+	brokers := brokerList(config)
+	if len(brokers) == 0 {
 		return nil, errors.New("mqtt config broker is empty")
 	}
+	m, err := newMQTT(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// 遗嘱消息，异常断线时由代理发布离线状态到自己的status主题，控制端在一个keepalive周期内即可感知
+	willData, err := json.Marshal(task.NewOfflineStatus())
+	if err != nil {
+		return nil, err
+	}
+	will := willMessage{
+		topic:   task.TopicStatus(m.topicPrefix, m.config.Username),
+		payload: willData,
+		qos:     m.qos,
+		retain:  true,
+	}
+
+	// 每个代理的地址协议可能不同，分别创建TLS配置
+	dial := func(broker string) (Transport, error) {
+		brokerConfig := config
+		brokerConfig.Broker = broker
+		tlsConfig, err := newTLSConfig(broker, config.TLS)
+		if err != nil {
+			return nil, err
+		}
+		switch config.MQTTVersion {
+		case 0, MQTTv311:
+			return newPahoV3Transport(brokerConfig, m.cleanSession, will, tlsConfig, logger), nil
+		case MQTTv5:
+			return newPahoV5Transport(brokerConfig, m.cleanSession, will, tlsConfig, logger)
+		default:
+			return nil, fmt.Errorf("mqtt config mqtt_version不支持，version=%d", config.MQTTVersion)
+		}
+	}
+
+	if len(brokers) == 1 {
+		m.transport, err = dial(brokers[0])
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	// 先校验所有代理的配置，避免切换时才发现配置错误
+	for _, broker := range brokers {
+		if _, err := dial(broker); err != nil {
+			return nil, fmt.Errorf("mqtt config brokers无效，broker=%s, Error=%v", broker, err)
+		}
+	}
+	failover := newFailoverTransport(config, dial, logger)
+	failover.onSwitch = m.onBrokerSwitch
+	m.transport = failover
+	return m, nil
+}
+
+// NewMQTTWithTransport 使用指定的传输层创建客户端，config中的broker、TLS和MQTT版本不再使用
+// 用于在进程内通过Hub连接控制端和被控端，传输层自行负责连接和遗嘱
+func NewMQTTWithTransport(config types.MQTTClientOpts, transport Transport, logger zerolog.Logger) (*MQTT, error) {
+	if transport == nil {
+		return nil, errors.New("transport is nil")
+	}
+	m, err := newMQTT(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	m.transport = transport
+	return m, nil
+}
+
+// newMQTT 校验与传输层无关的配置并创建客户端，调用方负责设置transport
+func newMQTT(config types.MQTTClientOpts, logger zerolog.Logger) (*MQTT, error) {
+	defaultVersion := task.ProtocolDefault
+	switch config.ProtocolVersion {
+	case 0:
+	case task.ProtocolV1, task.ProtocolV2:
+		defaultVersion = config.ProtocolVersion
+	default:
+		return nil, fmt.Errorf("mqtt config protocol_version不支持，version=%d", config.ProtocolVersion)
+	}
+	maxPacketSize := DefaultMaxPacketSize
+	if config.MaxPacketSize != 0 {
+		if config.MaxPacketSize < minMaxPacketSize {
+			return nil, fmt.Errorf("mqtt config max_packet_size不能小于%d，max_packet_size=%d", minMaxPacketSize, config.MaxPacketSize)
+		}
+		maxPacketSize = config.MaxPacketSize
+	}
+	skewTolerance := DefaultClockSkewTolerance
+	switch {
+	case config.ClockSkewTolerance > 0:
+		skewTolerance = time.Duration(config.ClockSkewTolerance) * time.Second
+	case config.ClockSkewTolerance < 0:
+		skewTolerance = 0
+	}
 
 	m := &MQTT{
 		config:             config,
@@ -41,217 +189,655 @@ func NewMQTT(config types.MQTTClientOpts, logger zerolog.Logger) (*MQTT, error)
 		retain:             false,
 		cleanSession:       false,
 		subscribeActionArr: make(map[string]MessageHandler),
-		waiters:            make(map[string]*task.Waiter),
+		orderKeys:          make(map[string]OrderKeyFunc),
+		waiters:            task.NewRegistry(),
+		peerVersions:       make(map[string]int),
+		learnedVersions:    make(map[string]int),
+		defaultVersion:     defaultVersion,
+		maxPacketSize:      maxPacketSize,
+		chunks:             newChunkAssembler(),
+		skews:              newSkewTracker(),
+		skewTolerance:      skewTolerance,
+		streams:            make(map[string]*Stream),
+		done:               make(chan struct{}),
 		logger:             logger,
 	}
-
-	opts := pahomqtt.NewClientOptions()
-	opts.AddBroker(m.config.Broker)
-	opts.SetUsername(m.config.Username)
-	opts.SetPassword(m.config.Password)
-	opts.SetClientID(m.config.ClientID)
-	opts.SetCleanSession(m.cleanSession)
-	opts.SetKeepAlive(30 * time.Second)
-	opts.SetPingTimeout(10 * time.Second)
-	opts.SetConnectRetry(true)
-	opts.SetConnectRetryInterval(1 * time.Second)
-	// 添加连接超时
-	opts.SetConnectTimeout(10 * time.Second)
-	// 设置最大重连次数，避免无限等待
-	opts.SetAutoReconnect(true)
-	opts.SetMaxReconnectInterval(60 * time.Second)
-
-	// 添加连接回调，处理连接失败的情况
-	opts.SetConnectionLostHandler(func(client pahomqtt.Client, err error) {
-		m.logger.Error().Msgf("MQTT连接断开: %v", err)
-	})
-
-	opts.SetOnConnectHandler(func(client pahomqtt.Client) {
-		m.logger.Info().Msg("MQTT连接成功")
-	})
-	m.paho = pahomqtt.NewClient(opts)
-
+	m.dispatcher = newDispatcher(DispatcherOptions{}, m.execute)
 	return m, nil
 }
 
 func (m *MQTT) Connect() error {
 
-	connToken := m.paho.Connect()
-	// 等待连接完成，设置超时
-	if !connToken.WaitTimeout(10 * time.Second) {
-		return fmt.Errorf("MQTT连接超时，请检查服务器地址或网络连接：%s", m.config.Broker)
-	}
-
-	if connToken.Error() != nil {
-		return fmt.Errorf("MQTT连接失败，请检查用户名密码是否正确：%s", connToken.Error())
+	if err := m.transport.Connect(); err != nil {
+		return err
 	}
 
 	m.registerTaskTopics()
+	go m.sweepWaiters()
+	if m.scheduler != nil {
+		go m.runSchedules()
+	}
+	if m.outbox != nil {
+		go m.runOutbox()
+	}
 	return nil
 }
 
 func (m *MQTT) Disconnect() error {
-	m.paho.Disconnect(250)
+	select {
+	case <-m.done:
+	default:
+		close(m.done)
+	}
+	if n := m.dispatcher.close(); n > 0 {
+		m.logger.Warn().Msgf("断开连接，丢弃排队中的任务，count=%d", n)
+	}
+	m.transport.Disconnect()
 	return nil
 }
+
+// sweepWaiters 定期清理已过期但未被移除的等待器和超时未到齐的分片
+func (m *MQTT) sweepWaiters() {
+	ticker := time.NewTicker(waiterSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			if n := m.waiters.Sweep(now); n > 0 {
+				m.logger.Debug().Msgf("清理过期等待器，count=%d", n)
+			}
+			if n := m.chunks.sweep(now); n > 0 {
+				m.logger.Warn().Msgf("丢弃超时未到齐的分片消息，count=%d", n)
+			}
+		}
+	}
+}
+
+// SetPeerVersion 设置对端使用的FD协议版本，发往该对端的任务按此版本编码
+func (m *MQTT) SetPeerVersion(peer string, version int) {
+	m.peerMu.Lock()
+	defer m.peerMu.Unlock()
+	m.peerVersions[peer] = version
+}
+
+// PeerVersion 返回对端使用的FD协议版本，依次使用配置的版本、从对端状态得知的版本和默认版本
+func (m *MQTT) PeerVersion(peer string) int {
+	m.peerMu.RLock()
+	defer m.peerMu.RUnlock()
+	if version, ok := m.peerVersions[peer]; ok {
+		return version
+	}
+	if version, ok := m.learnedVersions[peer]; ok {
+		return version
+	}
+	return m.defaultVersion
+}
+
+// KnowsPeerVersion 是否已配置或从对端状态得知对端的FD协议版本
+func (m *MQTT) KnowsPeerVersion(peer string) bool {
+	m.peerMu.RLock()
+	defer m.peerMu.RUnlock()
+	_, configured := m.peerVersions[peer]
+	_, learned := m.learnedVersions[peer]
+	return configured || learned
+}
+
+// learnPeerVersion 记录对端状态消息中上报的协议版本，高于本端支持的版本时按本端最高版本通信
+func (m *MQTT) learnPeerVersion(peer string, version int) {
+	if version <= 0 {
+		return
+	}
+	if version > task.ProtocolLatest {
+		version = task.ProtocolLatest
+	}
+	m.peerMu.Lock()
+	defer m.peerMu.Unlock()
+	m.learnedVersions[peer] = version
+}
+
 func (m *MQTT) SubscribeAction(actionName string, callback MessageHandler) {
 	m.subscribeActionArr[actionName] = callback
 }
 
+// SetOrderKey 设置动作的顺序键提取函数，顺序键相同的任务按到达顺序逐个执行
+func (m *MQTT) SetOrderKey(actionName string, fn OrderKeyFunc) {
+	m.orderKeys[actionName] = fn
+}
+
+// SetDispatcher 设置任务调度的并发数、队列长度和每个动作的并发上限，需要在Connect之前调用
+func (m *MQTT) SetDispatcher(opts DispatcherOptions) {
+	m.dispatcher = newDispatcher(opts, m.execute)
+}
+
+// SetDedupCache 设置任务去重缓存，需要在Connect之前调用
+// 缓存记录保留到任务过期时间加上时钟偏差容忍，容忍范围内的重复投递不会被再次执行
+func (m *MQTT) SetDedupCache(cache *DedupCache) {
+	cache.setTolerance(m.skewTolerance)
+	m.dedup = cache
+}
+
+// SetSigningKey 设置签名私钥，之后发出的所有任务都会签名
+func (m *MQTT) SetSigningKey(key ed25519.PrivateKey) {
+	m.signingKey = key
+}
+
+// SetTrustedKeys 设置受信任的发送方公钥，需要在Connect之前调用
+// 设置后未签名或签名无法验证的任务不会执行，直接回复failed
+func (m *MQTT) SetTrustedKeys(keys ...ed25519.PublicKey) {
+	m.trustedKeys = keys
+}
+
+// SetKeyring 设置负载加密密钥环，需要在Connect之前调用
+// 发往密钥环中持有密钥的接收方的任务会加密Payload，对应的响应也会加密Value和Error
+func (m *MQTT) SetKeyring(keyring *task.Keyring) {
+	m.keyring = keyring
+}
+
+// SetRequireSealed 设置是否拒绝未加密的任务
+func (m *MQTT) SetRequireSealed(require bool) {
+	m.requireSealed = require
+}
+
+// SetPolicy 设置发送方白名单和动作授权策略，需要在Connect之前调用
+// 白名单依据的是发送方自称的Sender字段，没有可用验签公钥的发送方的任务会被拒绝
+func (m *MQTT) SetPolicy(policy *Policy) {
+	m.policy = policy
+}
+
+// SetReplyObserver 设置响应观察者，需要在Connect之前调用，持久会话中积压的响应会在连接后立即到达
+func (m *MQTT) SetReplyObserver(observer ReplyObserver) {
+	m.observer = observer
+}
+
 func (m *MQTT) registerTaskTopics() {
-	m.subscribe(task.TopicPending(m.topicPrefix, m.config.Username), m.qos, func(client pahomqtt.Client, msg pahomqtt.Message) {
+	m.subscribe(task.TopicPending(m.topicPrefix, m.config.Username), m.qos, func(msg Message) {
 		var message task.MessagePending
-		mqttMessage := msg.Payload()
+		mqttMessage := msg.Payload
 		if err := json.Unmarshal(mqttMessage, &message); err != nil {
 			m.logger.Error().Msgf("解析消息失败: err=%v, message=%s", err, mqttMessage)
 			return
 		}
 		// 这里我都不if判断了，如果别人往这个pending主题胡乱投递不符合task.MessagePending的数据结构，那么后续处理时候自然会报错的。
+		if msg.Properties != nil {
+			message.ResponseTopic = msg.Properties.ResponseTopic
+			message.Correlation = msg.Properties.Correlation
+		}
 		m.onTopicPending(message)
 	})
-	m.subscribe(task.TopicAsk(m.topicPrefix, m.config.Username), m.qos, func(client pahomqtt.Client, msg pahomqtt.Message) {
-		var message task.MessageAsk
-		mqttMessage := msg.Payload()
+	m.subscribe(task.TopicAck(m.topicPrefix, m.config.Username), m.qos, func(msg Message) {
+		var message task.MessageAck
+		mqttMessage := msg.Payload
 		if err := json.Unmarshal(mqttMessage, &message); err != nil {
 			m.logger.Error().Msgf("解析消息失败: err=%v, message=%s", err, mqttMessage)
 			return
 		}
-		m.onTopicAsk(message)
+		message.MsgId = correlationId(msg, message.MsgId)
+		m.onTopicAck(message)
 	})
-	m.subscribe(task.TopicComplete(m.topicPrefix, m.config.Username), m.qos, func(client pahomqtt.Client, msg pahomqtt.Message) {
+	m.subscribe(task.TopicComplete(m.topicPrefix, m.config.Username), m.qos, func(msg Message) {
 		var message task.MessageComplete
-		mqttMessage := msg.Payload()
+		mqttMessage := msg.Payload
 		if err := json.Unmarshal(mqttMessage, &message); err != nil {
 			m.logger.Error().Msgf("解析消息失败: err=%v, message=%s", err, mqttMessage)
 			return
 		}
+		message.MsgId = correlationId(msg, message.MsgId)
 		m.onTopicComplete(message)
 	})
-	m.subscribe(task.TopicFailed(m.topicPrefix, m.config.Username), m.qos, func(client pahomqtt.Client, msg pahomqtt.Message) {
+	m.subscribe(task.TopicFailed(m.topicPrefix, m.config.Username), m.qos, func(msg Message) {
 		var message task.MessageFailed
-		mqttMessage := msg.Payload()
+		mqttMessage := msg.Payload
 		if err := json.Unmarshal(mqttMessage, &message); err != nil {
 			m.logger.Error().Msgf("解析消息失败: err=%v, message=%s", err, mqttMessage)
 			return
 		}
+		message.MsgId = correlationId(msg, message.MsgId)
 		m.onTopicFailed(message)
 	})
+	m.subscribe(task.TopicProgress(m.topicPrefix, m.config.Username), 0, func(msg Message) {
+		var message task.MessageProgress
+		mqttMessage := msg.Payload
+		if err := json.Unmarshal(mqttMessage, &message); err != nil {
+			m.logger.Error().Msgf("解析消息失败: err=%v, message=%s", err, mqttMessage)
+			return
+		}
+		message.MsgId = correlationId(msg, message.MsgId)
+		m.onTopicProgress(message)
+	})
+	m.subscribe(task.TopicStream(m.topicPrefix, m.config.Username), m.qos, func(msg Message) {
+		var message task.MessageStream
+		mqttMessage := msg.Payload
+		if err := json.Unmarshal(mqttMessage, &message); err != nil {
+			m.logger.Error().Msgf("解析消息失败: err=%v, message=%s", err, mqttMessage)
+			return
+		}
+		message.MsgId = correlationId(msg, message.MsgId)
+		m.onTopicStream(message)
+	})
+}
+
+// correlationId MQTT 5响应按关联数据匹配任务，v3.1.1连接或对端没有设置关联数据时使用信封中的消息ID
+func correlationId(msg Message, msgId string) string {
+	if msg.Properties != nil && msg.Properties.Correlation != "" {
+		return msg.Properties.Correlation
+	}
+	return msgId
+}
+
+// replyTopic 响应主题，MQTT 5任务消息带有响应主题时发布到其下，否则按信封中的发送方拼接
+func (m *MQTT) replyTopic(msg task.MessagePending, kind string) string {
+	root := msg.ResponseTopic
+	if root == "" {
+		root = task.TopicReply(m.topicPrefix, msg.Sender)
+	}
+	return task.ReplyTopic(root, kind)
 }
 func (m *MQTT) onTopicPending(msg task.MessagePending) {
-	// 如果已经超过时间，则丢弃
-	if msg.Expiration < time.Now().Unix() {
-		m.logger.Warn().Msgf("消息已过期，丢弃，messageId=%s", msg.MessageId)
+	now := time.Now()
+	// 校验签名，Sender字段是发送方自称的，只有签名能证明任务来自受信任的控制端
+	if keys := m.policy.verifyKeys(msg.Sender, m.trustedKeys); len(keys) > 0 {
+		if err := msg.Verify(keys); err != nil {
+			m.logger.Warn().Msgf("拒绝执行任务，messageId=%s, action=%s, sender=%s, Err=%v", msg.MsgId, msg.Action, msg.Sender, err)
+			m.replyFailed(msg, task.NewRemoteError(task.CodeBadSignature, err.Error()))
+			return
+		}
+	} else if m.policy.restricted() {
+		// 白名单依据的Sender字段无法验证，任何人都可以冒充白名单中的发送方
+		m.logger.Warn().Msgf("拒绝执行任务，发送方没有可用的验签公钥，messageId=%s, action=%s, sender=%s", msg.MsgId, msg.Action, msg.Sender)
+		m.replyFailed(msg, task.NewRemoteError(task.CodeBadSignature, fmt.Sprintf("发送方没有可用的验签公钥，sender=%s", msg.Sender)))
 		return
 	}
-	// 先回复一个ask
-	askMsg := task.MessageAsk{
-		MessageId: msg.MessageId,
+	// 解密负载，签名覆盖的是密文，所以要先验签再解密
+	if err := m.openPending(&msg); err != nil {
+		m.logger.Warn().Msgf("拒绝执行任务，messageId=%s, action=%s, sender=%s, Err=%v", msg.MsgId, msg.Action, msg.Sender, err)
+		// 两端密钥不一致时发送方也无法解密本端加密的响应，错误信息不含任务内容，以明文回复
+		msg.Enc = ""
+		m.replyFailed(msg, task.NewRemoteError(task.CodeSealError, err.Error()))
+		return
 	}
-	askData, err := json.Marshal(askMsg)
-	if err != nil {
-		m.logger.Error().Msgf("行为调用ask序列化失败，Err=%v", err)
+	// 发送时间戳在验签之后才可信，伪造的任务不能影响时钟偏差的测量
+	m.checkSkew(msg, now)
+	// 如果已经超过时间，则丢弃，两端时钟偏差在容忍范围内的不算过期
+	if m.expired(msg, now) {
+		m.logger.Warn().Msgf("消息已过期，丢弃，messageId=%s, exp=%s, sender=%s, time=%s", msg.MsgId,
+			time.Unix(msg.Exp, 0).Format(time.DateTime), msg.Sender, time.Unix(msg.Time, 0).Format(time.DateTime))
 		return
 	}
-	m.publish(task.TopicAsk(m.topicPrefix, msg.SenderClientId), askData, m.qos, m.retain)
-
-	// 从m.subscribeArr找出回调函数并调用，然后将返回值发布到compete或failed
-	var callback MessageHandler
-	for actionName, v := range m.subscribeActionArr {
-		if actionName == string(msg.Action) {
-			callback = v
-			break
-		}
+	// 取消是内置动作，由原任务的发送方发起，不受动作授权限制
+	if msg.Action == task.ActionCancel {
+		m.handleCancel(msg)
+		return
+	}
+	if msg.Action == task.ActionSchedules {
+		m.handleSchedules(msg)
+		return
+	}
+	// 在调用处理器之前检查发送方是否有权调用该动作
+	if err := m.policy.Authorize(msg.Sender, msg.Action); err != nil {
+		m.logger.Warn().Msgf("拒绝执行任务，messageId=%s, Err=%v", msg.MsgId, err)
+		m.replyFailed(msg, task.NewRemoteError(task.CodeForbidden, err.Error()))
+		return
 	}
-	if callback == nil {
+	// 从m.subscribeArr找出回调函数，没有注册的动作明确回复不支持，发送方不必等到超时
+	callback, ok := m.subscribeActionArr[msg.Action]
+	if !ok {
 		m.logger.Error().Msgf("行为调用没有找到回调函数，actionName=%s", msg.Action)
+		m.replyFailed(msg, task.NewRemoteError(task.CodeUnsupportedAction, fmt.Sprintf("不支持的动作，action=%s", msg.Action)))
+		return
+	}
+	// 重复投递的任务不再执行，已处理过的重发缓存的结果，仍在排队或执行的直接忽略
+	if m.dedup != nil {
+		entry, state := m.dedup.begin(msg)
+		switch state {
+		case dedupConflict:
+			m.logger.Warn().Msgf("拒绝执行任务，消息ID已被其他动作使用，messageId=%s, action=%s, sender=%s, cachedAction=%s", msg.MsgId, msg.Action, msg.Sender, entry.Action)
+			m.replyFailed(msg, task.NewRemoteError(task.CodeDuplicateId, fmt.Sprintf("消息ID已被其他动作使用，messageId=%s", msg.MsgId)))
+			return
+		case dedupDone:
+			m.ack(msg)
+			m.logger.Info().Msgf("任务已处理过，重发缓存的结果，messageId=%s, action=%s", msg.MsgId, msg.Action)
+			var handleErr error
+			if entry.Error != "" {
+				handleErr = entry.remoteError()
+			}
+			m.reply(msg, entry.Value, handleErr)
+			return
+		case dedupPending:
+			m.ack(msg)
+			m.logger.Info().Msgf("任务正在排队或执行，忽略重复投递，messageId=%s, action=%s", msg.MsgId, msg.Action)
+			return
+		}
+	}
+	// 先回复一个ack
+	m.ack(msg)
+
+	// 带执行时间或cron的任务先保存，到时间后再执行
+	if m.schedule(msg, now) {
 		return
 	}
-	value, err := callback(string(msg.Action), msg.Payload)
+
+	// 交给调度器执行，不阻塞传输层的消息回调
+	var key string
+	if fn, ok := m.orderKeys[msg.Action]; ok {
+		key = fn(msg.Action, msg.Payload)
+	}
+	submitted, err := m.dispatcher.submit(job{msg: msg, callback: callback, key: key})
 	if err != nil {
-		// 回复到失败主题
-		failedMsg := task.MessageFailed{
-			MessageId: msg.MessageId,
-			Error:     json.RawMessage(err.Error()),
+		// 没有记录结果，重复投递时可以重新排队
+		if m.dedup != nil {
+			m.dedup.abort(msg)
+		}
+		m.logger.Error().Msgf("任务无法排队，messageId=%s, action=%s, Err=%v", msg.MsgId, msg.Action, err)
+		m.replyFailed(msg, task.NewRemoteError(task.CodeQueueFull, err.Error()))
+		return
+	}
+	if !submitted {
+		m.logger.Info().Msgf("任务正在排队或执行，忽略重复投递，messageId=%s, action=%s", msg.MsgId, msg.Action)
+	}
+}
+
+// ack 回复任务已收到，回复使用与任务消息相同的协议版本
+func (m *MQTT) ack(msg task.MessagePending) {
+	ackMsg := task.MessageAck{
+		MsgId: msg.MsgId,
+	}
+	ackData, err := ackMsg.Marshal(msg.Version())
+	if err != nil {
+		m.logger.Error().Msgf("行为调用ack序列化失败，Err=%v", err)
+		return
+	}
+	m.publishWith(m.replyTopic(msg, task.ReplyAck), ackData, m.qos, m.retain, replyOptions(msg))
+}
+
+// execute 在调度器的工作协程中调用处理器，记录去重缓存并回复结果
+func (m *MQTT) execute(j job) {
+	msg := j.msg
+	// 出队后、开始执行前被取消的任务不再调用处理器
+	if err := j.ctx.Err(); err != nil {
+		m.finishJob(j, nil, task.NewRemoteError(task.CodeCanceled, "任务在执行前被取消"))
+		return
+	}
+
+	ctx, tc := withTask(j.ctx, m, msg)
+	value, err := j.callback(ctx, string(msg.Action), msg.Payload)
+	if msg.Stream {
+		m.endStream(tc)
+	}
+	// 被发送方取消的任务，处理器通常返回ctx.Err()
+	if err != nil && errors.Is(err, context.Canceled) && ctx.Err() != nil {
+		err = task.NewRemoteError(task.CodeCanceled, err.Error())
+	}
+	m.finishJob(j, value, err)
+}
+
+// finishJob 把执行结果交给job.done，没有设置时记录去重缓存并回复发送方
+func (m *MQTT) finishJob(j job, value []byte, err error) {
+	if j.done != nil {
+		j.done(value, err)
+		return
+	}
+	m.finish(j.msg, value, err)
+}
+
+// finish 记录去重缓存并回复结果，重复投递的任务会重发同样的结果，被取消的任务也不会再执行
+func (m *MQTT) finish(msg task.MessagePending, value []byte, err error) {
+	if m.dedup != nil {
+		entry := dedupEntry{
+			MessageId:  msg.MsgId,
+			Sender:     msg.Sender,
+			Action:     msg.Action,
+			Expiration: msg.Exp,
+			Value:      value,
+			HandleTime: time.Now().Unix(),
 		}
-		failedData, err := json.Marshal(failedMsg)
 		if err != nil {
-			m.logger.Error().Msgf("行为调用ask序列化失败，Err=%v", err)
-			return
+			remote := task.AsRemoteError(err)
+			entry.Error, entry.Code, entry.Details = remote.Message, remote.Code, remote.Details
+		}
+		if putErr := m.dedup.put(entry); putErr != nil {
+			m.logger.Error().Msgf("写入任务去重缓存失败，messageId=%s, Err=%v", msg.MsgId, putErr)
 		}
-		m.publish(task.TopicFailed(m.topicPrefix, msg.SenderClientId), failedData, m.qos, m.retain)
+	}
+	m.reply(msg, value, err)
+}
+
+// reply 将处理器的结果发布到发送方的complete或failed主题，每个任务只回复其中一个
+func (m *MQTT) reply(msg task.MessagePending, value []byte, err error) {
+	if err != nil {
+		m.replyFailed(msg, err)
+		return
 	}
 	// 回复到完成主题
 	complepeMsg := task.MessageComplete{
-		MessageId: msg.MessageId,
-		Value:     json.RawMessage(value),
+		MsgId: msg.MsgId,
+		Value: json.RawMessage(value),
 	}
-	complepeData, err := json.Marshal(complepeMsg)
+	complepeMsg.Value, complepeMsg.Enc = m.sealReply(msg, task.SealValue, complepeMsg.Value)
+	complepeData, err := complepeMsg.Marshal(msg.Version())
 	if err != nil {
 		m.logger.Error().Msgf("行为调用ask序列化失败，Err=%v", err)
 		return
 	}
-	m.publish(task.TopicComplete(m.topicPrefix, msg.SenderClientId), complepeData, m.qos, m.retain)
+	m.publishWith(m.replyTopic(msg, task.ReplyComplete), complepeData, m.qos, m.retain, replyOptions(msg))
+}
+
+// replyFailed 回复到发送方的失败主题，错误以RemoteError信封发送
+func (m *MQTT) replyFailed(msg task.MessagePending, err error) {
+	errData, err := json.Marshal(task.AsRemoteError(err))
+	if err != nil {
+		m.logger.Error().Msgf("行为调用failed序列化失败，Err=%v", err)
+		return
+	}
+	failedMsg := task.MessageFailed{
+		MsgId: msg.MsgId,
+		Error: errData,
+	}
+	failedMsg.Error, failedMsg.Enc = m.sealReply(msg, task.SealError, failedMsg.Error)
+	failedData, err := failedMsg.Marshal(msg.Version())
+	if err != nil {
+		m.logger.Error().Msgf("行为调用failed序列化失败，Err=%v", err)
+		return
+	}
+	m.publishWith(m.replyTopic(msg, task.ReplyFailed), failedData, m.qos, m.retain, replyOptions(msg))
+}
+
+// replyOptions 响应的MQTT 5属性，关联数据沿用任务消息的关联数据，没有时使用任务消息ID，随任务一起过期
+// 流式任务持续到过期时间之后，响应不设置过期时间
+func replyOptions(msg task.MessagePending) *PublishOptions {
+	opts := &PublishOptions{
+		Correlation: msg.MsgId,
+	}
+	if msg.Correlation != "" {
+		opts.Correlation = msg.Correlation
+	}
+	if !msg.Stream {
+		opts.Expiry = time.Unix(msg.Exp, 0)
+	}
+	return opts
 }
 
-func (m *MQTT) onTopicAsk(msg task.MessageAsk) {
+// openPending 解密任务负载，未加密的任务在要求加密时返回错误
+func (m *MQTT) openPending(msg *task.MessagePending) error {
+	if msg.Enc == "" {
+		if m.requireSealed {
+			return errors.New("任务消息未加密")
+		}
+		return nil
+	}
+	if m.keyring == nil {
+		return task.ErrUnknownSealKey
+	}
+	payload, err := m.keyring.Open(msg.Enc, msg.MsgId, task.SealPayload, msg.Payload)
+	if err != nil {
+		return err
+	}
+	msg.Payload = payload
+	return nil
+}
+
+// sealReply 使用任务消息的密钥加密响应内容，任务未加密或密钥不可用时原样返回
+func (m *MQTT) sealReply(msg task.MessagePending, purpose string, data []byte) ([]byte, string) {
+	if msg.Enc == "" || m.keyring == nil || !m.keyring.Has(msg.Enc) {
+		return data, ""
+	}
+	sealed, err := m.keyring.Seal(msg.Enc, msg.MsgId, purpose, data)
+	if err != nil {
+		m.logger.Error().Msgf("加密响应失败，messageId=%s, Err=%v", msg.MsgId, err)
+		return data, ""
+	}
+	return sealed, msg.Enc
+}
+
+// openReply 解密响应内容，未加密时原样返回
+func (m *MQTT) openReply(msgId, enc, purpose string, data []byte) ([]byte, error) {
+	if enc == "" {
+		return data, nil
+	}
+	if m.keyring == nil {
+		return nil, task.ErrUnknownSealKey
+	}
+	return m.keyring.Open(enc, msgId, purpose, data)
+}
+
+func (m *MQTT) onTopicAck(msg task.MessageAck) {
+	if m.observer != nil {
+		m.observer.OnAck(msg)
+	}
+	// 接收方已收到任务，推进等待器的acked阶段
+	m.waiters.Ack(msg.MsgId)
 }
 func (m *MQTT) onTopicComplete(msg task.MessageComplete) {
-	// 同步行为调用接收响应
-	if waiter, ok := m.waiters[msg.MessageId]; ok {
-		waiter.Ch <- msg.Value
-		delete(m.waiters, msg.MessageId)
+	value, err := m.openReply(msg.MsgId, msg.Enc, task.SealValue, msg.Value)
+	if err != nil {
+		m.logger.Error().Msgf("解密complete响应失败，messageId=%s, Err=%v", msg.MsgId, err)
+		m.waiters.Resolve(msg.MsgId, fmt.Errorf("解密响应失败: %v", err))
+		return
 	}
+	msg.Value, msg.Enc = value, ""
+	if m.observer != nil {
+		m.observer.OnComplete(msg)
+	}
+	// 同步行为调用接收响应
+	m.waiters.Resolve(msg.MsgId, []byte(msg.Value))
 }
 func (m *MQTT) onTopicFailed(msg task.MessageFailed) {
-	// 同步行为调用接收响应
-	if waiter, ok := m.waiters[msg.MessageId]; ok {
-		waiter.Ch <- errors.New(string(msg.Error))
-		delete(m.waiters, msg.MessageId)
+	errData, err := m.openReply(msg.MsgId, msg.Enc, task.SealError, msg.Error)
+	if err != nil {
+		m.logger.Error().Msgf("解密failed响应失败，messageId=%s, Err=%v", msg.MsgId, err)
+		m.waiters.Resolve(msg.MsgId, fmt.Errorf("解密响应失败: %v", err))
+		return
+	}
+	msg.Error, msg.Enc = errData, ""
+	if m.observer != nil {
+		m.observer.OnFailed(msg)
 	}
+	// 同步行为调用接收响应
+	m.waiters.Resolve(msg.MsgId, task.ParseRemoteError(msg.Error))
 }
 func (m *MQTT) RsyncAction(action task.MessagePending) error {
 	return m.action(action)
 }
-func (m *MQTT) SyncAction(action task.MessagePending) (*task.Waiter, error) {
-	waiter := task.NewWaiter(action.MessageId, time.Unix(action.Expiration, 0))
-	m.waiters[action.MessageId] = waiter
-	err := m.action(action)
+
+// Call 同步行为调用，发布任务后等待complete或failed响应
+// ctx被取消或超过action.Exp时返回错误，无论结果如何等待器都会被移除
+func (m *MQTT) Call(ctx context.Context, action task.MessagePending) ([]byte, error) {
+	waiter, err := m.Dispatch(action)
 	if err != nil {
-		delete(m.waiters, action.MessageId)
+		return nil, err
+	}
+	defer m.Release(waiter)
+	return waiter.Wait(ctx)
+}
+
+// Dispatch 发布任务并返回等待器，调用方可以分别等待acked和completed阶段
+// 调用方用完等待器后应调用Release，否则要到消息过期后才会被清理
+func (m *MQTT) Dispatch(action task.MessagePending) (*task.Waiter, error) {
+	waiter := task.NewWaiter(action.MsgId, time.Unix(action.Exp, 0))
+	if err := m.waiters.Add(waiter); err != nil {
+		return nil, err
+	}
+	if err := m.action(action); err != nil {
+		m.waiters.Remove(action.MsgId)
 		return nil, err
 	}
 	return waiter, nil
 }
 
+// Release 移除等待器，之后到达的响应将被忽略
+func (m *MQTT) Release(waiter *task.Waiter) {
+	m.waiters.Remove(waiter.MessageId())
+}
+
 func (m *MQTT) action(action task.MessagePending) error {
-	if action.MessageId == "" {
+	if action.MsgId == "" {
 		return errors.New("消息ID为空")
 	}
-	if action.Expiration == 0 {
+	if action.Exp == 0 {
 		return errors.New("超时时间必须设置")
 	}
-	if action.Expiration > time.Now().Add(3*24*time.Hour).Unix() {
+	if action.Exp > time.Now().Add(3*24*time.Hour).Unix() {
 		return errors.New("超时时间不得大于3天")
 	}
+	// v1接收方不认识定时字段，会立即执行任务
+	if (action.NotBefore != 0 || action.Cron != "") && m.PeerVersion(action.Receiver) == task.ProtocolV1 {
+		return fmt.Errorf("接收方使用v1协议或尚未上报协议版本，不支持定时任务，receiver=%s", action.Receiver)
+	}
+	if action.Cron != "" {
+		if _, err := parseCron(action.Cron); err != nil {
+			return err
+		}
+	}
+	// 发送时间戳用于接收方测量时钟偏差，需要在签名之前设置
+	if action.Time == 0 {
+		action.Time = time.Now().Unix()
+	}
+
+	// 先加密后签名
+	if m.keyring != nil && m.keyring.Has(action.Receiver) {
+		sealed, err := m.keyring.Seal(action.Receiver, action.MsgId, task.SealPayload, action.Payload)
+		if err != nil {
+			return fmt.Errorf("加密任务负载失败: %v", err)
+		}
+		action.Payload = sealed
+		action.Enc = action.Receiver
+	}
+	if m.signingKey != nil {
+		action.Sign(m.signingKey)
+	}
 
-	// 序列化消息为JSON
-	jsonData, err := json.Marshal(action)
+	// 按接收方支持的协议版本序列化消息为JSON
+	jsonData, err := action.Marshal(m.PeerVersion(action.Receiver))
 	if err != nil {
 		return err
 	}
 
-	err = m.publish(task.TopicPending(m.topicPrefix, action.ReceiverClientId), jsonData, m.qos, m.retain)
+	// MQTT 5连接时代理按过期时间丢弃未投递的任务，v3.1.1时忽略
+	err = m.publishWith(task.TopicPending(m.topicPrefix, action.Receiver), jsonData, m.qos, m.retain, &PublishOptions{
+		Expiry:        time.Unix(action.Exp, 0),
+		Correlation:   action.MsgId,
+		ResponseTopic: task.TopicReply(m.topicPrefix, action.Sender),
+	})
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
-func (m *MQTT) Report(selfClientId string, status types.Status) error {
+
+// Report 以保留消息发布自己的状态，同时上报本端支持的协议版本
+func (m *MQTT) Report(selfClientId string, status task.MessageStatus) error {
+	if status.Protocol == 0 {
+		status.Protocol = task.ProtocolLatest
+	}
 	statusJSON, err := json.Marshal(status)
 	if err != nil {
 		return err
 	}
+	m.lastStatusMu.Lock()
+	m.lastStatus = &reportedStatus{clientId: selfClientId, payload: statusJSON}
+	m.lastStatusMu.Unlock()
 	err = m.publish(task.TopicStatus(m.topicPrefix, selfClientId), statusJSON, m.qos, true)
 	if err != nil {
 		return err
@@ -259,26 +845,70 @@ func (m *MQTT) Report(selfClientId string, status types.Status) error {
 
 	return nil
 }
-func (m *MQTT) publish(topic string, payload []byte, qos byte, retain bool) error {
-	token := m.paho.Publish(topic, qos, retain, payload)
-	if token.Wait() && token.Error() != nil {
-		return token.Error()
+
+// ReadStatus 读取指定节点保留在status主题上的最新状态，节点从未上报过状态时会等到ctx结束
+// 状态中带有协议版本时，之后发往该节点的任务按该版本编码
+func (m *MQTT) ReadStatus(ctx context.Context, clientId string) (*task.MessageStatus, error) {
+	topic := task.TopicStatus(m.topicPrefix, clientId)
+	ch := make(chan []byte, 1)
+	err := m.subscribe(topic, m.qos, func(msg Message) {
+		select {
+		case ch <- msg.Payload:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	defer m.unsubscribe(topic)
+
+	select {
+	case data := <-ch:
+		var status task.MessageStatus
+		if err := json.Unmarshal(data, &status); err != nil {
+			return nil, fmt.Errorf("解析状态消息失败: err=%v, message=%s", err, data)
+		}
+		m.learnPeerVersion(clientId, status.Protocol)
+		return &status, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// publish 发布消息，超过maxPacketSize的消息切分为多个分片按顺序发布，接收方订阅时自动重组
+func (m *MQTT) publish(topic string, payload []byte, qos byte, retain bool) error {
+	return m.publishWith(topic, payload, qos, retain, nil)
 }
 
-func (m *MQTT) subscribe(topic string, qos byte, callback pahomqtt.MessageHandler) error {
-	token := m.paho.Subscribe(topic, qos, callback)
-	if token.Wait() && token.Error() != nil {
-		return token.Error()
+// publishWith 发布消息并附带MQTT 5属性，分片时每个分片都带相同的属性
+func (m *MQTT) publishWith(topic string, payload []byte, qos byte, retain bool, opts *PublishOptions) error {
+	if len(payload) <= m.maxPacketSize {
+		return m.transport.Publish(topic, payload, qos, retain, opts)
+	}
+	// 保留消息每个主题只保留最后一条，无法分片
+	if retain {
+		return fmt.Errorf("保留消息长度超过限制，topic=%s, size=%d, max_packet_size=%d", topic, len(payload), m.maxPacketSize)
+	}
+	if len(payload) > maxAssembledSize {
+		return fmt.Errorf("消息长度超过限制，topic=%s, size=%d, max=%d", topic, len(payload), maxAssembledSize)
+	}
+	frames, err := splitChunks(payload, m.maxPacketSize)
+	if err != nil {
+		return err
+	}
+	m.logger.Debug().Msgf("消息分片发送，topic=%s, size=%d, total=%d", topic, len(payload), len(frames))
+	for _, frame := range frames {
+		if err := m.transport.Publish(topic, frame, qos, false, opts); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+func (m *MQTT) subscribe(topic string, qos byte, callback TransportHandler) error {
+	return m.transport.Subscribe(topic, qos, m.reassemble(callback))
+}
+
 func (m *MQTT) unsubscribe(topic string) error {
-	token := m.paho.Unsubscribe(topic)
-	if token.Wait() && token.Error() != nil {
-		return token.Error()
-	}
-	return nil
+	return m.transport.Unsubscribe(topic)
 }
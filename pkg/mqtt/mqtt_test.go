@@ -0,0 +1,324 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+	"github.com/shellus/frp-daemon/pkg/types"
+)
+
+// newHubMQTT 创建通过Hub连接的客户端，setup在Connect之前调用，测试结束时断开
+func newHubMQTT(t *testing.T, hub *Hub, clientId string, setup func(m *MQTT)) *MQTT {
+	t.Helper()
+	m, err := NewMQTTWithTransport(types.MQTTClientOpts{ClientID: clientId, Username: clientId, TopicPrefix: "test"}, hub.Transport(), zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(m)
+	}
+	if err := m.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Disconnect() })
+	return m
+}
+
+// countingHandler 记录每个动作的执行次数，处理器一直执行到release被关闭
+type countingHandler struct {
+	mu      sync.Mutex
+	calls   map[string]int
+	started chan string
+	release chan struct{}
+}
+
+func newCountingHandler() *countingHandler {
+	return &countingHandler{
+		calls:   make(map[string]int),
+		started: make(chan string, 10),
+		release: make(chan struct{}),
+	}
+}
+
+func (h *countingHandler) handle(ctx context.Context, action string, payload []byte) ([]byte, error) {
+	h.mu.Lock()
+	h.calls[action]++
+	h.mu.Unlock()
+	h.started <- action
+	<-h.release
+	return []byte(`"` + action + `"`), nil
+}
+
+func (h *countingHandler) count(action string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls[action]
+}
+
+func newPending(sender, receiver, id, action string) task.MessagePending {
+	return task.MessagePending{
+		MsgId:    id,
+		Sender:   sender,
+		Receiver: receiver,
+		Action:   action,
+		Exp:      time.Now().Add(time.Minute).Unix(),
+	}
+}
+
+func TestRedeliveryWhileRunning(t *testing.T) {
+	hub := NewHub()
+	h := newCountingHandler()
+	newHubMQTT(t, hub, "client", func(m *MQTT) {
+		d, err := NewDedupCache("", DefaultDedupCapacity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.SetDedupCache(d)
+		m.SubscribeAction("wol", h.handle)
+	})
+	ctl := newHubMQTT(t, hub, "ctl", nil)
+
+	msg := newPending("ctl", "client", "a", "wol")
+	waiter, err := ctl.Dispatch(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.Release(waiter)
+	<-h.started
+	// 处理器执行期间重复投递，不应再次执行
+	for i := 0; i < 3; i++ {
+		if err := ctl.RsyncAction(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(h.release)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := waiter.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// 执行完成后的重复投递重发缓存的结果
+	if err := ctl.RsyncAction(msg); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := h.count("wol"); n != 1 {
+		t.Fatalf("重复投递的任务执行了%d次", n)
+	}
+}
+
+func TestDedupPerSender(t *testing.T) {
+	hub := NewHub()
+	h := newCountingHandler()
+	close(h.release)
+	newHubMQTT(t, hub, "client", func(m *MQTT) {
+		d, err := NewDedupCache("", DefaultDedupCapacity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.SetDedupCache(d)
+		m.SubscribeAction("wol", h.handle)
+		m.SubscribeAction("update", h.handle)
+	})
+	ctl := newHubMQTT(t, hub, "ctl", nil)
+	other := newHubMQTT(t, hub, "other", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	tests := []struct {
+		name   string
+		sender *MQTT
+		msg    task.MessagePending
+		value  string
+		code   string
+	}{
+		{"首次执行", ctl, newPending("ctl", "client", "same", "update"), `"update"`, ""},
+		{"其他发送方使用相同ID", other, newPending("other", "client", "same", "wol"), `"wol"`, ""},
+		{"同一发送方的ID被其他动作使用", ctl, newPending("ctl", "client", "same", "wol"), "", task.CodeDuplicateId},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := tt.sender.Call(ctx, tt.msg)
+			if tt.code != "" {
+				if !task.IsCode(err, tt.code) {
+					t.Fatalf("err=%v, want code=%s", err, tt.code)
+				}
+				return
+			}
+			if err != nil || string(value) != tt.value {
+				t.Fatalf("value=%s, err=%v", value, err)
+			}
+		})
+	}
+	if h.count("update") != 1 || h.count("wol") != 1 {
+		t.Fatalf("calls=%v", h.calls)
+	}
+}
+
+func TestSealedTasks(t *testing.T) {
+	key := make([]byte, task.SealKeySize)
+	wrongKey := make([]byte, task.SealKeySize)
+	wrongKey[0] = 1
+	keyring := func(key []byte) *task.Keyring {
+		if key == nil {
+			return nil
+		}
+		k := task.NewKeyring()
+		if err := k.Add("client", key); err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	tests := []struct {
+		name          string
+		senderKey     []byte
+		receiverKey   []byte
+		requireSealed bool
+		code          string
+	}{
+		{"加密", key, key, true, ""},
+		{"未加密且不要求加密", nil, nil, false, ""},
+		{"要求加密时拒绝明文", nil, key, true, task.CodeSealError},
+		{"密钥不一致", wrongKey, key, true, task.CodeSealError},
+		{"接收方没有密钥", key, nil, false, task.CodeSealError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub()
+			h := newCountingHandler()
+			close(h.release)
+			newHubMQTT(t, hub, "client", func(m *MQTT) {
+				if k := keyring(tt.receiverKey); k != nil {
+					m.SetKeyring(k)
+				}
+				m.SetRequireSealed(tt.requireSealed)
+				m.SubscribeAction("update", func(ctx context.Context, action string, payload []byte) ([]byte, error) {
+					if string(payload) != `{"secret":1}` {
+						t.Errorf("处理器收到的负载错误，payload=%s", payload)
+					}
+					return h.handle(ctx, action, payload)
+				})
+			})
+			ctl := newHubMQTT(t, hub, "ctl", func(m *MQTT) {
+				if k := keyring(tt.senderKey); k != nil {
+					m.SetKeyring(k)
+				}
+			})
+			// 旁听任务主题，加密的任务在代理上看不到明文
+			wire := make(chan []byte, 1)
+			observer := hub.Transport()
+			observer.Connect()
+			defer observer.Disconnect()
+			observer.Subscribe(task.TopicPending("test", "client"), 1, func(msg Message) { wire <- msg.Payload })
+
+			msg := newPending("ctl", "client", "a", "update")
+			msg.Payload = []byte(`{"secret":1}`)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err := ctl.Call(ctx, msg)
+			if tt.code != "" {
+				if !task.IsCode(err, tt.code) {
+					t.Fatalf("err=%v, want code=%s", err, tt.code)
+				}
+				if h.count("update") != 0 {
+					t.Fatal("被拒绝的任务不应执行")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var onWire task.MessagePending
+			if err := json.Unmarshal(<-wire, &onWire); err != nil {
+				t.Fatal(err)
+			}
+			if sealed := tt.senderKey != nil; sealed == (string(onWire.Payload) == string(msg.Payload)) {
+				t.Fatalf("任务负载加密=%v，代理上的负载=%s", sealed, onWire.Payload)
+			}
+		})
+	}
+}
+
+func TestPeerVersion(t *testing.T) {
+	m, err := NewMQTTWithTransport(types.MQTTClientOpts{ClientID: "ctl", Username: "ctl"}, NewHub().Transport(), zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetPeerVersion("configured", task.ProtocolV2)
+	m.learnPeerVersion("learned", task.ProtocolV2)
+	m.learnPeerVersion("newer", task.ProtocolLatest+1)
+	m.learnPeerVersion("old", 0)
+	// 配置的版本优先于从状态得知的版本
+	m.SetPeerVersion("both", task.ProtocolV1)
+	m.learnPeerVersion("both", task.ProtocolV2)
+	tests := []struct {
+		peer    string
+		version int
+		known   bool
+	}{
+		{"unknown", task.ProtocolV1, false},
+		{"configured", task.ProtocolV2, true},
+		{"learned", task.ProtocolV2, true},
+		{"newer", task.ProtocolLatest, true},
+		{"old", task.ProtocolV1, false},
+		{"both", task.ProtocolV1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.peer, func(t *testing.T) {
+			if v := m.PeerVersion(tt.peer); v != tt.version {
+				t.Fatalf("version=%d, want=%d", v, tt.version)
+			}
+			if k := m.KnowsPeerVersion(tt.peer); k != tt.known {
+				t.Fatalf("known=%v, want=%v", k, tt.known)
+			}
+		})
+	}
+}
+
+// 对端上报状态之前按v1编码任务，读取状态得知版本后按v2编码，接收方按任务的版本回复
+func TestPeerVersionOnWire(t *testing.T) {
+	hub := NewHub()
+	h := newCountingHandler()
+	close(h.release)
+	client := newHubMQTT(t, hub, "client", func(m *MQTT) {
+		m.SubscribeAction("ping", h.handle)
+	})
+	ctl := newHubMQTT(t, hub, "ctl", nil)
+	wire := make(chan []byte, 2)
+	observer := hub.Transport()
+	observer.Connect()
+	defer observer.Disconnect()
+	observer.Subscribe(task.TopicPending("test", "client"), 1, func(msg Message) { wire <- msg.Payload })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	call := func(id string) int {
+		t.Helper()
+		if _, err := ctl.Call(ctx, newPending("ctl", "client", id, "ping")); err != nil {
+			t.Fatal(err)
+		}
+		var onWire task.MessagePending
+		if err := json.Unmarshal(<-wire, &onWire); err != nil {
+			t.Fatal(err)
+		}
+		return onWire.Version()
+	}
+	if v := call("a"); v != task.ProtocolV1 {
+		t.Fatalf("对端版本未知时按v%d编码", v)
+	}
+	if err := client.Report("client", task.MessageStatus{Time: time.Now().Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctl.ReadStatus(ctx, "client"); err != nil {
+		t.Fatal(err)
+	}
+	if v := call("b"); v != task.ProtocolLatest {
+		t.Fatalf("得知对端版本后按v%d编码", v)
+	}
+}
@@ -0,0 +1,301 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+const (
+	// DefaultOutboxCapacity 发件箱默认最多保存的记录数，每分钟一条状态快照时约可保存一天
+	DefaultOutboxCapacity = 2000
+	// outboxRetryInterval 断线期间检查连接是否恢复的间隔
+	outboxRetryInterval = 5 * time.Second
+)
+
+// outboxFile 发件箱快照，压缩后的日志只有这一行
+type outboxFile struct {
+	NextSeq int64                 `json:"next_seq"`
+	Entries []task.MessageHistory `json:"entries"`
+}
+
+// outboxRecord 发件箱日志中的一行，依次是快照、新增的记录或已发布的序号
+type outboxRecord struct {
+	NextSeq int64                 `json:"next_seq,omitempty"`
+	Entries []task.MessageHistory `json:"entries,omitempty"`
+	Entry   *task.MessageHistory  `json:"entry,omitempty"`
+	Ack     int64                 `json:"ack,omitempty"`
+}
+
+// Outbox 历史记录发件箱，记录先持久化到磁盘，连接可用时按顺序发布，发布成功后移除
+// 断线期间的记录因此不会丢失，超过容量时丢弃最旧的记录并在下一条记录中注明丢弃数量
+// 磁盘上是只追加的日志，新增记录和发布确认各追加一行，全部发布或日志过长时才压缩为一行快照
+type Outbox struct {
+	path     string
+	capacity int
+	mu       sync.Mutex
+	file     outboxFile
+	// logged 上次压缩之后日志追加的行数
+	logged int
+	// wake 有新记录时唤醒发送协程
+	wake chan struct{}
+}
+
+// NewOutbox 创建发件箱并从path加载尚未发布的记录，path为空时只保存在内存中
+func NewOutbox(path string, capacity int) (*Outbox, error) {
+	if capacity <= 0 {
+		return nil, errors.New("outbox capacity must be positive")
+	}
+	o := &Outbox{
+		path:     path,
+		capacity: capacity,
+		file:     outboxFile{NextSeq: 1},
+		wake:     make(chan struct{}, 1),
+	}
+	if path == "" {
+		return o, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return o, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	// 按顺序重放日志，崩溃时最后一行可能没有写完，丢弃这一行
+	decoder := json.NewDecoder(f)
+	for {
+		var record outboxRecord
+		if err := decoder.Decode(&record); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		o.apply(record)
+	}
+	if o.file.NextSeq < 1 {
+		o.file.NextSeq = 1
+	}
+	// 加载后压缩，去掉已确认的记录和不完整的行
+	if err := o.save(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// apply 重放一行日志
+func (o *Outbox) apply(record outboxRecord) {
+	switch {
+	case record.Entry != nil:
+		o.push(*record.Entry)
+		o.file.NextSeq = record.Entry.Seq + 1
+	case record.Ack > 0:
+		o.prune(record.Ack)
+	default:
+		o.file = outboxFile{NextSeq: record.NextSeq, Entries: record.Entries}
+	}
+}
+
+// add 追加一条记录并持久化
+func (o *Outbox) add(kind string, data []byte, now time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entry := task.MessageHistory{
+		Seq:  o.file.NextSeq,
+		Time: now.Unix(),
+		Kind: kind,
+		Data: data,
+	}
+	o.file.NextSeq++
+	o.push(entry)
+	// 日志中记录丢弃之前的原始记录，重放时按同样的容量重新计算丢弃数量
+	err := o.append(outboxRecord{Entry: &entry})
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// push 把记录放入队尾，超过容量时丢弃最旧的记录，调用方需持有锁
+func (o *Outbox) push(entry task.MessageHistory) {
+	if len(o.file.Entries) >= o.capacity {
+		// 丢弃最旧的记录，丢弃数量连同它们之前已丢弃的数量记到保留下来的第一条记录上
+		n := len(o.file.Entries) - o.capacity + 1
+		dropped := n
+		for _, e := range o.file.Entries[:n] {
+			dropped += e.Dropped
+		}
+		o.file.Entries = append(o.file.Entries[:0], o.file.Entries[n:]...)
+		if len(o.file.Entries) > 0 {
+			o.file.Entries[0].Dropped += dropped
+		} else {
+			entry.Dropped += dropped
+		}
+	}
+	o.file.Entries = append(o.file.Entries, entry)
+}
+
+// pending 返回尚未发布的记录
+func (o *Outbox) pending() []task.MessageHistory {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]task.MessageHistory(nil), o.file.Entries...)
+}
+
+// ack 移除序号不大于seq的已发布记录
+func (o *Outbox) ack(seq int64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.prune(seq) {
+		return nil
+	}
+	if len(o.file.Entries) == 0 {
+		// 全部发布后日志只剩下一行快照，连接正常时日志不会增长
+		return o.save()
+	}
+	return o.append(outboxRecord{Ack: seq})
+}
+
+// prune 移除序号不大于seq的记录，返回是否有记录被移除，调用方需持有锁
+func (o *Outbox) prune(seq int64) bool {
+	i := 0
+	for i < len(o.file.Entries) && o.file.Entries[i].Seq <= seq {
+		i++
+	}
+	if i == 0 {
+		return false
+	}
+	o.file.Entries = append(o.file.Entries[:0], o.file.Entries[i:]...)
+	return true
+}
+
+// append 向日志追加一行，日志行数超过容量的两倍时压缩，调用方需持有锁
+func (o *Outbox) append(record outboxRecord) error {
+	if o.path == "" {
+		return nil
+	}
+	if o.logged >= 2*o.capacity {
+		return o.save()
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	o.logged++
+	return err
+}
+
+// save 把日志压缩为一行快照，先写临时文件再重命名，调用方需持有锁
+func (o *Outbox) save() error {
+	if o.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(o.file)
+	if err != nil {
+		return err
+	}
+	tmp := o.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, o.path); err != nil {
+		return err
+	}
+	o.logged = 0
+	return nil
+}
+
+// SetOutbox 设置历史记录发件箱，需要在Connect之前调用
+func (m *MQTT) SetOutbox(outbox *Outbox) {
+	m.outbox = outbox
+}
+
+// Record 记录一条历史，写入发件箱后立即返回，不等待发布，连接断开时不会阻塞
+func (m *MQTT) Record(kind string, v interface{}) error {
+	if m.outbox == nil {
+		return errors.New("未设置历史记录发件箱")
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return m.outbox.add(kind, data, time.Now())
+}
+
+// IsConnected 传输层当前是否已连接，不支持报告连接状态的传输层视为一直连接
+func (m *MQTT) IsConnected() bool {
+	if state, ok := m.transport.(connectionState); ok {
+		return state.IsConnected()
+	}
+	return true
+}
+
+// runOutbox 连接可用时按顺序发布发件箱中的记录，发布失败时停止，等连接恢复后从失败的记录继续
+func (m *MQTT) runOutbox() {
+	ticker := time.NewTicker(outboxRetryInterval)
+	defer ticker.Stop()
+	topic := task.TopicHistory(m.topicPrefix, m.config.Username)
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-m.outbox.wake:
+		case <-ticker.C:
+		}
+		entries := m.outbox.pending()
+		if len(entries) == 0 || !m.IsConnected() {
+			continue
+		}
+		var last int64
+		published := 0
+		for _, entry := range entries {
+			data, err := json.Marshal(entry)
+			if err == nil {
+				err = m.publish(topic, data, m.qos, false)
+			}
+			if err != nil {
+				m.logger.Warn().Msgf("发布历史记录失败，稍后重试，seq=%d, Error=%v", entry.Seq, err)
+				break
+			}
+			last = entry.Seq
+			published++
+		}
+		if last == 0 {
+			continue
+		}
+		if err := m.outbox.ack(last); err != nil {
+			m.logger.Error().Msgf("保存历史记录发件箱失败，Error=%v", err)
+		}
+		if published > 1 {
+			m.logger.Info().Msgf("已补发断线期间的历史记录，count=%d", published)
+		}
+	}
+}
+
+// SubscribeHistory 订阅指定节点的历史记录，使用持久会话时，本端离线期间的记录在重连后由代理投递
+func (m *MQTT) SubscribeHistory(clientId string, handler func(clientId string, msg task.MessageHistory)) error {
+	return m.subscribe(task.TopicHistory(m.topicPrefix, clientId), m.qos, func(msg Message) {
+		var history task.MessageHistory
+		if err := json.Unmarshal(msg.Payload, &history); err != nil {
+			m.logger.Error().Msgf("解析消息失败: err=%v, message=%s", err, msg.Payload)
+			return
+		}
+		handler(clientId, history)
+	})
+}
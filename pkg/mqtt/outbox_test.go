@@ -0,0 +1,200 @@
+package mqtt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+	"github.com/shellus/frp-daemon/pkg/types"
+)
+
+func seqs(entries []task.MessageHistory) []int64 {
+	var s []int64
+	for _, e := range entries {
+		s = append(s, e.Seq)
+	}
+	return s
+}
+
+func equalSeqs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ack移除不大于seq的记录，重新打开后按日志恢复未发布的记录和下一个序号
+func TestOutboxAck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	o, err := NewOutbox(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := o.add("status", []byte(`{}`), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		ack  int64
+		want []int64
+	}{
+		{"没有可移除的记录", 0, []int64{1, 2, 3, 4}},
+		{"移除前两条", 2, []int64{3, 4}},
+		{"重复确认", 1, []int64{3, 4}},
+		{"不连续的序号", 3, []int64{4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := o.ack(tt.ack); err != nil {
+				t.Fatal(err)
+			}
+			if got := seqs(o.pending()); !equalSeqs(got, tt.want) {
+				t.Fatalf("pending=%v, want=%v", got, tt.want)
+			}
+			reopened, err := NewOutbox(path, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := seqs(reopened.pending()); !equalSeqs(got, tt.want) {
+				t.Fatalf("重新打开后pending=%v, want=%v", got, tt.want)
+			}
+		})
+	}
+
+	// 全部发布后日志压缩为一行快照，序号继续递增
+	if err := o.ack(4); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte("\n")); n != 1 {
+		t.Fatalf("全部发布后日志没有压缩，lines=%d, data=%s", n, data)
+	}
+	reopened, err := NewOutbox(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.add("status", []byte(`{}`), now)
+	if got := seqs(reopened.pending()); !equalSeqs(got, []int64{5}) {
+		t.Fatalf("pending=%v, want=[5]", got)
+	}
+}
+
+// 新增记录只追加一行，超过容量时丢弃的数量在重放后不变，不完整的最后一行被丢弃
+func TestOutboxLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	o, err := NewOutbox(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		before, _ := os.ReadFile(path)
+		if err := o.add("status", []byte(`{}`), now); err != nil {
+			t.Fatal(err)
+		}
+		after, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(after, before) || bytes.Count(after[len(before):], []byte("\n")) != 1 {
+			t.Fatalf("新增记录重写了日志，before=%s, after=%s", before, after)
+		}
+	}
+	want := o.pending()
+	if !equalSeqs(seqs(want), []int64{2, 3}) || want[0].Dropped != 1 {
+		t.Fatalf("pending=%+v", want)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"entry":{"seq":4,"ti`)
+	f.Close()
+
+	reopened, err := NewOutbox(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := reopened.pending()
+	if !equalSeqs(seqs(got), []int64{2, 3}) || got[0].Dropped != 1 || got[1].Dropped != 0 {
+		t.Fatalf("重新打开后pending=%+v", got)
+	}
+}
+
+// 断线期间的记录保存在发件箱中，连接恢复后按序号顺序补发并从发件箱中移除
+func TestOutboxFlushOnReconnect(t *testing.T) {
+	broker := &testBroker{hub: NewHub()}
+	outbox, err := NewOutbox(filepath.Join(t.TempDir(), "history.json"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMQTTWithTransport(types.MQTTClientOpts{ClientID: "client", Username: "client", TopicPrefix: "test"},
+		&testBrokerConn{Transport: broker.hub.Transport(), broker: broker}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetOutbox(outbox)
+	if err := m.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Disconnect()
+
+	received := make(chan task.MessageHistory, 10)
+	ctl := newHubMQTT(t, broker.hub, "ctl", nil)
+	if err := ctl.SubscribeHistory("client", func(clientId string, msg task.MessageHistory) { received <- msg }); err != nil {
+		t.Fatal(err)
+	}
+
+	broker.down.Store(true)
+	for _, kind := range []string{"a", "b", "c"} {
+		if err := m.Record(kind, kind); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case msg := <-received:
+		t.Fatalf("断线期间发布了记录，seq=%d", msg.Seq)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := seqs(outbox.pending()); !equalSeqs(got, []int64{1, 2, 3}) {
+		t.Fatalf("pending=%v", got)
+	}
+
+	broker.down.Store(false)
+	if err := m.Record("d", "d"); err != nil {
+		t.Fatal(err)
+	}
+	for i, kind := range []string{"a", "b", "c", "d"} {
+		select {
+		case msg := <-received:
+			if msg.Seq != int64(i+1) || msg.Kind != kind {
+				t.Fatalf("补发顺序错误，seq=%d, kind=%s", msg.Seq, msg.Kind)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("没有收到第%d条记录", i+1)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(outbox.pending()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("发布后没有从发件箱中移除，pending=%v", seqs(outbox.pending()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,71 @@
+package mqtt
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+)
+
+// ActionAll 在SenderPolicy.Actions中表示允许全部动作
+const ActionAll = "*"
+
+// ErrForbidden 发送方不在白名单中或无权调用该动作
+var ErrForbidden = errors.New("无权执行该任务")
+
+// SenderPolicy 单个发送方的授权规则
+type SenderPolicy struct {
+	// Actions 允许调用的动作，包含ActionAll时允许全部动作
+	Actions []string
+	// PublicKey 该发送方的签名公钥，设置后该发送方的任务只接受此公钥的签名，
+	// 避免持有其他受信任密钥的发送方冒充该身份；为nil时使用SetTrustedKeys设置的公钥
+	PublicKey ed25519.PublicKey
+}
+
+// Policy 发送方白名单和动作授权，没有任何规则时允许所有发送方调用所有动作
+type Policy struct {
+	senders map[string]SenderPolicy
+}
+
+// NewPolicy 创建空的授权策略
+func NewPolicy() *Policy {
+	return &Policy{
+		senders: make(map[string]SenderPolicy),
+	}
+}
+
+// Allow 添加发送方授权规则，sender为发送方的MQTT username
+func (p *Policy) Allow(sender string, rule SenderPolicy) {
+	p.senders[sender] = rule
+}
+
+// Authorize 检查发送方是否可以调用该动作
+func (p *Policy) Authorize(sender, action string) error {
+	if p == nil || len(p.senders) == 0 {
+		return nil
+	}
+	rule, ok := p.senders[sender]
+	if !ok {
+		return fmt.Errorf("%w，发送方不在白名单中，sender=%s", ErrForbidden, sender)
+	}
+	for _, allowed := range rule.Actions {
+		if allowed == ActionAll || allowed == action {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w，发送方无权调用该动作，sender=%s, action=%s", ErrForbidden, sender, action)
+}
+
+// restricted 是否配置了发送方白名单
+func (p *Policy) restricted() bool {
+	return p != nil && len(p.senders) > 0
+}
+
+// verifyKeys 返回验证该发送方签名的公钥，发送方配置了专属公钥时只使用专属公钥
+func (p *Policy) verifyKeys(sender string, trusted []ed25519.PublicKey) []ed25519.PublicKey {
+	if p != nil {
+		if rule, ok := p.senders[sender]; ok && rule.PublicKey != nil {
+			return []ed25519.PublicKey{rule.PublicKey}
+		}
+	}
+	return trusted
+}
@@ -0,0 +1,137 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+func TestPolicyAuthorize(t *testing.T) {
+	policy := NewPolicy()
+	policy.Allow("monitor", SenderPolicy{Actions: []string{"ping", "get_status"}})
+	policy.Allow("ctl", SenderPolicy{Actions: []string{ActionAll}})
+	tests := []struct {
+		name   string
+		policy *Policy
+		sender string
+		action string
+		ok     bool
+	}{
+		{"未设置策略", nil, "anyone", "update", true},
+		{"没有规则", NewPolicy(), "anyone", "update", true},
+		{"发送方不在白名单中", policy, "other", "ping", false},
+		{"允许的动作", policy, "monitor", "ping", true},
+		{"未授权的动作", policy, "monitor", "update", false},
+		{"允许全部动作", policy, "ctl", "update", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Authorize(tt.sender, tt.action)
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrForbidden) {
+				t.Fatalf("err=%v, want=%v", err, ErrForbidden)
+			}
+		})
+	}
+}
+
+func TestPolicyVerifyKeys(t *testing.T) {
+	trusted, _, _ := ed25519.GenerateKey(nil)
+	own, _, _ := ed25519.GenerateKey(nil)
+	policy := NewPolicy()
+	policy.Allow("monitor", SenderPolicy{Actions: []string{"ping"}, PublicKey: own})
+	policy.Allow("ctl", SenderPolicy{Actions: []string{ActionAll}})
+	tests := []struct {
+		name    string
+		policy  *Policy
+		sender  string
+		trusted []ed25519.PublicKey
+		want    []ed25519.PublicKey
+	}{
+		{"未设置策略", nil, "ctl", []ed25519.PublicKey{trusted}, []ed25519.PublicKey{trusted}},
+		{"专属公钥", policy, "monitor", []ed25519.PublicKey{trusted}, []ed25519.PublicKey{own}},
+		{"没有专属公钥", policy, "ctl", []ed25519.PublicKey{trusted}, []ed25519.PublicKey{trusted}},
+		{"没有可用的公钥", policy, "ctl", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.verifyKeys(tt.sender, tt.trusted)
+			if len(got) != len(tt.want) {
+				t.Fatalf("keys=%v, want=%v", got, tt.want)
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Fatalf("keys=%v, want=%v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// 被控端按白名单、专属公钥和动作授权拒绝任务，回复对应的错误码
+func TestPolicyRejects(t *testing.T) {
+	ctlPub, ctlKey, _ := ed25519.GenerateKey(nil)
+	monitorPub, monitorKey, _ := ed25519.GenerateKey(nil)
+	tests := []struct {
+		name    string
+		sender  string
+		key     ed25519.PrivateKey
+		trusted bool // 被控端是否信任控制端的公钥
+		action  string
+		code    string
+	}{
+		{"允许的动作", "monitor", monitorKey, true, "ping", ""},
+		{"未授权的动作", "monitor", monitorKey, true, "update", task.CodeForbidden},
+		{"发送方不在白名单中", "other", ctlKey, true, "ping", task.CodeForbidden},
+		{"冒充有专属公钥的发送方", "monitor", ctlKey, true, "ping", task.CodeBadSignature},
+		{"未签名", "ctl", nil, true, "update", task.CodeBadSignature},
+		{"发送方没有可用的验签公钥", "ctl", nil, false, "update", task.CodeBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub()
+			h := newCountingHandler()
+			close(h.release)
+			newHubMQTT(t, hub, "client", func(m *MQTT) {
+				if tt.trusted {
+					m.SetTrustedKeys(ctlPub)
+				}
+				policy := NewPolicy()
+				policy.Allow("ctl", SenderPolicy{Actions: []string{ActionAll}})
+				policy.Allow("monitor", SenderPolicy{Actions: []string{"ping"}, PublicKey: monitorPub})
+				m.SetPolicy(policy)
+				m.SubscribeAction("ping", h.handle)
+				m.SubscribeAction("update", h.handle)
+			})
+			sender := newHubMQTT(t, hub, tt.sender, func(m *MQTT) {
+				if tt.key != nil {
+					m.SetSigningKey(tt.key)
+				}
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err := sender.Call(ctx, newPending(tt.sender, "client", "a", tt.action))
+			if tt.code == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !task.IsCode(err, tt.code) {
+				t.Fatalf("err=%v, want code=%s", err, tt.code)
+			}
+			if h.count(tt.action) != 0 {
+				t.Fatal("被拒绝的任务不应执行")
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+// progressInterval 同一阶段内两次进度上报的最小间隔，阶段变化和100%总是立即上报
+const progressInterval = 500 * time.Millisecond
+
+// taskContextKey 处理器ctx中保存正在执行任务的键
+type taskContextKey struct{}
+
+// taskContext 正在执行的任务，用于处理器上报进度和发送流式数据
+type taskContext struct {
+	m   *MQTT
+	msg task.MessagePending
+
+	mu          sync.Mutex
+	lastPercent int
+	lastPhase   string
+	lastTime    time.Time
+
+	// emitMu 保证流式数据的序号和发布顺序一致
+	emitMu sync.Mutex
+	seq    int
+}
+
+// withTask 返回携带正在执行任务的ctx
+func withTask(ctx context.Context, m *MQTT, msg task.MessagePending) (context.Context, *taskContext) {
+	tc := &taskContext{m: m, msg: msg, lastPercent: -2}
+	return context.WithValue(ctx, taskContextKey{}, tc), tc
+}
+
+// MessageIdFromContext 返回处理器ctx对应的任务消息ID
+func MessageIdFromContext(ctx context.Context) (string, bool) {
+	tc, ok := ctx.Value(taskContextKey{}).(*taskContext)
+	if !ok {
+		return "", false
+	}
+	return tc.msg.MsgId, true
+}
+
+// ReportProgress 在处理器中上报执行进度到任务发送方，percent为0-100，无法估计时传-1
+// ctx必须是传给MessageHandler的ctx，上报过于频繁时会被节流，可以在下载回调中直接调用
+func ReportProgress(ctx context.Context, percent int, phase string) error {
+	tc, ok := ctx.Value(taskContextKey{}).(*taskContext)
+	if !ok {
+		return errors.New("ctx不是任务处理器的ctx，无法上报进度")
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	if percent < -1 {
+		percent = -1
+	}
+
+	now := time.Now()
+	tc.mu.Lock()
+	if phase == tc.lastPhase && (percent == tc.lastPercent || (percent != 100 && now.Sub(tc.lastTime) < progressInterval)) {
+		tc.mu.Unlock()
+		return nil
+	}
+	tc.lastPercent, tc.lastPhase, tc.lastTime = percent, phase, now
+	tc.mu.Unlock()
+
+	data, err := json.Marshal(task.MessageProgress{
+		MsgId:   tc.msg.MsgId,
+		Percent: percent,
+		Phase:   phase,
+		Time:    now.UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+	// 进度只用于展示，使用QoS 0，发送方离线时不需要保留
+	return tc.m.publishWith(tc.m.replyTopic(tc.msg, task.ReplyProgress), data, 0, false, replyOptions(tc.msg))
+}
+
+func (m *MQTT) onTopicProgress(msg task.MessageProgress) {
+	if !m.waiters.Progress(msg) {
+		m.logger.Debug().Msgf("收到无等待器的进度，messageId=%s, phase=%s, percent=%d", msg.MsgId, msg.Phase, msg.Percent)
+	}
+}
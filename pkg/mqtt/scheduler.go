@@ -0,0 +1,416 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+const (
+	// DefaultScheduleCapacity 默认最多保存的定时任务数量
+	DefaultScheduleCapacity = 64
+	// scheduleRetention 一次性定时任务执行完成后保留的时间，期间控制端可以查看执行结果
+	scheduleRetention = 24 * time.Hour
+	// scheduleMissGrace cron任务错过执行时间超过该值时不再补执行，直接等待下一次
+	scheduleMissGrace = time.Minute
+)
+
+// ErrScheduleFull 定时任务数量已达上限
+var ErrScheduleFull = errors.New("定时任务数量已达上限")
+
+// ScheduleResult 接收方保存定时任务后的回复
+type ScheduleResult struct {
+	Scheduled bool  `json:"scheduled"`
+	NextRun   int64 `json:"next_run"` // 下次执行时间戳，单位为秒
+}
+
+// ScheduleInfo 定时任务的执行情况，由ActionSchedules返回
+type ScheduleInfo struct {
+	MessageId string `json:"message_id"`
+	Action    string `json:"action"`
+	NotBefore int64  `json:"not_before,omitempty"`
+	Cron      string `json:"cron,omitempty"`
+	NextRun   int64  `json:"next_run"`             // 下次执行时间戳，为0表示一次性任务已执行完成
+	LastRun   int64  `json:"last_run,omitempty"`   // 上次开始执行的时间戳
+	LastError string `json:"last_error,omitempty"` // 上次执行的错误，为空表示成功
+	LastCode  string `json:"last_code,omitempty"`  // 上次执行错误的错误码
+	Runs      int    `json:"runs"`                 // 已执行次数
+}
+
+// scheduledTask 持久化的定时任务，Msg是验签和解密之后的任务
+type scheduledTask struct {
+	Msg       task.MessagePending `json:"msg"`
+	NextRun   int64               `json:"next_run"`
+	LastRun   int64               `json:"last_run,omitempty"`
+	LastError string              `json:"last_error,omitempty"`
+	LastCode  string              `json:"last_code,omitempty"`
+	Runs      int                 `json:"runs"`
+}
+
+func (t *scheduledTask) info() ScheduleInfo {
+	return ScheduleInfo{
+		MessageId: t.Msg.MsgId,
+		Action:    t.Msg.Action,
+		NotBefore: t.Msg.NotBefore,
+		Cron:      t.Msg.Cron,
+		NextRun:   t.NextRun,
+		LastRun:   t.LastRun,
+		LastError: t.LastError,
+		LastCode:  t.LastCode,
+		Runs:      t.Runs,
+	}
+}
+
+// Scheduler 接收方保存的定时任务，持久化到磁盘，进程重启后继续按时执行
+// 负载以解密后的明文保存，文件权限为0600
+type Scheduler struct {
+	path     string
+	capacity int
+	mu       sync.Mutex
+	tasks    map[string]*scheduledTask
+	// wake 任务增删后唤醒执行协程重新计算等待时间
+	wake chan struct{}
+}
+
+// NewScheduler 创建定时任务存储并从path加载已有任务，path为空时只保存在内存中
+func NewScheduler(path string, capacity int) (*Scheduler, error) {
+	if capacity <= 0 {
+		return nil, errors.New("schedule capacity must be positive")
+	}
+	s := &Scheduler{
+		path:     path,
+		capacity: capacity,
+		tasks:    make(map[string]*scheduledTask),
+		wake:     make(chan struct{}, 1),
+	}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	var tasks []*scheduledTask
+	if err := json.Unmarshal(data, &tasks); err != nil {
+		return nil, err
+	}
+	for _, t := range tasks {
+		s.tasks[t.Msg.MsgId] = t
+	}
+	return s, nil
+}
+
+// nextRun 计算任务在now之后的执行时间，一次性任务返回NotBefore
+func nextRun(msg task.MessagePending, now time.Time) (time.Time, error) {
+	if msg.Cron == "" {
+		return time.Unix(msg.NotBefore, 0), nil
+	}
+	cron, err := parseCron(msg.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	from := now
+	if notBefore := time.Unix(msg.NotBefore, 0); notBefore.After(from) {
+		from = notBefore.Add(-time.Minute)
+	}
+	next := cron.next(from)
+	if next.IsZero() {
+		return time.Time{}, fmt.Errorf("cron表达式不会触发，cron=%s", msg.Cron)
+	}
+	return next, nil
+}
+
+// add 保存定时任务，同一任务重复添加时返回已保存的执行时间
+func (s *Scheduler) add(msg task.MessagePending, now time.Time) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[msg.MsgId]; ok {
+		return time.Unix(t.NextRun, 0), nil
+	}
+	next, err := nextRun(msg, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	s.prune(now)
+	if len(s.tasks) >= s.capacity {
+		return time.Time{}, fmt.Errorf("%w，capacity=%d", ErrScheduleFull, s.capacity)
+	}
+	s.tasks[msg.MsgId] = &scheduledTask{Msg: msg, NextRun: next.Unix()}
+	if err := s.save(); err != nil {
+		delete(s.tasks, msg.MsgId)
+		return time.Time{}, err
+	}
+	s.notify()
+	return next, nil
+}
+
+// remove 移除发送方为sender的定时任务，已执行完成的一次性任务不算
+func (s *Scheduler) remove(msgId, sender string) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[msgId]
+	if !ok || t.Msg.Sender != sender || t.NextRun == 0 {
+		return false, nil
+	}
+	delete(s.tasks, msgId)
+	s.notify()
+	return true, s.save()
+}
+
+// list 返回发送方为sender的定时任务，按下次执行时间排序，已完成的一次性任务排在最后
+func (s *Scheduler) list(sender string) []ScheduleInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	infos := make([]ScheduleInfo, 0)
+	for _, t := range s.tasks {
+		if t.Msg.Sender == sender {
+			infos = append(infos, t.info())
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		a, b := infos[i].NextRun, infos[j].NextRun
+		if (a == 0) != (b == 0) {
+			return b == 0
+		}
+		if a != b {
+			return a < b
+		}
+		return infos[i].MessageId < infos[j].MessageId
+	})
+	return infos
+}
+
+// due 取出已到执行时间的任务并推进下次执行时间，返回最近一次待执行的时间，没有待执行任务时返回零值
+// 一次性任务错过执行时间时仍会执行，cron任务错过超过scheduleMissGrace时跳到下一次
+func (s *Scheduler) due(now time.Time, logf func(format string, v ...interface{})) ([]task.MessagePending, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var runs []task.MessagePending
+	var wait time.Time
+	changed := false
+	for _, t := range s.tasks {
+		if t.NextRun == 0 {
+			continue
+		}
+		next := time.Unix(t.NextRun, 0)
+		if next.After(now) {
+			if wait.IsZero() || next.Before(wait) {
+				wait = next
+			}
+			continue
+		}
+		changed = true
+		if t.Msg.Cron == "" {
+			t.NextRun = 0
+			t.LastRun = now.Unix()
+			t.Runs++
+			runs = append(runs, t.Msg)
+			continue
+		}
+		if now.Sub(next) <= scheduleMissGrace {
+			t.LastRun = now.Unix()
+			t.Runs++
+			runs = append(runs, t.Msg)
+		} else {
+			logf("定时任务错过执行时间，等待下一次，messageId=%s, nextRun=%s", t.Msg.MsgId, next.Format(time.DateTime))
+		}
+		if n, err := nextRun(t.Msg, now); err == nil {
+			t.NextRun = n.Unix()
+			if wait.IsZero() || n.Before(wait) {
+				wait = n
+			}
+		} else {
+			t.NextRun = 0
+		}
+	}
+	if changed {
+		if err := s.save(); err != nil {
+			logf("保存定时任务失败，Error=%v", err)
+		}
+	}
+	return runs, wait
+}
+
+// done 记录一次执行的结果
+func (s *Scheduler) done(msgId string, err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[msgId]
+	if !ok {
+		return nil
+	}
+	t.LastError, t.LastCode = "", ""
+	if err != nil {
+		remote := task.AsRemoteError(err)
+		t.LastError, t.LastCode = remote.Message, remote.Code
+	}
+	return s.save()
+}
+
+// prune 移除执行完成超过scheduleRetention的一次性任务，调用方需持有锁
+func (s *Scheduler) prune(now time.Time) {
+	for id, t := range s.tasks {
+		if t.NextRun == 0 && now.Sub(time.Unix(t.LastRun, 0)) > scheduleRetention {
+			delete(s.tasks, id)
+		}
+	}
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// save 先写临时文件再重命名，调用方需持有锁
+func (s *Scheduler) save() error {
+	if s.path == "" {
+		return nil
+	}
+	tasks := make([]*scheduledTask, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		tasks = append(tasks, t)
+	}
+	data, err := json.Marshal(tasks)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// SetScheduler 设置定时任务存储，需要在Connect之前调用，未设置时带NotBefore或Cron的任务回复不支持
+func (m *MQTT) SetScheduler(scheduler *Scheduler) {
+	m.scheduler = scheduler
+}
+
+// runSchedules 按时把到期的定时任务交给调度器执行，执行结果只记录在定时任务中，不回复发送方
+func (m *MQTT) runSchedules() {
+	logf := func(format string, v ...interface{}) { m.logger.Warn().Msgf(format, v...) }
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-timer.C:
+		case <-m.scheduler.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+		runs, wait := m.scheduler.due(time.Now(), logf)
+		for _, msg := range runs {
+			m.runScheduled(msg)
+		}
+		// 没有待执行任务时也定期检查，系统时间被调整后不会一直等下去
+		d := time.Minute
+		if !wait.IsZero() && time.Until(wait) < d {
+			d = time.Until(wait)
+		}
+		timer.Reset(d)
+	}
+}
+
+// runScheduled 提交一次定时执行，上一次执行还未结束时跳过本次
+func (m *MQTT) runScheduled(msg task.MessagePending) {
+	callback, ok := m.subscribeActionArr[msg.Action]
+	if !ok {
+		m.recordScheduled(msg, task.NewRemoteError(task.CodeUnsupportedAction, fmt.Sprintf("不支持的动作，action=%s", msg.Action)))
+		return
+	}
+	var key string
+	if fn, ok := m.orderKeys[msg.Action]; ok {
+		key = fn(msg.Action, msg.Payload)
+	}
+	m.logger.Info().Msgf("执行定时任务，messageId=%s, action=%s, sender=%s", msg.MsgId, msg.Action, msg.Sender)
+	submitted, err := m.dispatcher.submit(job{msg: msg, callback: callback, key: key, done: func(value []byte, err error) {
+		m.recordScheduled(msg, err)
+	}})
+	if err != nil {
+		m.recordScheduled(msg, task.NewRemoteError(task.CodeQueueFull, err.Error()))
+		return
+	}
+	if !submitted {
+		m.logger.Warn().Msgf("定时任务上一次执行尚未结束，跳过本次，messageId=%s", msg.MsgId)
+	}
+}
+
+func (m *MQTT) recordScheduled(msg task.MessagePending, err error) {
+	if err != nil {
+		m.logger.Error().Msgf("定时任务执行失败，messageId=%s, action=%s, Err=%v", msg.MsgId, msg.Action, err)
+	} else {
+		m.logger.Info().Msgf("定时任务执行完成，messageId=%s, action=%s", msg.MsgId, msg.Action)
+	}
+	if saveErr := m.scheduler.done(msg.MsgId, err); saveErr != nil {
+		m.logger.Error().Msgf("保存定时任务失败，messageId=%s, Err=%v", msg.MsgId, saveErr)
+	}
+}
+
+// schedule 保存带NotBefore或Cron的任务并回复下次执行时间，返回false表示任务应立即执行
+func (m *MQTT) schedule(msg task.MessagePending, now time.Time) bool {
+	if msg.Cron == "" && !time.Unix(msg.NotBefore, 0).After(now) {
+		return false
+	}
+	if m.scheduler == nil {
+		m.finish(msg, nil, task.NewRemoteError(task.CodeUnsupportedAction, "接收方未启用定时任务"))
+		return true
+	}
+	if msg.Stream {
+		m.finish(msg, nil, task.NewRemoteError(task.CodeInvalidPayload, "定时任务不支持流式结果"))
+		return true
+	}
+	next, err := m.scheduler.add(msg, now)
+	if err != nil {
+		code := task.CodeInvalidPayload
+		if errors.Is(err, ErrScheduleFull) {
+			code = task.CodeQueueFull
+		}
+		m.logger.Error().Msgf("保存定时任务失败，messageId=%s, action=%s, Err=%v", msg.MsgId, msg.Action, err)
+		m.finish(msg, nil, task.NewRemoteError(code, err.Error()))
+		return true
+	}
+	m.logger.Info().Msgf("保存定时任务，messageId=%s, action=%s, nextRun=%s, cron=%s", msg.MsgId, msg.Action, next.Format(time.DateTime), msg.Cron)
+	value, err := json.Marshal(ScheduleResult{Scheduled: true, NextRun: next.Unix()})
+	if err != nil {
+		m.finish(msg, nil, err)
+		return true
+	}
+	m.finish(msg, value, nil)
+	return true
+}
+
+// handleSchedules 处理内置的列出定时任务动作
+func (m *MQTT) handleSchedules(msg task.MessagePending) {
+	m.ack(msg)
+	if m.scheduler == nil {
+		m.replyFailed(msg, task.NewRemoteError(task.CodeUnsupportedAction, "接收方未启用定时任务"))
+		return
+	}
+	value, err := json.Marshal(m.scheduler.list(msg.Sender))
+	if err != nil {
+		m.replyFailed(msg, err)
+		return
+	}
+	m.reply(msg, value, nil)
+}
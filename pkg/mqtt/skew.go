@@ -0,0 +1,82 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+// DefaultClockSkewTolerance 默认容忍的时钟偏差，任务在过期时间之后的这段时间内仍会执行
+const DefaultClockSkewTolerance = 2 * time.Minute
+
+// skewSampleMaxLifetime 只用有效期不超过该值的任务测量时钟偏差
+// 有效期很长的任务可能在代理暂存数天后才投递，收到时间和发送时间的差主要是投递延迟而不是时钟偏差
+const skewSampleMaxLifetime = 5 * time.Minute
+
+// ClockSkew 最近一次测得的时钟偏差
+type ClockSkew struct {
+	Peer string        // 任务发送方
+	Skew time.Duration // 本地时钟减去发送方时间戳，正数表示本地时钟快于发送方，包含投递延迟
+	At   time.Time     // 测量时间
+}
+
+// skewTracker 记录各发送方的时钟偏差
+type skewTracker struct {
+	mu    sync.Mutex
+	peers map[string]ClockSkew
+	last  ClockSkew
+}
+
+func newSkewTracker() *skewTracker {
+	return &skewTracker{peers: make(map[string]ClockSkew)}
+}
+
+// observe 根据任务的发送时间戳测量时钟偏差，没有时间戳或有效期过长的任务不测量
+func (s *skewTracker) observe(msg task.MessagePending, now time.Time) (ClockSkew, bool) {
+	if msg.Time == 0 || time.Duration(msg.Exp-msg.Time)*time.Second > skewSampleMaxLifetime {
+		return ClockSkew{}, false
+	}
+	skew := ClockSkew{
+		Peer: msg.Sender,
+		Skew: now.Sub(time.Unix(msg.Time, 0)).Truncate(time.Second),
+		At:   now,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[msg.Sender] = skew
+	s.last = skew
+	return skew, true
+}
+
+// ClockSkew 返回与指定发送方最近一次测得的时钟偏差
+func (m *MQTT) ClockSkew(peer string) (ClockSkew, bool) {
+	m.skews.mu.Lock()
+	defer m.skews.mu.Unlock()
+	skew, ok := m.skews.peers[peer]
+	return skew, ok
+}
+
+// LastClockSkew 返回最近一次测得的时钟偏差，不区分发送方
+func (m *MQTT) LastClockSkew() (ClockSkew, bool) {
+	m.skews.mu.Lock()
+	defer m.skews.mu.Unlock()
+	return m.skews.last, !m.skews.last.At.IsZero()
+}
+
+// expired 判断任务是否已过期，在过期时间之后的容忍范围内仍视为有效
+// 两端时钟不一致时，直接比较发送方的过期时间和本地时间会把有效任务当作过期丢弃
+func (m *MQTT) expired(msg task.MessagePending, now time.Time) bool {
+	return now.After(time.Unix(msg.Exp, 0).Add(m.skewTolerance))
+}
+
+// checkSkew 测量时钟偏差，超过容忍范围时记录警告，提示检查两端的系统时间
+func (m *MQTT) checkSkew(msg task.MessagePending, now time.Time) {
+	skew, ok := m.skews.observe(msg, now)
+	if !ok {
+		return
+	}
+	if skew.Skew > m.skewTolerance || -skew.Skew > m.skewTolerance {
+		m.logger.Warn().Msgf("与发送方的时钟偏差超过容忍范围，请检查系统时间，sender=%s, skew=%s, tolerance=%s", msg.Sender, skew.Skew, m.skewTolerance)
+	}
+}
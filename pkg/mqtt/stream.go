@@ -0,0 +1,261 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+// ErrNotStreaming 任务不是以流式方式调用的，处理器不能发送流式数据
+var ErrNotStreaming = errors.New("任务不是流式调用")
+
+// streamEndGrace 流的结束标记和complete/failed响应走不同主题，先到的一方等待另一方的最长时间
+const streamEndGrace = 10 * time.Second
+
+// streamIdleTimeout 流式任务的等待器在最后一次收到数据或调用方读取之后保持有效的时间
+const streamIdleTimeout = time.Minute
+
+// Emit 在处理器中向调用方发送一段流式数据，ctx必须是传给MessageHandler的ctx
+// 数据按调用顺序编号，处理器返回后自动发送结束标记；调用方取消后ctx会被取消，处理器应当尽快返回
+func Emit(ctx context.Context, data []byte) error {
+	tc, ok := ctx.Value(taskContextKey{}).(*taskContext)
+	if !ok {
+		return errors.New("ctx不是任务处理器的ctx，无法发送流式数据")
+	}
+	if !tc.msg.Stream {
+		return ErrNotStreaming
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// 持锁发布，保证序号和发布顺序一致
+	tc.emitMu.Lock()
+	defer tc.emitMu.Unlock()
+	if err := tc.m.publishStream(tc.msg, tc.seq, data, false); err != nil {
+		return err
+	}
+	tc.seq++
+	return nil
+}
+
+// endStream 处理器返回后发送结束标记，Seq为已发送的数据段数量
+func (m *MQTT) endStream(tc *taskContext) {
+	tc.emitMu.Lock()
+	defer tc.emitMu.Unlock()
+	if err := m.publishStream(tc.msg, tc.seq, nil, true); err != nil {
+		m.logger.Error().Msgf("发送流结束标记失败，messageId=%s, Err=%v", tc.msg.MsgId, err)
+	}
+}
+
+func (m *MQTT) publishStream(msg task.MessagePending, seq int, data []byte, end bool) error {
+	streamMsg := task.MessageStream{
+		MsgId: msg.MsgId,
+		Seq:   seq,
+		End:   end,
+	}
+	if !end {
+		streamMsg.Data, streamMsg.Enc = m.sealReply(msg, streamPurpose(seq), data)
+	}
+	jsonData, err := json.Marshal(streamMsg)
+	if err != nil {
+		return err
+	}
+	return m.publishWith(m.replyTopic(msg, task.ReplyStream), jsonData, m.qos, false, replyOptions(msg))
+}
+
+func streamPurpose(seq int) string {
+	return fmt.Sprintf("%s/%d", task.SealStream, seq)
+}
+
+// Stream 流式调用的接收端，数据段按序号重排后交付
+type Stream struct {
+	m      *MQTT
+	msg    task.MessagePending
+	waiter *task.Waiter
+
+	mu      sync.Mutex
+	next    int            // 下一个要交付的序号
+	pending map[int][]byte // 提前到达的数据段
+	ready   [][]byte       // 已按顺序排好、等待读取的数据段
+	end     int            // 结束标记的序号，-1表示还没收到
+	final   error          // 流结束后Recv返回的错误
+	notify  chan struct{}
+}
+
+// OpenStream 以流式方式发布任务，调用方通过Recv逐段读取处理器发送的数据
+// action.Exp只限制任务的投递期限，流开始后持续到处理器返回或调用方取消，
+// 收到数据或调用方仍在Recv时推迟等待器的过期时间
+// 调用方用完后必须调用Close
+func (m *MQTT) OpenStream(action task.MessagePending) (*Stream, error) {
+	action.Stream = true
+	s := &Stream{
+		m:       m,
+		msg:     action,
+		pending: make(map[int][]byte),
+		end:     -1,
+		notify:  make(chan struct{}, 1),
+	}
+	m.streamMu.Lock()
+	if _, exists := m.streams[action.MsgId]; exists {
+		m.streamMu.Unlock()
+		return nil, fmt.Errorf("流已存在，messageId=%s", action.MsgId)
+	}
+	m.streams[action.MsgId] = s
+	m.streamMu.Unlock()
+
+	waiter, err := m.Dispatch(action)
+	if err != nil {
+		m.removeStream(action.MsgId)
+		return nil, err
+	}
+	// 数据段可能在Dispatch返回之前到达，deliver持锁读取waiter
+	s.mu.Lock()
+	s.waiter = waiter
+	s.mu.Unlock()
+	return s, nil
+}
+
+// MessageId 返回流对应的任务消息ID
+func (s *Stream) MessageId() string {
+	return s.msg.MsgId
+}
+
+// Waiter 返回流对应任务的等待器，可用于等待ack
+func (s *Stream) Waiter() *task.Waiter {
+	return s.waiter
+}
+
+// Recv 按顺序读取下一段数据，流正常结束时返回io.EOF，处理器返回错误时返回该错误
+// 不支持流式的旧版本接收方不会发送结束标记，此时收到complete/failed响应后视为流结束
+// 流结束后streamEndGrace内仍未收到complete/failed响应时返回task.ErrTimeout
+func (s *Stream) Recv(ctx context.Context) ([]byte, error) {
+	done := s.waiter.Done()
+	var grace <-chan time.Time
+	keepalive := time.NewTicker(streamIdleTimeout / 2)
+	defer keepalive.Stop()
+	for {
+		// 调用方仍在读取，等待器不能在流结束之前过期
+		s.waiter.Extend(time.Now().Add(streamIdleTimeout))
+		s.mu.Lock()
+		if len(s.ready) > 0 {
+			data := s.ready[0]
+			s.ready[0] = nil
+			s.ready = s.ready[1:]
+			s.mu.Unlock()
+			return data, nil
+		}
+		if s.final != nil {
+			err := s.final
+			s.mu.Unlock()
+			return nil, err
+		}
+		ended := s.end >= 0 && s.next >= s.end
+		s.mu.Unlock()
+		if ended {
+			return nil, s.finish(ctx)
+		}
+
+		select {
+		case <-s.notify:
+		case <-done:
+			done = nil
+			timer := time.NewTimer(streamEndGrace)
+			defer timer.Stop()
+			grace = timer.C
+		case <-grace:
+			return nil, s.finish(ctx)
+		case <-keepalive.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// finish 读取任务结果作为流的最终状态
+func (s *Stream) finish(ctx context.Context) error {
+	_, err := s.waiter.WaitComplete(ctx, streamEndGrace)
+	if err == nil {
+		err = io.EOF
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	s.mu.Lock()
+	s.final = err
+	s.mu.Unlock()
+	return err
+}
+
+// Cancel 通知接收方取消正在执行的处理器，之后仍可以继续Recv直到流结束
+func (s *Stream) Cancel() error {
+	return s.m.Cancel(s.msg.Receiver, s.msg.MsgId)
+}
+
+// Close 停止接收流数据并释放等待器，不会通知接收方，需要停止处理器时先调用Cancel
+func (s *Stream) Close() {
+	s.m.removeStream(s.msg.MsgId)
+	if s.waiter != nil {
+		s.m.Release(s.waiter)
+	}
+}
+
+// deliver 收到一段数据或结束标记，重复投递的数据段被忽略
+func (s *Stream) deliver(msg task.MessageStream, data []byte) {
+	s.mu.Lock()
+	if s.waiter != nil {
+		s.waiter.Extend(time.Now().Add(streamIdleTimeout))
+	}
+	if msg.End {
+		s.end = msg.Seq
+	} else if msg.Seq >= s.next {
+		if _, exists := s.pending[msg.Seq]; !exists {
+			s.pending[msg.Seq] = data
+		}
+	}
+	for {
+		data, ok := s.pending[s.next]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.next)
+		s.ready = append(s.ready, data)
+		s.next++
+	}
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (m *MQTT) removeStream(msgId string) {
+	m.streamMu.Lock()
+	defer m.streamMu.Unlock()
+	delete(m.streams, msgId)
+}
+
+func (m *MQTT) onTopicStream(msg task.MessageStream) {
+	m.streamMu.Lock()
+	s, ok := m.streams[msg.MsgId]
+	m.streamMu.Unlock()
+	if !ok {
+		m.logger.Debug().Msgf("收到无接收端的流数据，messageId=%s, seq=%d", msg.MsgId, msg.Seq)
+		return
+	}
+	var data []byte
+	if !msg.End {
+		var err error
+		data, err = m.openReply(msg.MsgId, msg.Enc, streamPurpose(msg.Seq), msg.Data)
+		if err != nil {
+			m.logger.Error().Msgf("流数据解密失败，丢弃，messageId=%s, seq=%d, Err=%v", msg.MsgId, msg.Seq, err)
+			return
+		}
+	}
+	s.deliver(msg, data)
+}
@@ -0,0 +1,78 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+// 流持续到任务的过期时间之后，等待器不会被清理，处理器的错误原样返回而不是io.EOF
+func TestStreamOutlivesExpiration(t *testing.T) {
+	hub := NewHub()
+	release := make(chan struct{})
+	newHubMQTT(t, hub, "client", func(m *MQTT) {
+		m.SubscribeAction("follow", func(ctx context.Context, action string, payload []byte) ([]byte, error) {
+			if err := Emit(ctx, []byte("a")); err != nil {
+				return nil, err
+			}
+			<-release
+			if err := Emit(ctx, []byte("b")); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("boom")
+		})
+	})
+	ctl := newHubMQTT(t, hub, "ctl", nil)
+
+	msg := newPending("ctl", "client", "a", "follow")
+	msg.Exp = time.Now().Add(time.Second).Unix()
+	stream, err := ctl.OpenStream(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if data, err := stream.Recv(ctx); err != nil || string(data) != "a" {
+		t.Fatalf("data=%s, err=%v", data, err)
+	}
+	time.Sleep(time.Until(time.Unix(msg.Exp, 0).Add(100 * time.Millisecond)))
+	ctl.waiters.Sweep(time.Now())
+	close(release)
+	if data, err := stream.Recv(ctx); err != nil || string(data) != "b" {
+		t.Fatalf("data=%s, err=%v", data, err)
+	}
+	_, err = stream.Recv(ctx)
+	if err == io.EOF || !task.IsCode(err, task.CodeInternal) {
+		t.Fatalf("err=%v, want=boom", err)
+	}
+	// 流结束后再次读取返回相同的错误
+	if _, again := stream.Recv(ctx); again == nil || again.Error() != err.Error() {
+		t.Fatalf("err=%v, want=%v", again, err)
+	}
+}
+
+func TestWaiterExtend(t *testing.T) {
+	registry := task.NewRegistry()
+	now := time.Now()
+	w := task.NewWaiter("a", now.Add(time.Second))
+	if err := registry.Add(w); err != nil {
+		t.Fatal(err)
+	}
+	// 早于当前过期时间的推迟被忽略
+	w.Extend(now)
+	w.Extend(now.Add(time.Minute))
+	if n := registry.Sweep(now.Add(30 * time.Second)); n != 0 {
+		t.Fatal("推迟过期时间后等待器被清理")
+	}
+	if n := registry.Sweep(now.Add(2 * time.Minute)); n != 1 {
+		t.Fatal("超过推迟后的过期时间仍未清理")
+	}
+	if _, err := w.WaitComplete(context.Background(), 10*time.Millisecond); !errors.Is(err, task.ErrTimeout) {
+		t.Fatalf("err=%v, want=%v", err, task.ErrTimeout)
+	}
+}
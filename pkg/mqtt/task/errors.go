@@ -0,0 +1,78 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// failed响应的错误码，接收方拒绝或执行失败的原因，调用方可以据此区分处理
+const (
+	// CodeInternal 处理器返回的普通错误，旧版本接收方的纯文本错误也归为此类
+	CodeInternal = "internal"
+	// CodeUnsupportedAction 接收方没有注册该动作的处理器
+	CodeUnsupportedAction = "unsupported_action"
+	// CodeForbidden 发送方不在白名单内或无权调用该动作
+	CodeForbidden = "forbidden"
+	// CodeBadSignature 任务未签名或签名无效
+	CodeBadSignature = "bad_signature"
+	// CodeSealError 任务未按要求加密或解密失败
+	CodeSealError = "seal_error"
+	// CodeQueueFull 接收方任务队列已满
+	CodeQueueFull = "queue_full"
+	// CodeCanceled 任务被发送方取消
+	CodeCanceled = "canceled"
+	// CodeInvalidPayload 任务负载无法解析
+	CodeInvalidPayload = "invalid_payload"
+	// CodeDuplicateId 消息ID已被同一发送方的其他动作使用
+	CodeDuplicateId = "duplicate_id"
+)
+
+// RemoteError failed响应的错误信封，序列化后放在MessageFailed.Error中
+// 处理器返回*RemoteError（或包装了它的错误）时原样回复，其他错误以CodeInternal回复
+type RemoteError struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Details json.RawMessage `json:"details,omitempty"`
+}
+
+// NewRemoteError 创建错误信封
+func NewRemoteError(code, message string) *RemoteError {
+	return &RemoteError{Code: code, Message: message}
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// WithDetails 附加详细信息，details序列化失败时忽略
+func (e *RemoteError) WithDetails(details interface{}) *RemoteError {
+	data, err := json.Marshal(details)
+	if err == nil {
+		e.Details = data
+	}
+	return e
+}
+
+// AsRemoteError 将错误转换为错误信封，不是*RemoteError时使用CodeInternal
+func AsRemoteError(err error) *RemoteError {
+	var remote *RemoteError
+	if errors.As(err, &remote) {
+		return remote
+	}
+	return &RemoteError{Code: CodeInternal, Message: err.Error()}
+}
+
+// ParseRemoteError 解析failed响应中的错误，旧版本接收方回复的是纯文本，按CodeInternal处理
+func ParseRemoteError(data []byte) *RemoteError {
+	var remote RemoteError
+	if err := json.Unmarshal(data, &remote); err == nil && remote.Code != "" {
+		return &remote
+	}
+	return &RemoteError{Code: CodeInternal, Message: string(data)}
+}
+
+// IsCode 判断错误是否为指定错误码的远端错误
+func IsCode(err error, code string) bool {
+	var remote *RemoteError
+	return errors.As(err, &remote) && remote.Code == code
+}
@@ -0,0 +1,135 @@
+package task
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// 加密内容的用途，作为附加数据参与认证，防止密文被挪到其他消息或其他字段
+const (
+	SealPayload = "payload"
+	SealValue   = "value"
+	SealError   = "error"
+	// SealStream 流式数据的用途前缀，实际用途为"stream/{seq}"，防止数据段被重排
+	SealStream = "stream"
+)
+
+// SealKeySize 负载加密密钥长度，AES-256
+const SealKeySize = 32
+
+// ErrUnknownSealKey 密钥环中没有对应密钥ID的密钥
+var ErrUnknownSealKey = errors.New("未知的加密密钥")
+
+// Keyring 负载加密密钥环，密钥ID为被控端的clientId
+// 控制端持有所有被控端的密钥，被控端只持有自己的密钥，同一任务的请求和响应使用同一个密钥
+type Keyring struct {
+	mu   sync.RWMutex
+	keys map[string]cipher.AEAD
+}
+
+// NewKeyring 创建空的密钥环
+func NewKeyring() *Keyring {
+	return &Keyring{
+		keys: make(map[string]cipher.AEAD),
+	}
+}
+
+// Add 添加密钥，key为SealKeySize字节
+func (k *Keyring) Add(kid string, key []byte) error {
+	if kid == "" {
+		return errors.New("密钥ID为空")
+	}
+	if len(key) != SealKeySize {
+		return fmt.Errorf("加密密钥长度错误，应为%d字节，实际%d字节", SealKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[kid] = aead
+	return nil
+}
+
+// Has 是否持有指定密钥ID的密钥
+func (k *Keyring) Has(kid string) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	_, ok := k.keys[kid]
+	return ok
+}
+
+// Seal 加密数据，返回随机nonce与密文的拼接，msgId和purpose作为附加数据
+func (k *Keyring) Seal(kid, msgId, purpose string, plaintext []byte) ([]byte, error) {
+	aead, err := k.get(kid)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, sealAD(msgId, purpose)), nil
+}
+
+// Open 解密Seal的输出
+func (k *Keyring) Open(kid, msgId, purpose string, sealed []byte) ([]byte, error) {
+	aead, err := k.get(kid)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("密文长度不足")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, sealAD(msgId, purpose))
+	if err != nil {
+		return nil, fmt.Errorf("解密失败: %v", err)
+	}
+	return plaintext, nil
+}
+
+func (k *Keyring) get(kid string) (cipher.AEAD, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	aead, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w，kid=%s", ErrUnknownSealKey, kid)
+	}
+	return aead, nil
+}
+
+func sealAD(msgId, purpose string) []byte {
+	return []byte(purpose + "\x00" + msgId)
+}
+
+// GenerateSealKey 生成base64编码的负载加密密钥
+func GenerateSealKey() (string, error) {
+	key := make([]byte, SealKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ParseSealKey 解析base64编码的负载加密密钥
+func ParseSealKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("加密密钥不是有效的base64: %v", err)
+	}
+	if len(key) != SealKeySize {
+		return nil, fmt.Errorf("加密密钥长度错误，应为%d字节，实际%d字节", SealKeySize, len(key))
+	}
+	return key, nil
+}
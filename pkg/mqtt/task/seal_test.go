@@ -0,0 +1,120 @@
+package task
+
+import (
+	"errors"
+	"testing"
+)
+
+func testKeyring(t *testing.T, kid string) *Keyring {
+	t.Helper()
+	s, err := GenerateSealKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseSealKey(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := NewKeyring()
+	if err := k.Add(kid, key); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKeyringOpen(t *testing.T) {
+	k := testKeyring(t, "client")
+	sealed, err := k.Seal("client", "a", SealPayload, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 使用其他被控端的密钥，或者控制端为同一clientId配置了不同的密钥
+	wrong := testKeyring(t, "client")
+	tests := []struct {
+		name    string
+		keyring *Keyring
+		kid     string
+		msgId   string
+		purpose string
+		sealed  []byte
+		ok      bool
+		err     error
+	}{
+		{"正确", k, "client", "a", SealPayload, sealed, true, nil},
+		{"错误的密钥", wrong, "client", "a", SealPayload, sealed, false, nil},
+		{"未知的密钥ID", k, "other", "a", SealPayload, sealed, false, ErrUnknownSealKey},
+		{"挪到其他消息", k, "client", "b", SealPayload, sealed, false, nil},
+		{"挪到其他字段", k, "client", "a", SealValue, sealed, false, nil},
+		{"挪到流式数据", k, "client", "a", SealStream + "/0", sealed, false, nil},
+		{"密文被修改", k, "client", "a", SealPayload, append(append([]byte{}, sealed[:len(sealed)-1]...), sealed[len(sealed)-1]^1), false, nil},
+		{"密文长度不足", k, "client", "a", SealPayload, sealed[:4], false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext, err := tt.keyring.Open(tt.kid, tt.msgId, tt.purpose, tt.sealed)
+			if tt.ok {
+				if err != nil || string(plaintext) != "secret" {
+					t.Fatalf("plaintext=%s, err=%v", plaintext, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("解密应失败")
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("err=%v, want=%v", err, tt.err)
+			}
+		})
+	}
+}
+
+// 附加数据中用途和消息ID之间有分隔符，拼接结果相同的两组不能互相解密
+func TestSealAssociatedDataBoundary(t *testing.T) {
+	k := testKeyring(t, "client")
+	sealed, err := k.Seal("client", "1", "stream/1", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Open("client", "11", "stream/", sealed); err == nil {
+		t.Fatal("用途和消息ID的边界被混淆")
+	}
+}
+
+func TestSealNonce(t *testing.T) {
+	k := testKeyring(t, "client")
+	a, _ := k.Seal("client", "a", SealPayload, []byte("same"))
+	b, _ := k.Seal("client", "a", SealPayload, []byte("same"))
+	if string(a) == string(b) {
+		t.Fatal("相同明文两次加密的结果相同，nonce没有随机生成")
+	}
+}
+
+func TestKeyringAdd(t *testing.T) {
+	tests := []struct {
+		name string
+		kid  string
+		key  []byte
+		ok   bool
+	}{
+		{"正确", "client", make([]byte, SealKeySize), true},
+		{"密钥ID为空", "", make([]byte, SealKeySize), false},
+		{"密钥过短", "client", make([]byte, 16), false},
+		{"密钥过长", "client", make([]byte, 64), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := NewKeyring()
+			if err := k.Add(tt.kid, tt.key); (err == nil) != tt.ok {
+				t.Fatalf("ok=%v, err=%v", tt.ok, err)
+			}
+			if k.Has(tt.kid) != tt.ok {
+				t.Fatalf("Has=%v", k.Has(tt.kid))
+			}
+		})
+	}
+	for _, s := range []string{"!", "YWJj"} {
+		if _, err := ParseSealKey(s); err == nil {
+			t.Fatalf("无效的密钥应返回错误，key=%s", s)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package task
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrUnsigned 任务消息没有签名
+	ErrUnsigned = errors.New("任务消息未签名")
+	// ErrBadSignature 任务消息的签名无法通过任何受信任公钥的验证
+	ErrBadSignature = errors.New("任务消息签名验证失败")
+)
+
+// signingDomain 签名内容的前缀，避免签名被挪用到其他用途
+const signingDomain = "fd-task-sig-v1"
+
+// signingBytes 返回签名覆盖的内容，与协议版本无关，v1和v2编码的同一任务签名相同
+// 加密的任务先加密后签名，签名覆盖的是密文
+// 每个字段前都写入长度，避免字段拼接产生歧义
+func (m MessagePending) signingBytes() []byte {
+	var buf bytes.Buffer
+	writeField := func(b []byte) {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(b)))
+		buf.Write(n[:])
+		buf.Write(b)
+	}
+	writeInt := func(v int64) {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(v))
+		buf.Write(n[:])
+	}
+	writeField([]byte(signingDomain))
+	writeField([]byte(m.Sender))
+	writeField([]byte(m.Receiver))
+	writeField([]byte(m.MsgId))
+	writeField([]byte(m.Action))
+	writeInt(m.Time)
+	writeInt(m.Exp)
+	writeField(m.Payload)
+	// 加密和流式字段是后加入的，为空时不写入，保持已有任务的签名不变
+	if m.Enc != "" {
+		writeField([]byte(m.Enc))
+	}
+	if m.Stream {
+		writeField([]byte("stream"))
+	}
+	// 定时字段带名称写入，旧版本接收方验签会失败而不是立即执行定时任务
+	if m.NotBefore != 0 {
+		writeField([]byte("not_before"))
+		writeInt(m.NotBefore)
+	}
+	if m.Cron != "" {
+		writeField([]byte("cron"))
+		writeField([]byte(m.Cron))
+	}
+	return buf.Bytes()
+}
+
+// Sign 使用发送方私钥对任务消息签名，签名后不得再修改消息字段
+func (m *MessagePending) Sign(key ed25519.PrivateKey) {
+	m.Sig = ed25519.Sign(key, m.signingBytes())
+}
+
+// Verify 使用受信任的公钥验证任务消息签名，任意一个公钥验证通过即可
+func (m MessagePending) Verify(keys []ed25519.PublicKey) error {
+	if len(m.Sig) == 0 {
+		return ErrUnsigned
+	}
+	data := m.signingBytes()
+	for _, key := range keys {
+		if ed25519.Verify(key, data, m.Sig) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+// GenerateSigningKey 生成签名密钥对，返回base64编码的私钥种子和公钥
+func GenerateSigningKey() (privateKey string, publicKey string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(priv.Seed()), base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// ParseSigningKey 解析base64编码的私钥种子
+func ParseSigningKey(s string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("签名私钥不是有效的base64: %v", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("签名私钥长度错误，应为%d字节，实际%d字节", ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParseVerifyKey 解析base64编码的公钥
+func ParseVerifyKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("签名公钥不是有效的base64: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("签名公钥长度错误，应为%d字节，实际%d字节", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// PublicKeyOf 返回私钥对应的base64编码公钥
+func PublicKeyOf(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
@@ -0,0 +1,175 @@
+package task
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func testSigningKey(t *testing.T) (ed25519.PrivateKey, ed25519.PublicKey) {
+	t.Helper()
+	priv, pub, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseSigningKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify, err := ParseVerifyKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, verify
+}
+
+func signedPending(key ed25519.PrivateKey) MessagePending {
+	msg := MessagePending{
+		Sender:   "ctl",
+		Receiver: "client",
+		MsgId:    "a",
+		Action:   "update",
+		Time:     1700000000,
+		Exp:      1700000060,
+		Payload:  []byte(`{"name":"frp"}`),
+	}
+	msg.Sign(key)
+	return msg
+}
+
+func TestVerifyTampered(t *testing.T) {
+	key, pub := testSigningKey(t)
+	tests := []struct {
+		name   string
+		tamper func(m *MessagePending)
+	}{
+		{"sender", func(m *MessagePending) { m.Sender = "other" }},
+		{"receiver", func(m *MessagePending) { m.Receiver = "other" }},
+		{"msg_id", func(m *MessagePending) { m.MsgId = "b" }},
+		{"action", func(m *MessagePending) { m.Action = "delete" }},
+		{"time", func(m *MessagePending) { m.Time++ }},
+		{"exp", func(m *MessagePending) { m.Exp += 3600 }},
+		{"payload", func(m *MessagePending) { m.Payload = []byte(`{"name":"evil"}`) }},
+		{"enc", func(m *MessagePending) { m.Enc = "client" }},
+		{"stream", func(m *MessagePending) { m.Stream = true }},
+		{"not_before", func(m *MessagePending) { m.NotBefore = 1700000030 }},
+		{"cron", func(m *MessagePending) { m.Cron = "* * * * *" }},
+		{"sig", func(m *MessagePending) { m.Sig[0] ^= 1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := signedPending(key)
+			if err := msg.Verify([]ed25519.PublicKey{pub}); err != nil {
+				t.Fatalf("未修改的消息验签失败，err=%v", err)
+			}
+			tt.tamper(&msg)
+			if err := msg.Verify([]ed25519.PublicKey{pub}); !errors.Is(err, ErrBadSignature) {
+				t.Fatalf("修改%s后验签应失败，err=%v", tt.name, err)
+			}
+		})
+	}
+}
+
+func TestVerifyKeys(t *testing.T) {
+	key, pub := testSigningKey(t)
+	_, other := testSigningKey(t)
+	tests := []struct {
+		name string
+		msg  func() MessagePending
+		keys []ed25519.PublicKey
+		err  error
+	}{
+		{"正确的公钥", func() MessagePending { return signedPending(key) }, []ed25519.PublicKey{pub}, nil},
+		{"任意一个公钥通过", func() MessagePending { return signedPending(key) }, []ed25519.PublicKey{other, pub}, nil},
+		{"错误的公钥", func() MessagePending { return signedPending(key) }, []ed25519.PublicKey{other}, ErrBadSignature},
+		{"没有公钥", func() MessagePending { return signedPending(key) }, nil, ErrBadSignature},
+		{"未签名", func() MessagePending {
+			msg := signedPending(key)
+			msg.Sig = nil
+			return msg
+		}, []ed25519.PublicKey{pub}, ErrUnsigned},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.msg().Verify(tt.keys); !errors.Is(err, tt.err) {
+				t.Fatalf("err=%v, want=%v", err, tt.err)
+			}
+		})
+	}
+}
+
+// 字段前写入长度，相邻字段之间挪动内容得到的签名内容不同
+func TestSigningBytesFieldBoundary(t *testing.T) {
+	key, pub := testSigningKey(t)
+	tests := []struct {
+		name   string
+		a, b   MessagePending
+		shared bool
+	}{
+		{"sender和receiver", MessagePending{Sender: "ab", Receiver: "c"}, MessagePending{Sender: "a", Receiver: "bc"}, false},
+		{"msg_id和action", MessagePending{MsgId: "a", Action: "update"}, MessagePending{MsgId: "au", Action: "pdate"}, false},
+		{"action和payload", MessagePending{Action: "up", Payload: []byte("date")}, MessagePending{Action: "update"}, false},
+		{"cron和stream", MessagePending{Cron: "stream"}, MessagePending{Stream: true}, false},
+		{"not_before和cron", MessagePending{NotBefore: 1}, MessagePending{Cron: "\x00\x00\x00\x00\x00\x00\x00\x01"}, false},
+		{"空负载与nil负载", MessagePending{Payload: []byte{}}, MessagePending{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			same := string(tt.a.signingBytes()) == string(tt.b.signingBytes())
+			if same != tt.shared {
+				t.Fatalf("签名内容相同=%v, want=%v", same, tt.shared)
+			}
+			tt.a.Sign(key)
+			tt.b.Sig = tt.a.Sig
+			if err := tt.b.Verify([]ed25519.PublicKey{pub}); (err == nil) != tt.shared {
+				t.Fatalf("签名被挪用到其他消息，err=%v", err)
+			}
+		})
+	}
+}
+
+// 签名与协议版本无关，v1和v2编码后解码都能通过验签
+func TestSignatureSurvivesEncoding(t *testing.T) {
+	key, pub := testSigningKey(t)
+	for _, version := range []int{ProtocolV1, ProtocolV2} {
+		msg := signedPending(key)
+		msg.Stream = true
+		msg.Cron = "0 3 * * *"
+		msg.Sign(key)
+		data, err := msg.Marshal(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded MessagePending
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if err := decoded.Verify([]ed25519.PublicKey{pub}); err != nil {
+			t.Fatalf("version=%d, err=%v", version, err)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func() error
+	}{
+		{"私钥不是base64", func() error { _, err := ParseSigningKey("!"); return err }},
+		{"私钥长度错误", func() error { _, err := ParseSigningKey("YWJj"); return err }},
+		{"公钥不是base64", func() error { _, err := ParseVerifyKey("!"); return err }},
+		{"公钥长度错误", func() error { _, err := ParseVerifyKey("YWJj"); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.parse() == nil {
+				t.Fatal("无效的密钥应返回错误")
+			}
+		})
+	}
+	key, pub := testSigningKey(t)
+	if got, err := ParseVerifyKey(PublicKeyOf(key)); err != nil || !got.Equal(pub) {
+		t.Fatalf("PublicKeyOf与生成的公钥不一致，err=%v", err)
+	}
+}
@@ -1,7 +1,9 @@
 package task
 
 import (
+	"encoding/json"
 	"fmt"
+	"time"
 )
 
 // MQTT的任务主题默认配置
@@ -20,34 +22,330 @@ import (
 // {prefix}/{node}/ack       - 任务确认
 // {prefix}/{node}/complete  - 任务完成
 // {prefix}/{node}/failed    - 任务失败
+// {prefix}/{node}/progress  - 任务执行进度
+// {prefix}/{node}/stream    - 流式任务的数据
 // {prefix}/{node}/status    - 节点状态（保留消息）
 
+// FD协议版本，v2简化了字段命名，参阅docs/fd协议更新.md
+// 解码时同时接受两个版本的字段名，编码时按接收方支持的版本输出
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+	// ProtocolLatest 本端支持的最高版本，在状态消息中上报
+	ProtocolLatest = ProtocolV2
+	// ProtocolDefault 对端版本未知时使用的版本，新版本能解码v1消息，旧版本只能解码v1消息
+	ProtocolDefault = ProtocolV1
+)
+
+// Message 可按指定协议版本编码的消息
+type Message interface {
+	Marshal(version int) ([]byte, error)
+}
+
 type MessagePending struct {
-	SenderClientId   string `json:"sender_client_id"`   // 发送者客户端ID
-	ReceiverClientId string `json:"receiver_client_id"` // 接收者客户端ID
-	MessageId        string `json:"message_id"`         // 消息ID，一般为UUID，resp和req的message_id相同
-	Action           string `json:"action"`             // 消息动作
-	Timestamp        int64  `json:"timestamp"`          // 消息发送时间戳，单位为秒
-	Expiration       int64  `json:"expiration"`         // 消息过期时间戳，单位为秒
-	Payload          []byte `json:"payload"`            // 消息负载
-}
-type MessageAsk struct {
-	MessageId string `json:"message_id"`
+	Sender   string `json:"sender"`        // 发送者的MQTT username
+	Receiver string `json:"receiver"`      // 接收者的MQTT username
+	MsgId    string `json:"msg_id"`        // 消息ID，一般为UUID，resp和req的msg_id相同
+	Action   string `json:"action"`        // 消息动作
+	Time     int64  `json:"time"`          // 消息发送时间戳，单位为秒
+	Exp      int64  `json:"exp"`           // 消息过期时间戳，单位为秒
+	Payload  []byte `json:"payload"`       // 消息负载
+	Enc      string `json:"enc,omitempty"` // Payload加密使用的密钥ID，为空表示明文，参阅seal.go
+	// Stream 调用方以流式方式接收结果，处理器可以多次发布数据到发送方的stream主题，结束时发布结束标记
+	Stream bool `json:"stream,omitempty"`
+	// NotBefore 最早执行时间戳，单位为秒，接收方保存任务并在该时间之后执行，Exp只限制投递期限
+	NotBefore int64 `json:"not_before,omitempty"`
+	// Cron 周期执行的cron表达式（分 时 日 月 周，接收方本地时区），同时设置NotBefore时从NotBefore之后开始
+	Cron string `json:"cron,omitempty"`
+	Sig  []byte `json:"sig,omitempty"` // 发送方对以上字段的Ed25519签名，参阅sign.go
+
+	// ResponseTopic和Correlation 收到任务时的MQTT 5报文属性，不在JSON信封中，也不在签名范围内
+	// 带有ResponseTopic时响应发布到其下的子主题，响应的关联数据使用Correlation
+	ResponseTopic string `json:"-"`
+	Correlation   string `json:"-"`
+
+	version int // 解码时识别出的协议版本，回复时使用相同版本
+}
+type MessageAck struct {
+	MsgId string `json:"msg_id"`
 }
 type MessageComplete struct {
+	MsgId string `json:"msg_id"`
+	Value []byte `json:"value"`
+	Enc   string `json:"enc,omitempty"` // Value加密使用的密钥ID，与任务消息相同
+}
+type MessageFailed struct {
+	MsgId string `json:"msg_id"`
+	Error []byte `json:"error"`
+	Enc   string `json:"enc,omitempty"` // Error加密使用的密钥ID，与任务消息相同
+}
+
+// MessageProgress 长时间运行任务的执行进度，接收方执行处理器期间发布到发送方的progress主题
+// 进度消息使用QoS 0，丢失或乱序不影响任务结果，只用于展示
+type MessageProgress struct {
+	MsgId   string `json:"msg_id"`
+	Percent int    `json:"percent"`         // 进度百分比 0-100，-1表示该阶段无法估计进度
+	Phase   string `json:"phase,omitempty"` // 当前阶段，例如download、start
+	Time    int64  `json:"time"`            // 进度产生时间戳，单位为毫秒
+}
+
+// MessageStream 流式任务的一段数据，按Seq从0开始递增，End为true的消息是结束标记，不携带数据
+// 处理器的返回值和错误仍通过complete/failed主题回复
+type MessageStream struct {
+	MsgId string `json:"msg_id"`
+	Seq   int    `json:"seq"`
+	Data  []byte `json:"data,omitempty"`
+	End   bool   `json:"end,omitempty"`
+	Enc   string `json:"enc,omitempty"` // Data加密使用的密钥ID，与任务消息相同
+}
+
+// ActionCancel 内置的取消任务动作，由接收方直接处理，不经过MessageHandler
+// 只有原任务的发送方可以取消该任务
+const ActionCancel = "fd.cancel"
+
+// ActionSchedules 内置的列出定时任务动作，由接收方直接处理，只返回请求发送方自己的定时任务
+const ActionSchedules = "fd.schedules"
+
+// MessageCancel ActionCancel的负载
+type MessageCancel struct {
+	MsgId string `json:"msg_id"` // 要取消的任务消息ID
+}
+
+// 历史记录的类型
+const (
+	HistoryStatus    = "status"    // 状态快照
+	HistoryLifecycle = "lifecycle" // 实例启动、退出等事件
+)
+
+// MessageHistory 节点的历史记录，先写入本地发件箱再按Seq顺序发布到history主题，断线期间的记录在重连后补发
+// 崩溃重启后可能重发已发布过的记录，接收方按Seq和Time去重
+type MessageHistory struct {
+	Seq  int64           `json:"seq"`  // 从1开始递增的序号
+	Time int64           `json:"time"` // 记录产生的时间戳，单位为秒，不是发布时间
+	Kind string          `json:"kind"` // HistoryStatus或HistoryLifecycle
+	Data json.RawMessage `json:"data"`
+	// Dropped 发件箱已满时在本条之前丢弃的记录数
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// MessageStatus 节点状态，以保留消息发布到status主题，除Time外的字段都是可选的
+type MessageStatus struct {
+	Time    int64  `json:"time"`              // 状态更新时间戳，单位为秒
+	Online  *bool  `json:"online,omitempty"`  // 在线状态
+	Battery *int   `json:"battery,omitempty"` // 电量百分比 0-100
+	Rssi    *int   `json:"rssi,omitempty"`    // 信号强度 dBm
+	Ip      string `json:"ip,omitempty"`      // IP地址
+	Version string `json:"version,omitempty"` // 软件版本
+	Uptime  int64  `json:"uptime,omitempty"`  // 运行时长，单位为秒
+	// ClockSkew 最近一次测得的本地时钟与任务发送方的偏差，单位为秒，正数表示本地时钟较快，包含投递延迟
+	ClockSkew *int64 `json:"clock_skew,omitempty"`
+	// Protocol 节点支持的最高FD协议版本，旧版本节点不上报，发送方据此选择任务的编码版本
+	Protocol int    `json:"protocol,omitempty"`
+	Data     []byte `json:"data,omitempty"` // 其他业务自定义数据
+}
+
+// NewOfflineStatus 创建离线状态，用于遗嘱消息和正常下线
+func NewOfflineStatus() MessageStatus {
+	online := false
+	return MessageStatus{
+		Time:   time.Now().Unix(),
+		Online: &online,
+	}
+}
+
+// v1版本的消息结构，仅用于编解码旧版本对端的消息
+type messagePendingV1 struct {
+	SenderClientId   string `json:"sender_client_id"`
+	ReceiverClientId string `json:"receiver_client_id"`
+	MessageId        string `json:"message_id"`
+	Action           string `json:"action"`
+	Timestamp        int64  `json:"timestamp"`
+	Expiration       int64  `json:"expiration"`
+	Payload          []byte `json:"payload"`
+	Enc              string `json:"enc,omitempty"`
+	Stream           bool   `json:"stream,omitempty"`
+	NotBefore        int64  `json:"not_before,omitempty"`
+	Cron             string `json:"cron,omitempty"`
+	Sig              []byte `json:"sig,omitempty"`
+}
+type messageAckV1 struct {
+	MessageId string `json:"message_id"`
+}
+type messageCompleteV1 struct {
 	MessageId string `json:"message_id"`
 	Value     []byte `json:"value"`
+	Enc       string `json:"enc,omitempty"`
 }
-type MessageFailed struct {
+type messageFailedV1 struct {
 	MessageId string `json:"message_id"`
 	Error     []byte `json:"error"`
+	Enc       string `json:"enc,omitempty"`
+}
+
+// Version 解码时识别出的协议版本，非解码得到的消息返回ProtocolDefault
+func (m MessagePending) Version() int {
+	if m.version == 0 {
+		return ProtocolDefault
+	}
+	return m.version
+}
+
+func (m MessagePending) Marshal(version int) ([]byte, error) {
+	if version == ProtocolV1 {
+		return json.Marshal(messagePendingV1{
+			SenderClientId:   m.Sender,
+			ReceiverClientId: m.Receiver,
+			MessageId:        m.MsgId,
+			Action:           m.Action,
+			Timestamp:        m.Time,
+			Expiration:       m.Exp,
+			Payload:          m.Payload,
+			Enc:              m.Enc,
+			Stream:           m.Stream,
+			NotBefore:        m.NotBefore,
+			Cron:             m.Cron,
+			Sig:              m.Sig,
+		})
+	}
+	type plain MessagePending
+	return json.Marshal(plain(m))
+}
+
+func (m *MessagePending) UnmarshalJSON(data []byte) error {
+	var aux struct {
+		messagePendingV1
+		Sender   string `json:"sender"`
+		Receiver string `json:"receiver"`
+		MsgId    string `json:"msg_id"`
+		Time     int64  `json:"time"`
+		Exp      int64  `json:"exp"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*m = MessagePending{
+		Sender:    aux.Sender,
+		Receiver:  aux.Receiver,
+		MsgId:     aux.MsgId,
+		Action:    aux.Action,
+		Time:      aux.Time,
+		Exp:       aux.Exp,
+		Payload:   aux.Payload,
+		Enc:       aux.Enc,
+		Stream:    aux.Stream,
+		NotBefore: aux.NotBefore,
+		Cron:      aux.Cron,
+		Sig:       aux.Sig,
+		version:   ProtocolV2,
+	}
+	if m.MsgId == "" && aux.MessageId != "" {
+		m.version = ProtocolV1
+		m.Sender = aux.SenderClientId
+		m.Receiver = aux.ReceiverClientId
+		m.MsgId = aux.MessageId
+		m.Time = aux.Timestamp
+		m.Exp = aux.Expiration
+	}
+	return nil
+}
+
+func (m MessageAck) Marshal(version int) ([]byte, error) {
+	if version == ProtocolV1 {
+		return json.Marshal(messageAckV1{MessageId: m.MsgId})
+	}
+	type plain MessageAck
+	return json.Marshal(plain(m))
+}
+
+func (m *MessageAck) UnmarshalJSON(data []byte) error {
+	var aux struct {
+		MsgId     string `json:"msg_id"`
+		MessageId string `json:"message_id"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	m.MsgId = firstNonEmpty(aux.MsgId, aux.MessageId)
+	return nil
+}
+
+func (m MessageComplete) Marshal(version int) ([]byte, error) {
+	if version == ProtocolV1 {
+		return json.Marshal(messageCompleteV1{MessageId: m.MsgId, Value: m.Value, Enc: m.Enc})
+	}
+	type plain MessageComplete
+	return json.Marshal(plain(m))
+}
+
+func (m *MessageComplete) UnmarshalJSON(data []byte) error {
+	var aux struct {
+		messageCompleteV1
+		MsgId string `json:"msg_id"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	m.MsgId = firstNonEmpty(aux.MsgId, aux.MessageId)
+	m.Value = aux.Value
+	m.Enc = aux.Enc
+	return nil
+}
+
+func (m MessageFailed) Marshal(version int) ([]byte, error) {
+	if version == ProtocolV1 {
+		return json.Marshal(messageFailedV1{MessageId: m.MsgId, Error: m.Error, Enc: m.Enc})
+	}
+	type plain MessageFailed
+	return json.Marshal(plain(m))
+}
+
+func (m *MessageFailed) UnmarshalJSON(data []byte) error {
+	var aux struct {
+		messageFailedV1
+		MsgId string `json:"msg_id"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	m.MsgId = firstNonEmpty(aux.MsgId, aux.MessageId)
+	m.Error = aux.Error
+	m.Enc = aux.Enc
+	return nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// 响应主题的最后一段，发送方的响应主题为TopicReply下的子主题
+const (
+	ReplyAck      = "ack"
+	ReplyComplete = "complete"
+	ReplyFailed   = "failed"
+	ReplyProgress = "progress"
+	ReplyStream   = "stream"
+)
+
+// TopicReply 发送方响应主题的上一级，MQTT 5任务消息以此作为Response Topic
+func TopicReply(prefix string, username string) string {
+	return fmt.Sprintf("%s/%s", prefix, username)
+}
+
+// ReplyTopic 响应主题，root为TopicReply或任务消息的Response Topic
+func ReplyTopic(root string, kind string) string {
+	return root + "/" + kind
 }
 
 func TopicPending(prefix string, username string) string {
 	return fmt.Sprintf("%s/%s/%s", prefix, username, "pending")
 }
 
-func TopicAsk(prefix string, username string) string {
+func TopicAck(prefix string, username string) string {
 	return fmt.Sprintf("%s/%s/%s", prefix, username, "ack")
 }
 
@@ -59,6 +357,18 @@ func TopicFailed(prefix string, username string) string {
 	return fmt.Sprintf("%s/%s/%s", prefix, username, "failed")
 }
 
+func TopicProgress(prefix string, username string) string {
+	return fmt.Sprintf("%s/%s/%s", prefix, username, "progress")
+}
+
+func TopicStream(prefix string, username string) string {
+	return fmt.Sprintf("%s/%s/%s", prefix, username, "stream")
+}
+
 func TopicStatus(prefix string, username string) string {
 	return fmt.Sprintf("%s/%s/%s", prefix, username, "status")
 }
+
+func TopicHistory(prefix string, username string) string {
+	return fmt.Sprintf("%s/%s/%s", prefix, username, "history")
+}
@@ -0,0 +1,100 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPendingRoundTrip(t *testing.T) {
+	msg := MessagePending{
+		Sender:    "ctl",
+		Receiver:  "client",
+		MsgId:     "a",
+		Action:    "update",
+		Time:      1700000000,
+		Exp:       1700000060,
+		Payload:   []byte(`{"name":"frp"}`),
+		Enc:       "client",
+		Stream:    true,
+		NotBefore: 1700000030,
+		Cron:      "0 3 * * *",
+		Sig:       []byte("sig"),
+	}
+	tests := []struct {
+		name    string
+		version int
+		field   string // 该版本特有的字段名
+	}{
+		{"v1", ProtocolV1, `"message_id"`},
+		{"v2", ProtocolV2, `"msg_id"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := msg.Marshal(tt.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), tt.field) {
+				t.Fatalf("编码结果中没有%s，data=%s", tt.field, data)
+			}
+			var decoded MessagePending
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Version() != tt.version {
+				t.Fatalf("version=%d, want=%d", decoded.Version(), tt.version)
+			}
+			// 按解码识别出的版本回复，对端收到的编码与原消息相同
+			again, err := decoded.Marshal(decoded.Version())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(again) != string(data) {
+				t.Fatalf("再次编码的结果不同，got=%s, want=%s", again, data)
+			}
+			decoded.version = 0
+			if !reflect.DeepEqual(decoded, msg) {
+				t.Fatalf("got=%+v, want=%+v", decoded, msg)
+			}
+		})
+	}
+	if (MessagePending{}).Version() != ProtocolDefault {
+		t.Fatal("非解码得到的消息应使用默认版本")
+	}
+}
+
+func TestReplyRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     Message
+		decoded func() interface{}
+	}{
+		{"ack", MessageAck{MsgId: "a"}, func() interface{} { return &MessageAck{} }},
+		{"complete", MessageComplete{MsgId: "a", Value: []byte(`"ok"`), Enc: "client"}, func() interface{} { return &MessageComplete{} }},
+		{"failed", MessageFailed{MsgId: "a", Error: []byte(`{"code":"internal"}`), Enc: "client"}, func() interface{} { return &MessageFailed{} }},
+	}
+	for _, tt := range tests {
+		for _, version := range []int{ProtocolV1, ProtocolV2} {
+			t.Run(fmt.Sprintf("%s/v%d", tt.name, version), func(t *testing.T) {
+				data, err := tt.msg.Marshal(version)
+				if err != nil {
+					t.Fatal(err)
+				}
+				field := map[int]string{ProtocolV1: `"message_id"`, ProtocolV2: `"msg_id"`}[version]
+				if !strings.Contains(string(data), field) {
+					t.Fatalf("编码结果中没有%s，data=%s", field, data)
+				}
+				decoded := tt.decoded()
+				if err := json.Unmarshal(data, decoded); err != nil {
+					t.Fatal(err)
+				}
+				if got := reflect.ValueOf(decoded).Elem().Interface(); !reflect.DeepEqual(got, tt.msg) {
+					t.Fatalf("got=%+v, want=%+v", got, tt.msg)
+				}
+			})
+		}
+	}
+}
@@ -1,22 +1,73 @@
 package task
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 )
 
-// 同步下发一个行为后，立即等待响应
+var (
+	// ErrTimeout 等待超过消息过期时间或指定超时仍未收到complete/failed响应
+	ErrTimeout = errors.New("timeout")
+	// ErrAckTimeout 等待超过指定超时仍未收到ack响应
+	ErrAckTimeout = errors.New("ack timeout")
+)
+
+// 下发一个行为后等待响应，分为两个阶段：
+// acked 接收方已收到任务并回复了ack
+// completed 接收方执行完毕并回复了complete或failed
 type Waiter struct {
-	messageId  string
-	Ch         chan interface{}
+	messageId string
+	acked     chan struct{}
+	ackOnce   sync.Once
+	result    chan interface{}
+	progress  chan MessageProgress
+	done      chan struct{}
+
+	mu         sync.Mutex
 	expiration time.Time
 }
 
-// Wait 等待任务完成或失败
-func (w *Waiter) Wait() (value []byte, err error) {
-	// 否则使用超时等待
+// Wait 等待任务完成或失败，ctx被取消或超过过期时间时返回错误
+func (w *Waiter) Wait(ctx context.Context) (value []byte, err error) {
+	return w.WaitComplete(ctx, time.Until(w.expires()))
+}
+
+// WaitAck 等待接收方确认收到任务，超时时间不会超过消息过期时间
+// 如果complete或failed先于ack到达，也视为已确认
+func (w *Waiter) WaitAck(ctx context.Context, timeout time.Duration) error {
+	timer := time.NewTimer(w.limit(timeout))
+	defer timer.Stop()
+
+	select {
+	case <-w.acked:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return ErrAckTimeout
+	}
+}
+
+// Acked 是否已收到接收方的ack
+func (w *Waiter) Acked() bool {
+	select {
+	case <-w.acked:
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitComplete 等待任务完成或失败，超时时间不会超过消息过期时间
+func (w *Waiter) WaitComplete(ctx context.Context, timeout time.Duration) (value []byte, err error) {
+	timer := time.NewTimer(w.limit(timeout))
+	defer timer.Stop()
+
 	select {
-	case result := <-w.Ch:
+	case result := <-w.result:
 		switch v := result.(type) {
 		case []byte:
 			return v, nil
@@ -25,16 +76,174 @@ func (w *Waiter) Wait() (value []byte, err error) {
 		default:
 			return nil, nil
 		}
-	case <-time.After(time.Until(w.expiration)):
-		return nil, errors.New("timeout")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
+// Done 收到complete或failed响应后关闭，结果仍需通过Wait或WaitComplete读取
+func (w *Waiter) Done() <-chan struct{} {
+	return w.done
+}
+
+// Progress 返回接收方上报的执行进度，只保留最新的一条，读取不及时时旧的进度会被丢弃
+func (w *Waiter) Progress() <-chan MessageProgress {
+	return w.progress
+}
+
+// notifyProgress 投递进度，通道已满时用最新的进度替换旧的进度
+func (w *Waiter) notifyProgress(p MessageProgress) {
+	for {
+		select {
+		case w.progress <- p:
+			return
+		default:
+		}
+		select {
+		case <-w.progress:
+		default:
+		}
+	}
+}
+
+// MessageId 返回等待器对应的消息ID
+func (w *Waiter) MessageId() string {
+	return w.messageId
+}
+
+// Extend 推迟等待器的过期时间，早于当前过期时间时忽略
+// 流式任务的过期时间只限制投递期限，流开始后由接收端在收到数据或读取时推迟
+func (w *Waiter) Extend(expiration time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if expiration.After(w.expiration) {
+		w.expiration = expiration
+	}
+}
+
+func (w *Waiter) expires() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.expiration
+}
+
+// limit 将超时时间限制在消息过期时间之内
+func (w *Waiter) limit(timeout time.Duration) time.Duration {
+	if remain := time.Until(w.expires()); timeout > remain {
+		return remain
 	}
+	return timeout
+}
+
+func (w *Waiter) markAcked() {
+	w.ackOnce.Do(func() { close(w.acked) })
 }
 
 // NewWaiter 创建一个新的等待器
 func NewWaiter(messageId string, expiration time.Time) *Waiter {
 	return &Waiter{
 		messageId:  messageId,
-		Ch:         make(chan interface{}, 1),
+		acked:      make(chan struct{}),
+		result:     make(chan interface{}, 1),
+		progress:   make(chan MessageProgress, 1),
+		done:       make(chan struct{}),
 		expiration: expiration,
 	}
 }
+
+// Registry 等待器注册表，发送方goroutine写入，paho回调goroutine读取，所以需要加锁
+type Registry struct {
+	mu      sync.Mutex
+	waiters map[string]*Waiter
+}
+
+// NewRegistry 创建等待器注册表
+func NewRegistry() *Registry {
+	return &Registry{
+		waiters: make(map[string]*Waiter),
+	}
+}
+
+// Add 注册等待器，消息ID重复时返回错误
+func (r *Registry) Add(w *Waiter) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.waiters[w.messageId]; exists {
+		return fmt.Errorf("等待器已存在，messageId=%s", w.messageId)
+	}
+	r.waiters[w.messageId] = w
+	return nil
+}
+
+// Remove 移除等待器，不存在时忽略
+func (r *Registry) Remove(messageId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.waiters, messageId)
+}
+
+// Resolve 将结果投递给等待器并移除，result为[]byte或error，返回是否找到等待器
+func (r *Registry) Resolve(messageId string, result interface{}) bool {
+	r.mu.Lock()
+	waiter, ok := r.waiters[messageId]
+	if ok {
+		delete(r.waiters, messageId)
+	}
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+	// 通道带1个缓冲且等待器只会被Resolve一次，不会阻塞
+	waiter.markAcked()
+	waiter.result <- result
+	close(waiter.done)
+	return true
+}
+
+// Ack 标记等待器已被接收方确认，返回是否找到等待器
+func (r *Registry) Ack(messageId string) bool {
+	r.mu.Lock()
+	waiter, ok := r.waiters[messageId]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+	waiter.markAcked()
+	return true
+}
+
+// Progress 将进度投递给等待器，收到进度说明接收方已开始执行，同时视为已确认，返回是否找到等待器
+func (r *Registry) Progress(p MessageProgress) bool {
+	r.mu.Lock()
+	waiter, ok := r.waiters[p.MsgId]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+	waiter.markAcked()
+	waiter.notifyProgress(p)
+	return true
+}
+
+// Sweep 清理已经过期的等待器，返回清理的数量
+func (r *Registry) Sweep(now time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for id, w := range r.waiters {
+		if now.After(w.expires()) {
+			delete(r.waiters, id)
+			n++
+		}
+	}
+	return n
+}
+
+// Len 返回当前注册的等待器数量
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.waiters)
+}
@@ -0,0 +1,171 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistryResolve(t *testing.T) {
+	remote := errors.New("failed")
+	tests := []struct {
+		name   string
+		result interface{}
+		value  []byte
+		err    error
+	}{
+		{"complete", []byte("ok"), []byte("ok"), nil},
+		{"failed", remote, nil, remote},
+		{"空结果", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry()
+			w := NewWaiter("a", time.Now().Add(time.Minute))
+			if err := r.Add(w); err != nil {
+				t.Fatal(err)
+			}
+			if !r.Resolve("a", tt.result) {
+				t.Fatal("没有找到等待器")
+			}
+			if r.Resolve("a", tt.result) {
+				t.Fatal("等待器只能被Resolve一次")
+			}
+			if r.Len() != 0 {
+				t.Fatalf("Resolve后应移除等待器，len=%d", r.Len())
+			}
+			if !w.Acked() {
+				t.Fatal("收到结果应视为已确认")
+			}
+			select {
+			case <-w.Done():
+			default:
+				t.Fatal("收到结果后Done应被关闭")
+			}
+			value, err := w.Wait(context.Background())
+			if string(value) != string(tt.value) || !errors.Is(err, tt.err) {
+				t.Fatalf("value=%s, err=%v", value, err)
+			}
+		})
+	}
+}
+
+func TestRegistryAddDuplicate(t *testing.T) {
+	r := NewRegistry()
+	exp := time.Now().Add(time.Minute)
+	if err := r.Add(NewWaiter("a", exp)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add(NewWaiter("a", exp)); err == nil {
+		t.Fatal("重复的消息ID应返回错误")
+	}
+	r.Remove("a")
+	r.Remove("a")
+	if err := r.Add(NewWaiter("a", exp)); err != nil {
+		t.Fatalf("移除后可以重新注册，err=%v", err)
+	}
+}
+
+func TestRegistryAckAndProgress(t *testing.T) {
+	r := NewRegistry()
+	w := NewWaiter("a", time.Now().Add(time.Minute))
+	r.Add(w)
+	if r.Ack("b") || r.Progress(MessageProgress{MsgId: "b"}) {
+		t.Fatal("不存在的等待器不应被找到")
+	}
+	for i := 1; i <= 3; i++ {
+		if !r.Progress(MessageProgress{MsgId: "a", Percent: i}) {
+			t.Fatal("没有找到等待器")
+		}
+	}
+	if !w.Acked() {
+		t.Fatal("收到进度应视为已确认")
+	}
+	if err := w.WaitAck(context.Background(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// 只保留最新的进度
+	if p := <-w.Progress(); p.Percent != 3 {
+		t.Fatalf("percent=%d, want=3", p.Percent)
+	}
+	select {
+	case p := <-w.Progress():
+		t.Fatalf("旧的进度应被丢弃，percent=%d", p.Percent)
+	default:
+	}
+}
+
+func TestWaiterTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		expiration time.Duration
+		timeout    time.Duration
+		err        error
+	}{
+		{"指定超时", time.Minute, 10 * time.Millisecond, ErrTimeout},
+		{"过期时间先到", 10 * time.Millisecond, time.Minute, ErrTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWaiter("a", time.Now().Add(tt.expiration))
+			if err := w.WaitAck(context.Background(), tt.timeout); !errors.Is(err, ErrAckTimeout) {
+				t.Fatalf("err=%v, want=%v", err, ErrAckTimeout)
+			}
+			if _, err := w.WaitComplete(context.Background(), tt.timeout); !errors.Is(err, tt.err) {
+				t.Fatalf("err=%v, want=%v", err, tt.err)
+			}
+		})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := NewWaiter("a", time.Now().Add(time.Minute))
+	if _, err := w.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("ctx取消后应返回ctx的错误，err=%v", err)
+	}
+}
+
+func TestRegistrySweep(t *testing.T) {
+	r := NewRegistry()
+	now := time.Now()
+	r.Add(NewWaiter("expired", now.Add(-time.Second)))
+	r.Add(NewWaiter("alive", now.Add(time.Minute)))
+	if n := r.Sweep(now); n != 1 {
+		t.Fatalf("n=%d, want=1", n)
+	}
+	if r.Resolve("expired", nil) || !r.Resolve("alive", nil) {
+		t.Fatal("只应清理过期的等待器")
+	}
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	r := NewRegistry()
+	exp := time.Now().Add(time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprint(i)
+		w := NewWaiter(id, exp)
+		if err := r.Add(w); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			r.Ack(id)
+			r.Progress(MessageProgress{MsgId: id})
+			r.Resolve(id, []byte(id))
+		}()
+		go func() {
+			defer wg.Done()
+			if value, err := w.Wait(context.Background()); err != nil || string(value) != id {
+				t.Errorf("value=%s, err=%v", value, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if r.Len() != 0 {
+		t.Fatalf("len=%d, want=0", r.Len())
+	}
+}
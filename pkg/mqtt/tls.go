@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/shellus/frp-daemon/pkg/types"
+)
+
+// tlsSchemes 使用TLS连接的broker地址协议，paho v3.1.1和paho.golang均支持
+var tlsSchemes = map[string]bool{
+	"ssl":   true,
+	"tls":   true,
+	"mqtts": true,
+	"tcps":  true,
+}
+
+// newTLSConfig 根据配置创建TLS配置，未配置TLS时返回nil，此时使用TLS协议的broker地址会使用系统根证书
+func newTLSConfig(broker string, config *types.TLSConfig) (*tls.Config, error) {
+	if config == nil {
+		return nil, nil
+	}
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt config broker无效: %v", err)
+	}
+	if !tlsSchemes[u.Scheme] {
+		return nil, fmt.Errorf("mqtt config 配置了tls，broker需使用ssl://、tls://或mqtts://，broker=%s", broker)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	switch config.MinVersion {
+	case "", "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("mqtt config tls.min_version不支持，min_version=%s", config.MinVersion)
+	}
+
+	if config.CAFile != "" {
+		caData, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取CA证书失败，ca_file=%s, Error=%v", config.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("CA证书中没有有效的PEM证书，ca_file=%s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("mqtt config tls.cert_file和tls.key_file需要同时配置")
+	}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("加载客户端证书失败，cert_file=%s, key_file=%s, Error=%v", config.CertFile, config.KeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
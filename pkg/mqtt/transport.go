@@ -0,0 +1,51 @@
+package mqtt
+
+import (
+	"time"
+)
+
+// MQTT协议版本，通过MQTTClientOpts.MQTTVersion选择
+const (
+	MQTTv311 = 3
+	MQTTv5   = 5
+)
+
+// Message 传输层收到的消息，与MQTT协议版本无关
+type Message struct {
+	Topic   string
+	Payload []byte
+	// Properties 收到的MQTT 5属性，v3.1.1连接或发布方没有设置属性时为nil
+	Properties *PublishOptions
+}
+
+// TransportHandler 传输层的订阅回调
+type TransportHandler func(msg Message)
+
+// PublishOptions 发布或收到的消息的MQTT 5属性，v3.1.1连接时忽略，此时FD协议只使用JSON信封中的字段
+type PublishOptions struct {
+	// Expiry 消息过期时间，代理在过期后丢弃尚未投递的消息，离线节点上线后不会再收到已过期的任务
+	Expiry time.Time
+	// Correlation 关联数据，使用任务消息ID
+	Correlation string
+	// ResponseTopic 响应主题，使用发送方的task.TopicReply，接收方把各类响应发布到其下的子主题
+	ResponseTopic string
+}
+
+// willMessage 遗嘱消息
+type willMessage struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+// Transport MQTT客户端的底层连接，内置paho v3.1.1、paho.golang v5和进程内Hub三种实现
+// FD协议只订阅精确主题，实现不需要支持通配符
+// 订阅回调在传输层的接收协程中按到达顺序同步调用，回调中不应执行耗时操作
+type Transport interface {
+	Connect() error
+	Disconnect()
+	Publish(topic string, payload []byte, qos byte, retain bool, opts *PublishOptions) error
+	Subscribe(topic string, qos byte, handler TransportHandler) error
+	Unsubscribe(topic string) error
+}
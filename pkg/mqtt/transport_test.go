@@ -0,0 +1,130 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/shellus/frp-daemon/pkg/mqtt/task"
+)
+
+func TestReceivedProperties(t *testing.T) {
+	expiry := uint32(60)
+	tests := []struct {
+		name  string
+		props *paho.PublishProperties
+		want  *PublishOptions
+	}{
+		{"没有属性", nil, nil},
+		{"只有内容类型", &paho.PublishProperties{ContentType: "application/json"}, nil},
+		{"任务消息", &paho.PublishProperties{MessageExpiry: &expiry, CorrelationData: []byte("a"), ResponseTopic: "test/ctl"},
+			&PublishOptions{Expiry: time.Now().Add(time.Minute), Correlation: "a", ResponseTopic: "test/ctl"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := receivedProperties(tt.props)
+			if tt.want == nil {
+				if got != nil {
+					t.Fatalf("got=%+v, want=nil", got)
+				}
+				return
+			}
+			if got == nil || got.Correlation != tt.want.Correlation || got.ResponseTopic != tt.want.ResponseTopic {
+				t.Fatalf("got=%+v, want=%+v", got, tt.want)
+			}
+			if d := got.Expiry.Sub(tt.want.Expiry); d < -time.Second || d > time.Second {
+				t.Fatalf("expiry=%v, want=%v", got.Expiry, tt.want.Expiry)
+			}
+		})
+	}
+}
+
+// MQTT 5任务带有响应主题时响应发布到其下并沿用关联数据，没有时按信封中的发送方回复
+func TestReplyToResponseTopic(t *testing.T) {
+	hub := NewHub()
+	h := newCountingHandler()
+	close(h.release)
+	newHubMQTT(t, hub, "client", func(m *MQTT) {
+		m.SubscribeAction("ping", h.handle)
+	})
+	tests := []struct {
+		name  string
+		id    string
+		opts  *PublishOptions
+		topic string
+		corr  string
+	}{
+		{"MQTT 5", "a", &PublishOptions{ResponseTopic: "test/elsewhere", Correlation: "corr"}, "test/elsewhere/complete", "corr"},
+		{"没有响应主题", "b", &PublishOptions{Correlation: "corr"}, task.TopicComplete("test", "ctl"), "corr"},
+		{"v3.1.1", "c", nil, task.TopicComplete("test", "ctl"), "c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := hub.Transport()
+			peer.Connect()
+			defer peer.Disconnect()
+			replies := make(chan Message, 1)
+			peer.Subscribe(tt.topic, 1, func(msg Message) { replies <- msg })
+
+			msg := newPending("ctl", "client", tt.id, "ping")
+			data, err := msg.Marshal(task.ProtocolV2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := peer.Publish(task.TopicPending("test", "client"), data, 1, false, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case reply := <-replies:
+				if reply.Properties == nil || reply.Properties.Correlation != tt.corr {
+					t.Fatalf("properties=%+v, want correlation=%s", reply.Properties, tt.corr)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("没有在%s上收到响应", tt.topic)
+			}
+		})
+	}
+}
+
+// 带有关联数据的响应按关联数据匹配等待器，没有报文属性时按信封中的消息ID匹配
+func TestReplyMatchesCorrelation(t *testing.T) {
+	hub := NewHub()
+	ctl := newHubMQTT(t, hub, "ctl", nil)
+	tests := []struct {
+		name  string
+		id    string
+		envId string
+		opts  func(id string) *PublishOptions
+	}{
+		{"关联数据", "a", "other", func(id string) *PublishOptions { return &PublishOptions{Correlation: id} }},
+		{"信封中的消息ID", "b", "", func(id string) *PublishOptions { return nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 模拟的接收方，记录任务消息的报文属性并回复
+			peer := hub.Transport()
+			peer.Connect()
+			defer peer.Disconnect()
+			peer.Subscribe(task.TopicPending("test", "client"), 1, func(msg Message) {
+				if msg.Properties == nil || msg.Properties.ResponseTopic != task.TopicReply("test", "ctl") || msg.Properties.Correlation != tt.id {
+					t.Errorf("任务消息的报文属性错误，properties=%+v", msg.Properties)
+				}
+				envId := tt.envId
+				if envId == "" {
+					envId = tt.id
+				}
+				data, _ := json.Marshal(task.MessageComplete{MsgId: envId, Value: []byte(`"ok"`)})
+				peer.Publish(task.ReplyTopic(msg.Properties.ResponseTopic, task.ReplyComplete), data, 1, false, tt.opts(tt.id))
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			value, err := ctl.Call(ctx, newPending("ctl", "client", tt.id, "ping"))
+			if err != nil || string(value) != `"ok"` {
+				t.Fatalf("value=%s, err=%v", value, err)
+			}
+		})
+	}
+}
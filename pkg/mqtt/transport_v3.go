@@ -0,0 +1,106 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	pahomqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+	"github.com/shellus/frp-daemon/pkg/types"
+)
+
+// pahoV3Transport 基于paho.mqtt.golang的MQTT 3.1.1连接
+type pahoV3Transport struct {
+	broker string
+	paho   pahomqtt.Client
+	logger zerolog.Logger
+}
+
+func newPahoV3Transport(config types.MQTTClientOpts, cleanSession bool, will willMessage, tlsConfig *tls.Config, logger zerolog.Logger) *pahoV3Transport {
+	t := &pahoV3Transport{
+		broker: config.Broker,
+		logger: logger,
+	}
+
+	opts := pahomqtt.NewClientOptions()
+	opts.AddBroker(config.Broker)
+	opts.SetUsername(config.Username)
+	opts.SetPassword(config.Password)
+	opts.SetClientID(config.ClientID)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	opts.SetCleanSession(cleanSession)
+	opts.SetKeepAlive(30 * time.Second)
+	opts.SetPingTimeout(10 * time.Second)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(1 * time.Second)
+	// 添加连接超时
+	opts.SetConnectTimeout(10 * time.Second)
+	// 设置最大重连次数，避免无限等待
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(60 * time.Second)
+
+	// 遗嘱消息，异常断线时由代理发布离线状态到自己的status主题，控制端在一个keepalive周期内即可感知
+	opts.SetBinaryWill(will.topic, will.payload, will.qos, will.retain)
+
+	// 添加连接回调，处理连接失败的情况
+	opts.SetConnectionLostHandler(func(client pahomqtt.Client, err error) {
+		t.logger.Error().Msgf("MQTT连接断开: %v", err)
+	})
+
+	opts.SetOnConnectHandler(func(client pahomqtt.Client) {
+		t.logger.Info().Msg("MQTT连接成功")
+	})
+	t.paho = pahomqtt.NewClient(opts)
+	return t
+}
+
+func (t *pahoV3Transport) Connect() error {
+	connToken := t.paho.Connect()
+	// 等待连接完成，设置超时
+	if !connToken.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("MQTT连接超时，请检查服务器地址或网络连接：%s", t.broker)
+	}
+
+	if connToken.Error() != nil {
+		return fmt.Errorf("MQTT连接失败，请检查用户名密码是否正确：%s", connToken.Error())
+	}
+	return nil
+}
+
+// IsConnected 连接断开后paho在后台重连，重连期间返回false
+func (t *pahoV3Transport) IsConnected() bool {
+	return t.paho.IsConnectionOpen()
+}
+
+func (t *pahoV3Transport) Disconnect() {
+	t.paho.Disconnect(250)
+}
+
+func (t *pahoV3Transport) Publish(topic string, payload []byte, qos byte, retain bool, opts *PublishOptions) error {
+	token := t.paho.Publish(topic, qos, retain, payload)
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+func (t *pahoV3Transport) Subscribe(topic string, qos byte, handler TransportHandler) error {
+	token := t.paho.Subscribe(topic, qos, func(client pahomqtt.Client, msg pahomqtt.Message) {
+		handler(Message{Topic: msg.Topic(), Payload: msg.Payload()})
+	})
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+func (t *pahoV3Transport) Unsubscribe(topic string) error {
+	token := t.paho.Unsubscribe(topic)
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
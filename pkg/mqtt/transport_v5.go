@@ -0,0 +1,255 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rs/zerolog"
+	"github.com/shellus/frp-daemon/pkg/types"
+)
+
+// sessionExpiryInterval MQTT 5持久会话的保留时间，与任务最长有效期3天一致
+const sessionExpiryInterval = 3 * 24 * 60 * 60
+
+// pahoV5Transport 基于paho.golang的MQTT 5连接
+// 发布任务时设置消息过期间隔、关联数据和响应主题，代理会丢弃离线期间已过期的任务
+type pahoV5Transport struct {
+	broker string
+	config autopaho.ClientConfig
+	cm     *autopaho.ConnectionManager
+	cancel context.CancelFunc
+
+	mu       sync.RWMutex
+	handlers map[string]TransportHandler
+	qos      map[string]byte
+	// lastErr 最近一次连接失败的原因
+	lastErr error
+	// connected 当前是否已连接，autopaho没有断开回调，由客户端错误和代理断开回调清除
+	connected bool
+
+	logger zerolog.Logger
+}
+
+func newPahoV5Transport(config types.MQTTClientOpts, cleanSession bool, will willMessage, tlsConfig *tls.Config, logger zerolog.Logger) (*pahoV5Transport, error) {
+	serverUrl, err := url.Parse(config.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt config broker无效: %v", err)
+	}
+	t := &pahoV5Transport{
+		broker:   config.Broker,
+		handlers: make(map[string]TransportHandler),
+		qos:      make(map[string]byte),
+		logger:   logger,
+	}
+
+	var sessionExpiry uint32
+	if !cleanSession {
+		sessionExpiry = sessionExpiryInterval
+	}
+	t.config = autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{serverUrl},
+		TlsCfg:                        tlsConfig,
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: cleanSession,
+		SessionExpiryInterval:         sessionExpiry,
+		ConnectTimeout:                10 * time.Second,
+		ReconnectBackoff:              autopaho.NewExponentialBackoff(time.Second, 60*time.Second, 2*time.Second, 2),
+		ConnectUsername:               config.Username,
+		ConnectPassword:               []byte(config.Password),
+		// 遗嘱消息，异常断线时由代理发布离线状态到自己的status主题
+		WillMessage: &paho.WillMessage{
+			Topic:   will.topic,
+			Payload: will.payload,
+			QoS:     will.qos,
+			Retain:  will.retain,
+		},
+		WillProperties: &paho.WillProperties{},
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+			t.logger.Info().Msg("MQTT连接成功")
+			t.setConnected(true)
+			t.resubscribe(cm)
+		},
+		OnConnectError: func(err error) {
+			t.mu.Lock()
+			t.lastErr = err
+			t.mu.Unlock()
+			t.logger.Error().Msgf("MQTT连接失败: %v", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: config.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				t.onPublishReceived,
+			},
+			OnClientError: func(err error) {
+				t.setConnected(false)
+				t.logger.Error().Msgf("MQTT连接断开: %v", err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				t.setConnected(false)
+				t.logger.Error().Msgf("MQTT连接被代理断开，reasonCode=%d", d.ReasonCode)
+			},
+		},
+	}
+	return t, nil
+}
+
+func (t *pahoV5Transport) Connect() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cm, err := autopaho.NewConnection(ctx, t.config)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("MQTT连接失败：%v", err)
+	}
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer waitCancel()
+	if err := cm.AwaitConnection(waitCtx); err != nil {
+		cancel()
+		t.mu.RLock()
+		lastErr := t.lastErr
+		t.mu.RUnlock()
+		if lastErr != nil {
+			return fmt.Errorf("MQTT连接失败，请检查用户名密码是否正确：%v", lastErr)
+		}
+		return fmt.Errorf("MQTT连接超时，请检查服务器地址或网络连接：%s", t.broker)
+	}
+	t.cm = cm
+	t.cancel = cancel
+	return nil
+}
+
+func (t *pahoV5Transport) setConnected(connected bool) {
+	t.mu.Lock()
+	t.connected = connected
+	t.mu.Unlock()
+}
+
+// IsConnected 连接断开后autopaho在后台重连，重连期间返回false
+func (t *pahoV5Transport) IsConnected() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.connected
+}
+
+func (t *pahoV5Transport) Disconnect() {
+	if t.cm == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	t.cm.Disconnect(ctx)
+	t.cancel()
+	t.setConnected(false)
+}
+
+func (t *pahoV5Transport) Publish(topic string, payload []byte, qos byte, retain bool, opts *PublishOptions) error {
+	if t.cm == nil {
+		return autopaho.ConnectionDownError
+	}
+	pub := &paho.Publish{
+		Topic:      topic,
+		QoS:        qos,
+		Retain:     retain,
+		Payload:    payload,
+		Properties: &paho.PublishProperties{ContentType: "application/json"},
+	}
+	if opts != nil {
+		if !opts.Expiry.IsZero() {
+			expiry := uint32(1)
+			if remain := time.Until(opts.Expiry); remain > time.Second {
+				expiry = uint32(remain / time.Second)
+			}
+			pub.Properties.MessageExpiry = &expiry
+		}
+		if opts.Correlation != "" {
+			pub.Properties.CorrelationData = []byte(opts.Correlation)
+		}
+		pub.Properties.ResponseTopic = opts.ResponseTopic
+	}
+	resp, err := t.cm.Publish(context.Background(), pub)
+	if err != nil {
+		return err
+	}
+	if resp != nil && resp.ReasonCode >= 0x80 {
+		return fmt.Errorf("代理拒绝了消息，topic=%s, reasonCode=%d", topic, resp.ReasonCode)
+	}
+	return nil
+}
+
+func (t *pahoV5Transport) Subscribe(topic string, qos byte, handler TransportHandler) error {
+	t.mu.Lock()
+	t.handlers[topic] = handler
+	t.qos[topic] = qos
+	t.mu.Unlock()
+	if t.cm == nil {
+		return autopaho.ConnectionDownError
+	}
+	_, err := t.cm.Subscribe(context.Background(), &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}},
+	})
+	return err
+}
+
+func (t *pahoV5Transport) Unsubscribe(topic string) error {
+	t.mu.Lock()
+	delete(t.handlers, topic)
+	delete(t.qos, topic)
+	t.mu.Unlock()
+	if t.cm == nil {
+		return autopaho.ConnectionDownError
+	}
+	_, err := t.cm.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: []string{topic}})
+	return err
+}
+
+// resubscribe 重连后重新订阅，会话已过期或被代理清除时订阅不会保留
+func (t *pahoV5Transport) resubscribe(cm *autopaho.ConnectionManager) {
+	t.mu.RLock()
+	subs := make([]paho.SubscribeOptions, 0, len(t.qos))
+	for topic, qos := range t.qos {
+		subs = append(subs, paho.SubscribeOptions{Topic: topic, QoS: qos})
+	}
+	t.mu.RUnlock()
+	if len(subs) == 0 {
+		return
+	}
+	if _, err := cm.Subscribe(context.Background(), &paho.Subscribe{Subscriptions: subs}); err != nil {
+		t.logger.Error().Msgf("MQTT重新订阅失败: %v", err)
+	}
+}
+
+// onPublishReceived 按主题分发收到的消息，FD协议的订阅都是精确主题，不含通配符
+func (t *pahoV5Transport) onPublishReceived(pr paho.PublishReceived) (bool, error) {
+	t.mu.RLock()
+	handler, ok := t.handlers[pr.Packet.Topic]
+	t.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	handler(Message{Topic: pr.Packet.Topic, Payload: pr.Packet.Payload, Properties: receivedProperties(pr.Packet.Properties)})
+	return true, nil
+}
+
+// receivedProperties 转换收到的报文属性，过期间隔换算为过期时间
+func receivedProperties(p *paho.PublishProperties) *PublishOptions {
+	if p == nil {
+		return nil
+	}
+	opts := &PublishOptions{
+		Correlation:   string(p.CorrelationData),
+		ResponseTopic: p.ResponseTopic,
+	}
+	if p.MessageExpiry != nil {
+		opts.Expiry = time.Now().Add(time.Duration(*p.MessageExpiry) * time.Second)
+	}
+	if *opts == (PublishOptions{}) {
+		return nil
+	}
+	return opts
+}
@@ -28,4 +28,6 @@ const (
 	MessageActionWOL string = "wol"
 	// MessageActionShutdownWindows 对应的Payload是ShutdownWindowsMessage
 	MessageActionShutdownWindows string = "shutdown_windows"
+	// MessageActionFollowLog 对应的Payload是FollowLogMessage，以流式方式返回实例日志
+	MessageActionFollowLog string = "follow_log"
 )
@@ -4,11 +4,35 @@ const (
 	TopicPrefix = "frp-client"
 )
 
+// Version 软件版本，构建时通过 -ldflags "-X github.com/shellus/frp-daemon/pkg/types.Version=x.y.z" 注入
+var Version = "dev"
+
 // InstanceConfigLocal FRP实例配置-本地
 type InstanceConfigLocal struct {
 	Name       string `yaml:"name"`       // 实例名称
 	Version    string `yaml:"version"`    // FRP版本
 	ConfigPath string `yaml:"configPath"` // FRP配置文件
+	// Restart 实例退出后的重启策略，为空时使用默认策略
+	Restart *RestartPolicy `yaml:"restart,omitempty"`
+	// StopTimeout 停止实例时等待frpc退出的秒数，超过后强制结束，为0时使用10秒
+	StopTimeout int `yaml:"stop_timeout,omitempty"`
+}
+
+// 实例重启策略
+const (
+	RestartAlways    = "always"     // 无论退出状态如何都重启
+	RestartOnFailure = "on-failure" // 退出状态不为0时重启
+	RestartNever     = "never"      // 不重启
+)
+
+// RestartPolicy 实例退出后的重启策略，重启间隔从InitialBackoff开始按2倍增长，最长MaxBackoff
+// 运行时间超过MinUptime后退出视为正常运行过一段时间，重启间隔和连续失败次数清零
+type RestartPolicy struct {
+	Policy         string `yaml:"policy,omitempty" json:"policy,omitempty"`                   // always、on-failure或never，为空时使用always
+	MaxRetries     int    `yaml:"max_retries,omitempty" json:"max_retries,omitempty"`         // 连续快速退出超过该次数后判定为崩溃循环并停止重启，为0时使用10，小于0时不限制
+	InitialBackoff int    `yaml:"initial_backoff,omitempty" json:"initial_backoff,omitempty"` // 首次重启前等待的秒数，为0时使用1秒
+	MaxBackoff     int    `yaml:"max_backoff,omitempty" json:"max_backoff,omitempty"`         // 重启前等待的最长秒数，为0时使用300秒
+	MinUptime      int    `yaml:"min_uptime,omitempty" json:"min_uptime,omitempty"`           // 运行不足该秒数就退出算作快速退出，为0时使用10秒
 }
 
 // EMQXAPIConfig EMQX API配置，控制端用来创建MQTT用户使用
@@ -17,15 +41,44 @@ type EMQXAPIConfig struct {
 	ApiAppKey    string `yaml:"api_app_key"`    // API App Key
 	ApiSecretKey string `yaml:"api_secret_key"` // API Secret Key
 	MQTTBroker   string `yaml:"mqtt_broker"`    // MQTT Broker
+	// MQTTBrokers 可选，按优先级排列的多个代理，fdctl new生成的客户端配置使用它们做故障切换，各代理需要共享用户认证数据
+	MQTTBrokers []string `yaml:"mqtt_brokers,omitempty"`
 }
 
 // MQTTClientOpts MQTT客户端选项
 type MQTTClientOpts struct {
-	Broker      string `yaml:"broker"`       // MQTT代理地址
-	ClientID    string `yaml:"client_id"`    // MQTT客户端ID
-	Username    string `yaml:"username"`     // MQTT用户名
-	Password    string `yaml:"password"`     // MQTT密码
-	TopicPrefix string `yaml:"topic_prefix"` // MQTT主题前缀
+	Broker string `yaml:"broker"` // MQTT代理地址
+	// Brokers 按优先级排列的多个代理地址，配置后忽略Broker，当前代理断开超过FailoverTimeout时切换到下一个可用的代理
+	Brokers []string `yaml:"brokers,omitempty"`
+	// FailoverTimeout 当前代理断开多久后切换，单位秒，为空时使用30秒
+	FailoverTimeout int `yaml:"failover_timeout,omitempty"`
+	// FailbackInterval 使用备用代理时每隔多久尝试切回优先级更高的代理，单位秒，为空时使用300秒，-1表示不切回
+	FailbackInterval int    `yaml:"failback_interval,omitempty"`
+	ClientID         string `yaml:"client_id"`    // MQTT客户端ID
+	Username         string `yaml:"username"`     // MQTT用户名
+	Password         string `yaml:"password"`     // MQTT密码
+	TopicPrefix      string `yaml:"topic_prefix"` // MQTT主题前缀
+	// ProtocolVersion 对端版本未知时发送任务使用的FD协议版本，1为旧版字段名，为空时使用1，所有对端都已升级时可以填2
+	ProtocolVersion int `yaml:"protocol_version,omitempty"`
+	// MaxPacketSize 单个MQTT消息的最大字节数，超过后分片发送，为空时使用128KB，需小于代理的报文长度限制
+	MaxPacketSize int `yaml:"max_packet_size,omitempty"`
+	// MQTTVersion MQTT协议版本，3为3.1.1，5为MQTT 5，为空时使用3.1.1
+	MQTTVersion int `yaml:"mqtt_version,omitempty"`
+	// ClockSkewTolerance 接收任务时容忍的时钟偏差，单位秒，任务在过期时间之后的这段时间内仍会执行，为空时使用120秒，-1表示不容忍
+	ClockSkewTolerance int `yaml:"clock_skew_tolerance,omitempty"`
+	// TLS 连接代理的TLS选项，broker需使用ssl://、tls://或mqtts://，为空时使用系统根证书
+	TLS *TLSConfig `yaml:"tls,omitempty"`
+}
+
+// TLSConfig MQTT代理的TLS配置，同时配置cert_file和key_file时使用双向认证
+type TLSConfig struct {
+	CAFile     string `yaml:"ca_file,omitempty"`     // 代理证书的CA，PEM格式，为空时使用系统根证书
+	CertFile   string `yaml:"cert_file,omitempty"`   // 客户端证书，PEM格式
+	KeyFile    string `yaml:"key_file,omitempty"`    // 客户端私钥，PEM格式
+	ServerName string `yaml:"server_name,omitempty"` // SNI及证书校验使用的主机名，为空时使用broker地址中的主机名
+	MinVersion string `yaml:"min_version,omitempty"` // 最低TLS版本，1.2或1.3，为空时使用1.2
+	// InsecureSkipVerify 不校验代理证书，仅用于测试
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
 }
 
 // ClientConfig 客户端配置，这是本程序的客户端配置，不是MQTT的客户端配置
@@ -33,4 +86,8 @@ type ClientAuth struct {
 	Name     string `yaml:"name"`      // 客户端名称，无实际用途
 	ClientId string `yaml:"client_id"` // 客户端ID，会作为mqtt的用户名
 	Password string `yaml:"password"`  // 客户端密码，会作为mqtt的密码
+	// SealKey 任务负载加密密钥，base64编码，控制端和该被控端各持有一份，为空时不加密
+	SealKey string `yaml:"seal_key,omitempty"`
+	// ProtocolVersion 该客户端支持的FD协议版本，为空时使用被控端状态中上报的版本，没有上报时使用mqtt.protocol_version
+	ProtocolVersion int `yaml:"protocol_version,omitempty"`
 }
@@ -2,7 +2,7 @@ package types
 
 // 传输的消息体
 
-// Status 客户端状态，仅被控端向控制端回复
+// Status 客户端状态，仅被控端向控制端回复，作为status主题上MessageStatus的Data字段
 type Status struct {
 	ID             string           `json:"id"`               // 客户端ID
 	LastOnlineTime int64            `json:"last_online_time"` // 最后在线时间
@@ -18,6 +18,36 @@ type InstanceStatus struct {
 	LastLog    []string `json:"last_log"`    // 最后100行日志
 	ExitStatus int      `json:"exit_status"` // 退出状态
 	Pid        int      `json:"pid"`         // 进程ID
+	// RestartCount 实例自动重启的次数
+	RestartCount int `json:"restart_count,omitempty"`
+	// NextRestartTime 等待重启时的下次重启时间, 单位为秒，为0表示没有等待中的重启
+	NextRestartTime int64 `json:"next_restart_time,omitempty"`
+	// CrashLoop 连续快速退出次数超过上限，已停止自动重启
+	CrashLoop bool `json:"crash_loop,omitempty"`
+}
+
+// 实例生命周期事件类型
+const (
+	InstanceEventStarted = "started" // 实例已启动
+	InstanceEventStopped = "stopped" // 实例被主动停止后退出
+	InstanceEventExited  = "exited"  // 实例意外退出
+	// InstanceEventRestarted 实例按重启策略自动重启
+	InstanceEventRestarted = "restarted"
+	// InstanceEventCrashLoop 实例连续快速退出，已停止自动重启
+	InstanceEventCrashLoop = "crash_loop"
+)
+
+// InstanceEvent 实例生命周期事件，被控端记入历史记录
+type InstanceEvent struct {
+	Name       string `json:"name"`                  // 实例名称
+	Type       string `json:"type"`                  // 事件类型
+	Time       int64  `json:"time"`                  // 事件时间, 单位为秒
+	Pid        int    `json:"pid"`                   // 进程ID
+	ExitStatus int    `json:"exit_status,omitempty"` // 退出状态，仅退出事件有效
+	// RestartCount 实例自动重启的次数
+	RestartCount int `json:"restart_count,omitempty"`
+	// NextRestartTime 退出事件中表示将在该时间重启, 单位为秒，为0表示不会自动重启
+	NextRestartTime int64 `json:"next_restart_time,omitempty"`
 }
 
 // PingMessage 心跳消息，双向共用
@@ -31,6 +61,10 @@ type InstanceConfigRemote struct {
 	Name           string `yaml:"name"`            // 实例名称
 	Version        string `yaml:"version"`         // FRP版本
 	ConfigContent  string `yaml:"config_content"`  // FRP配置文件内容
+	// Restart 实例重启策略，为空时被控端使用默认策略
+	Restart *RestartPolicy `yaml:"restart,omitempty"`
+	// StopTimeout 停止实例时等待frpc退出的秒数，为0时被控端使用默认值
+	StopTimeout int `yaml:"stop_timeout,omitempty"`
 }
 
 // DeleteInstanceMessage 删除实例消息，仅控制端向被控端下发
@@ -54,3 +88,10 @@ type ShutdownWindowsMessage struct {
 	Username string `json:"username"` // Windows用户名
 	Password string `json:"password"` // Windows密码
 }
+
+// FollowLogMessage 跟随实例日志消息，仅控制端向被控端以流式方式下发，每行日志是一段流数据
+type FollowLogMessage struct {
+	InstanceName string `json:"instance_name"` // 实例名称
+	Tail         int    `json:"tail"`          // 先返回最近的日志行数
+	Follow       bool   `json:"follow"`        // 为true时持续返回新日志，直到调用方取消或实例退出
+}